@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cyverse-de/model"
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// ComposeBackend is the name of the backend that shells out to
+	// docker-compose (or `docker compose`).
+	ComposeBackend = "compose"
+
+	// EngineBackend is the name of the backend that talks to the Docker Engine
+	// API directly over its unix socket.
+	EngineBackend = "engine"
+
+	// ApptainerBackend is the name of the backend that runs each service with
+	// apptainer (or singularity) without a container daemon.
+	ApptainerBackend = "apptainer"
+)
+
+const (
+	// DockerRuntime is the name of the runtime that uses docker and dockerd.
+	DockerRuntime = "docker"
+
+	// PodmanRuntime is the name of the runtime that uses podman, either through
+	// its CLI or its Docker-compatible API socket.
+	PodmanRuntime = "podman"
+)
+
+// ServiceResult contains the details of a single service run that are
+// available once its container exits. Backends that can't determine a value
+// leave it set to its zero value.
+type ServiceResult struct {
+	ContainerID string
+	ExitCode    int
+	OOMKilled   bool
+
+	// Signal is the signal that killed the container's main process, or zero
+	// if it exited on its own.
+	Signal syscall.Signal
+
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// String describes how the container exited, for example "exit code 137,
+// killed by signal 9 (killed), out of memory".
+func (r *ServiceResult) String() string {
+	parts := []string{fmt.Sprintf("exit code %d", r.ExitCode)}
+	if r.Signal != 0 {
+		parts = append(parts, fmt.Sprintf("killed by signal %d (%s)", int(r.Signal), r.Signal))
+	}
+	if r.OOMKilled {
+		parts = append(parts, "out of memory")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// exitSignal returns the signal that an exit code reports, following the
+// shell convention of exiting with 128 plus the signal number. Returns zero
+// for ordinary exit codes.
+func exitSignal(exitCode int) syscall.Signal {
+	if exitCode > 128 && exitCode < 128+65 {
+		return syscall.Signal(exitCode - 128)
+	}
+	return 0
+}
+
+// ContainerBackend is the interface for the types that execute the services
+// defined in a job's dcompose.JobCompose.
+type ContainerBackend interface {
+	// Login authenticates against a container image registry so that private
+	// images can be pulled.
+	Login(ctx context.Context, registry, username, password string) error
+
+	// Pull pulls the images for all of the services in the job.
+	Pull(ctx context.Context, stdout, stderr io.Writer) error
+
+	// RunService runs the named service to completion. A non-nil error is
+	// returned if the service couldn't be run or if it exited with a non-zero
+	// status. The ServiceResult is returned whenever the container ran, even
+	// if it failed.
+	RunService(ctx context.Context, svcname string, stdout, stderr io.Writer) (*ServiceResult, error)
+
+	// Down removes the containers and anonymous volumes created for the job.
+	Down(ctx context.Context, stdout, stderr io.Writer) error
+}
+
+// NewContainerBackend returns the ContainerBackend selected by the
+// docker.backend config setting. Defaults to the compose backend.
+func NewContainerBackend(cfg *viper.Viper, composer *dcompose.JobCompose, project, workingDir, composeFile string) (ContainerBackend, error) {
+	switch b := cfg.GetString("docker.backend"); b {
+	case "", ComposeBackend:
+		return newComposeBackend(cfg, composer, project, workingDir, composeFile), nil
+	case EngineBackend:
+		return newEngineBackend(cfg, composer, project, workingDir, composeFile)
+	case ApptainerBackend:
+		return newApptainerBackend(cfg, composer, workingDir)
+	default:
+		return nil, fmt.Errorf("unknown docker.backend %q", b)
+	}
+}
+
+// projectName returns the compose project name used for the job's containers.
+func projectName(job *model.Job) string {
+	return strings.Replace(job.InvocationID, "-", "", -1) // dumb hack
+}
+
+// splitImageRef splits an image reference into the repository and the tag or
+// digest. The tag defaults to "latest" if the reference doesn't include one.
+func splitImageRef(ref string) (string, string) {
+	if i := strings.Index(ref, "@"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, "latest"
+}
+
+// imageInspector is implemented by ContainerBackends that can report the
+// digests of the images they pulled.
+type imageInspector interface {
+	// ImageDigests returns the digest of the local copy of each image used by
+	// the job, keyed by the image reference from the docker-compose file.
+	ImageDigests(ctx context.Context) (map[string]string, error)
+}
+
+// imagePinner is implemented by ContainerBackends that can switch the job's
+// services over to the exact images that were pulled, so that a tag that moves
+// while the job runs can't change the tools it uses.
+type imagePinner interface {
+	// PinImages replaces the image references of the job's services with
+	// their repository digests and rewrites the docker-compose file. Returns
+	// the pinned images keyed by their original references. Images that
+	// didn't come from a registry are left alone.
+	PinImages(ctx context.Context) (map[string]PinnedImage, error)
+}
+
+// PinnedImage is an image that was switched over to its digest.
+type PinnedImage struct {
+	Digest    string
+	Reference string
+}
+
+// pinImages inspects each of the composer's images with inspect and switches
+// the services that use them over to name@digest references. The compose file
+// is rewritten afterwards if one is given.
+func pinImages(ctx context.Context, composer *dcompose.JobCompose, composeFile string, inspect func(context.Context, string) (*imageDetails, error)) (map[string]PinnedImage, error) {
+	pinned := make(map[string]PinnedImage)
+	for _, image := range jobImages(composer) {
+		if strings.Contains(image, "@") {
+			continue
+		}
+		details, err := inspect(ctx, image)
+		if err != nil {
+			return nil, err
+		}
+		if digest := details.repoDigest(image); digest != "" {
+			name, _ := splitImageRef(image)
+			pinned[image] = PinnedImage{Digest: digest, Reference: name + "@" + digest}
+		}
+	}
+	for _, svc := range composer.Services {
+		if p, ok := pinned[svc.Image]; ok {
+			svc.Image = p.Reference
+		}
+	}
+
+	if composeFile != "" && len(pinned) > 0 {
+		b, err := yaml.Marshal(composer)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to marshal the docker-compose file")
+		}
+		if err = os.WriteFile(composeFile, b, 0644); err != nil {
+			return nil, errors.Wrapf(err, "failed to rewrite %s", composeFile)
+		}
+	}
+	return pinned, nil
+}
+
+// imageLister is implemented by ContainerBackends that can list the images
+// used by the job's services.
+type imageLister interface {
+	// Images returns the sorted, de-duplicated list of images used by the
+	// job's services. Pinned images are listed by their pinned references.
+	Images() []string
+}
+
+// servicePuller is implemented by ContainerBackends that don't pull missing
+// images when they run a service. It's used for the hooks that run before the
+// job's images are pulled.
+type servicePuller interface {
+	// PullService pulls the image for a single service.
+	PullService(ctx context.Context, svcname string, stdout, stderr io.Writer) error
+}
+
+// containerLocator is implemented by ContainerBackends that can find the
+// container running a service while it runs.
+type containerLocator interface {
+	// ContainerID returns the full ID of the container running the service.
+	// An empty string is returned if the container hasn't been created yet.
+	ContainerID(ctx context.Context, svcname string) (string, error)
+}
+
+// jobImages returns the sorted, de-duplicated list of images used by the job's
+// services.
+func jobImages(composer *dcompose.JobCompose) []string {
+	seen := make(map[string]bool)
+	var images []string
+	for _, svc := range composer.Services {
+		if !seen[svc.Image] {
+			seen[svc.Image] = true
+			images = append(images, svc.Image)
+		}
+	}
+	sort.Strings(images)
+	return images
+}
+
+// imageDetails is the subset of an inspected image that road-runner cares
+// about. It's the same for `docker image inspect` and the Engine API.
+type imageDetails struct {
+	ID          string `json:"Id"`
+	RepoDigests []string
+}
+
+// containerState is the subset of an inspected container's state that
+// road-runner cares about. It's the same for `docker container inspect` and
+// the Engine API.
+type containerState struct {
+	ExitCode   int
+	OOMKilled  bool
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// containerDetails is the subset of an inspected container that road-runner
+// cares about.
+type containerDetails struct {
+	ID    string `json:"Id"`
+	Name  string
+	State containerState
+}
+
+// result returns the ServiceResult for the exited container.
+func (d *containerDetails) result() *ServiceResult {
+	return &ServiceResult{
+		ContainerID: d.ID,
+		ExitCode:    d.State.ExitCode,
+		OOMKilled:   d.State.OOMKilled,
+		Signal:      exitSignal(d.State.ExitCode),
+		StartedAt:   d.State.StartedAt,
+		FinishedAt:  d.State.FinishedAt,
+	}
+}
+
+// digest returns the registry digest of the image pulled for ref, for the
+// checkpoint. An image that was retagged locally gets the digest it was pulled
+// with under another name, and one that didn't come from a registry gets its
+// image ID, since the checkpoint only needs something that changes with the
+// image.
+func (d *imageDetails) digest(ref string) string {
+	if digest := d.repoDigest(ref); digest != "" {
+		return digest
+	}
+	if len(d.RepoDigests) > 0 {
+		_, digest := splitImageRef(d.RepoDigests[0])
+		return digest
+	}
+	return d.ID
+}
+
+// repoDigest returns the registry digest of the image pulled for ref, or an
+// empty string if none of the image's digests are for ref's repository. A
+// digest from another repository can't be used to pin ref, since ref's
+// registry may not have it.
+func (d *imageDetails) repoDigest(ref string) string {
+	name, _ := splitImageRef(ref)
+	for _, rd := range d.RepoDigests {
+		if repo, digest := splitImageRef(rd); repo == name {
+			return digest
+		}
+	}
+	return ""
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/cyverse-de/road-runner/fs"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// apptainerBackend is a ContainerBackend that runs each of the job's services
+// with `apptainer run` or `apptainer exec` rather than through a container
+// daemon. Images are converted to SIF files during the pull.
+type apptainerBackend struct {
+	cfg         *viper.Viper
+	composer    *dcompose.JobCompose
+	workingDir  string
+	imageDir    string
+	ownsImages  bool
+	dataSources map[string]bool
+}
+
+// newApptainerBackend returns an error if the job's egress policy is internal.
+// Apptainer can't give the steps a network of their own, so the policy can't
+// be enforced; none is enforced by running the steps without a network. An
+// error is also returned for the security settings that can't be enforced.
+func newApptainerBackend(cfg *viper.Viper, composer *dcompose.JobCompose, workingDir string) (*apptainerBackend, error) {
+	if n, ok := composer.Networks[dcompose.StepsNetwork]; ok && n.Internal {
+		return nil, fmt.Errorf("the apptainer backend can't enforce the %s egress policy", dcompose.EgressInternal)
+	}
+	if err := checkApptainerSecurity(cfg, composer); err != nil {
+		return nil, err
+	}
+
+	imageDir := cfg.GetString("apptainer.image_dir")
+	ownsImages := imageDir == ""
+	if ownsImages {
+		imageDir = filepath.Join(workingDir, "apptainer-images")
+	}
+
+	// Services that other services take volumes from only exist to provide
+	// those volumes. Apptainer has no equivalent, so their volumes get bound
+	// directly into the services that use them.
+	dataSources := make(map[string]bool)
+	for _, svc := range composer.Services {
+		for _, from := range svc.VolumesFrom {
+			dataSources[from] = true
+		}
+	}
+
+	return &apptainerBackend{
+		cfg:         cfg,
+		composer:    composer,
+		workingDir:  workingDir,
+		imageDir:    imageDir,
+		ownsImages:  ownsImages,
+		dataSources: dataSources,
+	}, nil
+}
+
+func (a *apptainerBackend) command(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, a.cfg.GetString("apptainer.path"), args...)
+}
+
+// imagePath returns the path to the SIF file for an image.
+func (a *apptainerBackend) imagePath(image string) string {
+	name := strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(image)
+	return filepath.Join(a.imageDir, name+".sif")
+}
+
+// images returns the sorted, de-duplicated list of images used by the services
+// that actually get run.
+func (a *apptainerBackend) images() []string {
+	seen := make(map[string]bool)
+	var images []string
+	for svcname, svc := range a.composer.Services {
+		if a.dataSources[svcname] || seen[svc.Image] {
+			continue
+		}
+		seen[svc.Image] = true
+		images = append(images, svc.Image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+// hostPath resolves relative bind sources against the working directory.
+func (a *apptainerBackend) hostPath(p string) string {
+	if strings.HasPrefix(p, ".") {
+		return filepath.Join(a.workingDir, p)
+	}
+	return p
+}
+
+// volumeArgs converts docker-compose volume definitions into apptainer
+// options. Anonymous volumes become scratch directories.
+func (a *apptainerBackend) volumeArgs(volumes []string) []string {
+	var args []string
+	for _, v := range volumes {
+		parts := strings.Split(v, ":")
+		if len(parts) == 1 || (len(parts) == 2 && (parts[1] == "ro" || parts[1] == "rw")) {
+			args = append(args, "--scratch", parts[0])
+			continue
+		}
+		if parts[0] == "" {
+			args = append(args, "--scratch", parts[1])
+			continue
+		}
+		parts[0] = a.hostPath(parts[0])
+		args = append(args, "--bind", strings.Join(parts, ":"))
+	}
+	return args
+}
+
+// checkDataSource returns an error if the data container service provides a
+// volume from its image rather than from the host. Those volumes can't be bound
+// into the services that use them, and binding an empty directory in their
+// place would hide the data that the tool expects.
+func (a *apptainerBackend) checkDataSource(svcname string) error {
+	svc, ok := a.composer.Services[svcname]
+	if !ok {
+		return nil
+	}
+	for _, v := range svc.Volumes {
+		parts := strings.Split(v, ":")
+		if len(parts) > 1 && parts[0] == "" {
+			return fmt.Errorf("data container %s (%s) provides %s from its image, which the apptainer backend doesn't support", svcname, svc.Image, parts[1])
+		}
+	}
+	return nil
+}
+
+// logFiles returns the paths to the files that the service's stdout and stderr
+// would have been written to by the Docker log driver, if any.
+func (a *apptainerBackend) logFiles(svc *dcompose.Service) (string, string) {
+	if svc.Logging == nil {
+		return "", ""
+	}
+	resolve := func(p string) string {
+		if p == "" {
+			return ""
+		}
+		i := strings.Index(p, dcompose.VOLUMEDIR+"/")
+		if i < 0 {
+			return ""
+		}
+		return filepath.Join(a.workingDir, p[i:])
+	}
+	return resolve(svc.Logging.Options["stdout"]), resolve(svc.Logging.Options["stderr"])
+}
+
+// checkApptainerSecurity returns an error if any of the job's services have
+// security settings that apptainer can't enforce. The user from the security
+// profile is checked separately from the job's own UIDs, which have never been
+// enforced by this backend.
+func checkApptainerSecurity(cfg *viper.Viper, composer *dcompose.JobCompose) error {
+	profile, err := dcompose.ReadSecurityProfile(cfg)
+	if err != nil {
+		return err
+	}
+	for svcname, svc := range composer.Services {
+		if _, err = securityArgs(svcname, svc); err != nil {
+			return err
+		}
+		if profile == nil || !strings.HasPrefix(svcname, "step_") {
+			continue
+		}
+		if u := profile.Settings(svc.Image).User; u != nil {
+			if err = checkApptainerUser(svcname, *u); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkApptainerUser returns an error unless the user, in the "uid" or
+// "uid:gid" form, is the one running road-runner. Apptainer runs everything
+// as that user.
+func checkApptainerUser(svcname, u string) error {
+	name := strings.SplitN(u, ":", 2)[0]
+	uid, err := strconv.Atoi(name)
+	if err != nil {
+		found, err := user.Lookup(name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to look up the user for %s", svcname)
+		}
+		if uid, err = strconv.Atoi(found.Uid); err != nil {
+			return errors.Wrapf(err, "failed to look up the user for %s", svcname)
+		}
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("%s has to run as %s, but the apptainer backend can only run it as the user running road-runner", svcname, u)
+	}
+	return nil
+}
+
+// securityArgs returns the apptainer options for the service's capabilities
+// and security options. Images are always read-only and added capabilities are
+// never granted, so read_only and cap_add only ever end up stricter than
+// asked for. Seccomp and AppArmor profiles can only be applied by root.
+func securityArgs(svcname string, svc *dcompose.Service) ([]string, error) {
+	var args []string
+	if len(svc.CapDrop) > 0 {
+		args = append(args, "--drop-caps", strings.Join(svc.CapDrop, ","))
+	}
+	for _, opt := range svc.SecurityOpt {
+		switch {
+		case opt == "no-new-privileges" || opt == "no-new-privileges:true":
+			args = append(args, "--no-privs")
+		case strings.HasPrefix(opt, "seccomp=") || strings.HasPrefix(opt, "apparmor="):
+			parts := strings.SplitN(opt, "=", 2)
+			if parts[1] == "unconfined" {
+				continue
+			}
+			if os.Geteuid() != 0 {
+				return nil, fmt.Errorf("%s needs the %s profile %s, which the apptainer backend can only apply when road-runner runs as root", svcname, parts[0], parts[1])
+			}
+			args = append(args, "--security", parts[0]+":"+parts[1])
+		default:
+			return nil, fmt.Errorf("the apptainer backend doesn't support the security option %q for %s", opt, svcname)
+		}
+	}
+	return args, nil
+}
+
+// runArgs returns the arguments passed to apptainer to run a service. Services
+// with an entrypoint are run with `apptainer exec`, everything else is run with
+// `apptainer run` so the image's own entrypoint is used.
+func (a *apptainerBackend) runArgs(svcname string) ([]string, error) {
+	svc, ok := a.composer.Services[svcname]
+	if !ok {
+		return nil, fmt.Errorf("no such service: %s", svcname)
+	}
+
+	subcommand := "run"
+	if svc.EntryPoint != "" {
+		subcommand = "exec"
+	}
+
+	args := []string{subcommand, "--cleanenv", "--no-home"}
+
+	if svc.NetworkMode == "none" {
+		args = append(args, "--net", "--network", "none")
+	}
+
+	security, err := securityArgs(svcname, svc)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, security...)
+
+	if svc.WorkingDir != "" {
+		args = append(args, "--pwd", svc.WorkingDir)
+	}
+
+	var envKeys []string
+	for k := range svc.Environment {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		args = append(args, "--env", fmt.Sprintf("%s=%s", k, svc.Environment[k]))
+	}
+
+	for _, from := range svc.VolumesFrom {
+		if err := a.checkDataSource(from); err != nil {
+			return nil, err
+		}
+		if dc, ok := a.composer.Services[from]; ok {
+			args = append(args, a.volumeArgs(dc.Volumes)...)
+		}
+	}
+
+	args = append(args, a.volumeArgs(svc.Volumes)...)
+
+	for _, d := range svc.Devices {
+		parts := strings.Split(d, ":")
+		bind := parts[0]
+		if len(parts) > 1 && parts[1] != "" {
+			bind = fmt.Sprintf("%s:%s", parts[0], parts[1])
+		}
+		args = append(args, "--bind", bind)
+	}
+
+	args = append(args, a.imagePath(svc.Image))
+	if svc.EntryPoint != "" {
+		args = append(args, strings.Fields(svc.EntryPoint)...)
+	}
+	args = append(args, svc.Command...)
+
+	return args, nil
+}
+
+// Login runs "apptainer registry login" for the registry.
+func (a *apptainerBackend) Login(ctx context.Context, registry, username, password string) error {
+	loginCommand := a.command(ctx, "registry", "login", "--username", username, "--password-stdin", "docker://"+registry)
+	loginCommand.Env = os.Environ()
+	loginCommand.Stdin = strings.NewReader(password)
+	loginCommand.Stdout = logWriter
+	loginCommand.Stderr = logWriter
+	return loginCommand.Run()
+}
+
+// Images returns the sorted, de-duplicated list of images used by the job.
+func (a *apptainerBackend) Images() []string {
+	return jobImages(a.composer)
+}
+
+// Pull converts each of the images used by the job into a SIF file.
+func (a *apptainerBackend) Pull(ctx context.Context, stdout, stderr io.Writer) error {
+	if err := os.MkdirAll(a.imageDir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %s", a.imageDir)
+	}
+	for _, image := range a.images() {
+		if err := a.pullImage(ctx, image, stdout, stderr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PullService converts the image for a single service into a SIF file.
+func (a *apptainerBackend) PullService(ctx context.Context, svcname string, stdout, stderr io.Writer) error {
+	svc, ok := a.composer.Services[svcname]
+	if !ok {
+		return fmt.Errorf("no such service: %s", svcname)
+	}
+	if err := os.MkdirAll(a.imageDir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create %s", a.imageDir)
+	}
+	return a.pullImage(ctx, svc.Image, stdout, stderr)
+}
+
+// pullImage converts an image into a SIF file.
+func (a *apptainerBackend) pullImage(ctx context.Context, image string, stdout, stderr io.Writer) error {
+	pullCommand := a.command(ctx, "pull", "--force", a.imagePath(image), "docker://"+image)
+	pullCommand.Env = os.Environ()
+	pullCommand.Stdout = stdout
+	pullCommand.Stderr = stderr
+	if err := pullCommand.Run(); err != nil {
+		return errors.Wrapf(err, "failed to pull %s", image)
+	}
+	return nil
+}
+
+// RunService runs a service with apptainer. Services that only provide volumes
+// to other services are skipped, as long as their volumes come from the host.
+func (a *apptainerBackend) RunService(ctx context.Context, svcname string, stdout, stderr io.Writer) (*ServiceResult, error) {
+	if a.dataSources[svcname] {
+		if err := a.checkDataSource(svcname); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(stdout, "%s only provides volumes, skipping\n", svcname)
+		return &ServiceResult{}, nil
+	}
+
+	args, err := a.runArgs(svcname)
+	if err != nil {
+		return nil, err
+	}
+
+	// Write the output to the same files that the Docker log driver would have.
+	stdoutPath, stderrPath := a.logFiles(a.composer.Services[svcname])
+	if stdoutPath != "" {
+		f, err := fs.CreateLogFile(stdoutPath, maxLogFileSize(a.cfg))
+		if err != nil {
+			log.Error(err)
+		} else {
+			defer f.Close()
+			stdout = io.MultiWriter(stdout, f)
+		}
+	}
+	if stderrPath != "" {
+		f, err := fs.CreateLogFile(stderrPath, maxLogFileSize(a.cfg))
+		if err != nil {
+			log.Error(err)
+		} else {
+			defer f.Close()
+			stderr = io.MultiWriter(stderr, f)
+		}
+	}
+
+	runCommand := a.command(ctx, args...)
+	runCommand.Env = os.Environ()
+	runCommand.Dir = a.workingDir
+
+	// Give the container a chance to exit cleanly when the context is
+	// cancelled or times out.
+	runCommand.Cancel = func() error {
+		return runCommand.Process.Signal(syscall.SIGTERM)
+	}
+	runCommand.WaitDelay = 10 * time.Second
+
+	runCommand.Stdout = stdout
+	runCommand.Stderr = stderr
+	err = runCommand.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result := &ServiceResult{ExitCode: exitErr.ExitCode(), Signal: exitSignal(exitErr.ExitCode())}
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			result.Signal = status.Signal()
+		}
+		return result, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceResult{}, nil
+}
+
+// Down removes the SIF files created for the job, unless they're kept in a
+// shared directory set with apptainer.image_dir. Apptainer doesn't leave any
+// containers behind.
+func (a *apptainerBackend) Down(ctx context.Context, stdout, stderr io.Writer) error {
+	if !a.ownsImages {
+		return nil
+	}
+	fmt.Fprintf(stdout, "Removing %s\n", a.imageDir)
+	return os.RemoveAll(a.imageDir)
+}
+
+func (a *apptainerBackend) planLogin(registry, username, password string) [][]string {
+	return [][]string{a.command(context.Background(), "registry", "login", "--username", username, "--password-stdin", "docker://"+registry).Args}
+}
+
+func (a *apptainerBackend) planPull() [][]string {
+	var cmds [][]string
+	for _, image := range a.images() {
+		cmds = append(cmds, a.command(context.Background(), "pull", "--force", a.imagePath(image), "docker://"+image).Args)
+	}
+	return cmds
+}
+
+func (a *apptainerBackend) planRunService(svcname string) ([][]string, error) {
+	if a.dataSources[svcname] {
+		return nil, a.checkDataSource(svcname)
+	}
+	args, err := a.runArgs(svcname)
+	if err != nil {
+		return nil, err
+	}
+	return [][]string{a.command(context.Background(), args...).Args}, nil
+}
+
+func (a *apptainerBackend) planDown() [][]string {
+	if !a.ownsImages {
+		return nil
+	}
+	return [][]string{{"rm", "-rf", a.imageDir}}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/spf13/viper"
+)
+
+func TestApptainerRunArgs(t *testing.T) {
+	jc, err := dcompose.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jc.Services["data_0_0"] = &dcompose.Service{
+		Image:   "data:1",
+		Volumes: []string{"/host/ref:/ref:ro"},
+	}
+	jc.Services["step_0"] = &dcompose.Service{
+		Image:       "tool:1.0",
+		Command:     []string{"--in", "file.txt"},
+		Environment: map[string]string{"B": "2", "A": "1"},
+		WorkingDir:  dcompose.WORKDIR,
+		Volumes: []string{
+			"/work/workingvolume:/de-app-work:rw",
+			"./tmpfiles:/tmp:rw",
+			"/scratch:rw",
+		},
+		VolumesFrom: []string{"data_0_0"},
+		Devices:     []string{"/dev/fuse:/dev/fuse:rwm"},
+	}
+	jc.Services["step_1"] = &dcompose.Service{
+		Image:      "tool:1.0",
+		EntryPoint: "/bin/sh -c",
+		Command:    []string{"true"},
+	}
+
+	a, err := newApptainerBackend(viper.New(), jc, "/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args, err := a.runArgs("step_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"run", "--cleanenv", "--no-home",
+		"--pwd", "/de-app-work",
+		"--env", "A=1",
+		"--env", "B=2",
+		"--bind", "/host/ref:/ref:ro",
+		"--bind", "/work/workingvolume:/de-app-work:rw",
+		"--bind", "/work/tmpfiles:/tmp:rw",
+		"--scratch", "/scratch",
+		"--bind", "/dev/fuse:/dev/fuse",
+		"/work/apptainer-images/tool_1.0.sif",
+		"--in", "file.txt",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("args were %v", args)
+	}
+
+	args, err = a.runArgs("step_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"exec", "--cleanenv", "--no-home",
+		"/work/apptainer-images/tool_1.0.sif",
+		"/bin/sh", "-c", "true",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("args were %v", args)
+	}
+
+	if _, err = a.runArgs("step_2"); err == nil {
+		t.Error("a missing service did not return an error")
+	}
+
+	if !reflect.DeepEqual(a.images(), []string{"tool:1.0"}) {
+		t.Errorf("images were %v", a.images())
+	}
+}
+
+func TestApptainerDataContainerFromImage(t *testing.T) {
+	jc, err := dcompose.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jc.Services["data_0_0"] = &dcompose.Service{
+		Image:   "reference-data:1",
+		Volumes: []string{":/data:ro"},
+	}
+	jc.Services["step_0"] = &dcompose.Service{
+		Image:       "tool:1.0",
+		VolumesFrom: []string{"data_0_0"},
+	}
+	a, err := newApptainerBackend(viper.New(), jc, "/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = a.RunService(context.Background(), "data_0_0", io.Discard, io.Discard); err == nil {
+		t.Error("a data container that provides a volume from its image didn't return an error")
+	}
+	if _, err = a.runArgs("step_0"); err == nil {
+		t.Error("a step using a data container's image volume didn't return an error")
+	}
+}
+
+func TestApptainerEgress(t *testing.T) {
+	jc, err := dcompose.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jc.Services["step_0"] = &dcompose.Service{Image: "tool:1.0"}
+	jc.Services["upload_outputs"] = &dcompose.Service{Image: "porklock:latest"}
+	jc.InitNetworks("egress-invocation-id", dcompose.EgressNone)
+
+	a, err := newApptainerBackend(viper.New(), jc, "/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := a.runArgs("step_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(args[3:6], []string{"--net", "--network", "none"}) {
+		t.Errorf("args were %v", args)
+	}
+	if args, err = a.runArgs("upload_outputs"); err != nil || containsString(args, "--net") {
+		t.Errorf("args were %v, error was %v", args, err)
+	}
+
+	jc.InitNetworks("egress-invocation-id", dcompose.EgressInternal)
+	if _, err = newApptainerBackend(viper.New(), jc, "/work"); err == nil {
+		t.Error("the internal egress policy didn't return an error")
+	}
+}
+
+func TestApptainerSecurity(t *testing.T) {
+	jc, err := dcompose.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jc.Services["step_0"] = &dcompose.Service{
+		Image:       "tool:1.0",
+		CapDrop:     []string{"ALL"},
+		CapAdd:      []string{"CHOWN"},
+		ReadOnly:    true,
+		SecurityOpt: []string{"no-new-privileges:true", "seccomp=/etc/seccomp.json"},
+	}
+
+	a, err := newApptainerBackend(viper.New(), jc, "/work")
+	if os.Geteuid() != 0 {
+		if err == nil {
+			t.Error("a seccomp profile didn't return an error without root")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := a.runArgs("step_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"--drop-caps", "ALL", "--no-privs", "--security", "seccomp:/etc/seccomp.json"}
+	if !reflect.DeepEqual(args[3:8], expected) {
+		t.Errorf("args were %v", args)
+	}
+}
+
+func TestApptainerUnsupportedSecurity(t *testing.T) {
+	jc, err := dcompose.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jc.Services["step_0"] = &dcompose.Service{Image: "tool:1.0", SecurityOpt: []string{"label=disable"}}
+	if _, err = newApptainerBackend(viper.New(), jc, "/work"); err == nil {
+		t.Error("an unsupported security option didn't return an error")
+	}
+
+	cfg := viper.New()
+	cfg.Set("security.user", strconv.Itoa(os.Getuid()+1))
+	jc.Services["step_0"] = &dcompose.Service{Image: "tool:1.0"}
+	if _, err = newApptainerBackend(cfg, jc, "/work"); err == nil {
+		t.Error("a user from the security profile didn't return an error")
+	}
+	cfg.Set("security.user", strconv.Itoa(os.Getuid()))
+	if _, err = newApptainerBackend(cfg, jc, "/work"); err != nil {
+		t.Errorf("the current user returned an error: %s", err)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// composeBackend is a ContainerBackend that runs the job's services by
+// shelling out to docker-compose, or to podman-compose when the podman runtime
+// is configured.
+type composeBackend struct {
+	cfg         *viper.Viper
+	composer    *dcompose.JobCompose
+	project     string
+	workingDir  string
+	composeFile string
+}
+
+func newComposeBackend(cfg *viper.Viper, composer *dcompose.JobCompose, project, workingDir, composeFile string) *composeBackend {
+	return &composeBackend{
+		cfg:         cfg,
+		composer:    composer,
+		project:     project,
+		workingDir:  workingDir,
+		composeFile: composeFile,
+	}
+}
+
+func (c *composeBackend) loginCommand(ctx context.Context, registry, username, password string) *exec.Cmd {
+	return DockerCommandContext(
+		c.cfg,
+		ctx,
+		"login",
+		"--username",
+		username,
+		"--password",
+		password,
+		registry,
+	)
+}
+
+func (c *composeBackend) pullCommand(ctx context.Context) *exec.Cmd {
+	args := []string{
+		"-p", c.project,
+		"-f", c.composeFile,
+		"pull",
+	}
+	// podman-compose doesn't accept --parallel.
+	if !usesPodman(c.cfg) {
+		args = append(args, "--parallel")
+	}
+	return DockerComposeCommandContext(c.cfg, ctx, args...)
+}
+
+func (c *composeBackend) upCommand(ctx context.Context, svcname string) *exec.Cmd {
+	return DockerComposeCommandContext(
+		c.cfg,
+		ctx,
+		"-p", c.project,
+		"-f", c.composeFile,
+		"up",
+		"--abort-on-container-exit",
+		"--exit-code-from", svcname,
+		"--no-color",
+		svcname,
+	)
+}
+
+func (c *composeBackend) stopCommand(ctx context.Context, svcname string) *exec.Cmd {
+	return DockerComposeCommandContext(
+		c.cfg,
+		ctx,
+		"-p", c.project,
+		"-f", c.composeFile,
+		"stop",
+		svcname,
+	)
+}
+
+func (c *composeBackend) psCommand(ctx context.Context, svcname string) *exec.Cmd {
+	return DockerComposeCommandContext(
+		c.cfg,
+		ctx,
+		"-p", c.project,
+		"-f", c.composeFile,
+		"ps",
+		"-a",
+		"-q",
+		svcname,
+	)
+}
+
+func (c *composeBackend) downCommand(ctx context.Context) *exec.Cmd {
+	return DockerComposeCommandContext(
+		c.cfg,
+		ctx,
+		"-p", c.project,
+		"-f", c.composeFile,
+		"down",
+		"-v",
+	)
+}
+
+// Login runs "docker login" against the registry.
+func (c *composeBackend) Login(ctx context.Context, registry, username, password string) error {
+	authCommand := c.loginCommand(ctx, registry, username, password)
+	authCommand.Env = os.Environ()
+	authCommand.Stderr = logWriter
+	authCommand.Stdout = logWriter
+	return authCommand.Run()
+}
+
+// inspectCommand returns the command that prints the details of an image as
+// JSON.
+func (c *composeBackend) inspectCommand(ctx context.Context, image string) *exec.Cmd {
+	return DockerCommandContext(c.cfg, ctx, "image", "inspect", "--format", "{{json .}}", image)
+}
+
+// inspectContainerCommand returns the command that prints the details of a
+// container as JSON.
+func (c *composeBackend) inspectContainerCommand(ctx context.Context, id string) *exec.Cmd {
+	return DockerCommandContext(c.cfg, ctx, "container", "inspect", "--format", "{{json .}}", id)
+}
+
+// Pull runs "docker-compose pull" for the job.
+func (c *composeBackend) Pull(ctx context.Context, stdout, stderr io.Writer) error {
+	pullCommand := c.pullCommand(ctx)
+	pullCommand.Env = os.Environ()
+	pullCommand.Dir = c.workingDir
+	pullCommand.Stdout = stdout
+	pullCommand.Stderr = stderr
+	return pullCommand.Run()
+}
+
+// RunService runs "docker-compose up" for a single service, then inspects the
+// service's container for the details in the returned ServiceResult. Only the
+// exit code of docker-compose is available if the container can't be
+// inspected.
+func (c *composeBackend) RunService(ctx context.Context, svcname string, stdout, stderr io.Writer) (*ServiceResult, error) {
+	upCommand := c.upCommand(ctx, svcname)
+	upCommand.Env = os.Environ()
+	upCommand.Stdout = stdout
+	upCommand.Stderr = stderr
+	err := upCommand.Run()
+
+	// Killing docker-compose leaves the container running, so it needs to be
+	// stopped separately when the context is cancelled or times out.
+	if ctx.Err() != nil {
+		c.stop(svcname)
+		return nil, ctx.Err()
+	}
+
+	result, inspectErr := c.inspectService(ctx, svcname)
+	if inspectErr != nil {
+		log.Error(inspectErr)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if result == nil {
+			result = &ServiceResult{ExitCode: exitErr.ExitCode(), Signal: exitSignal(exitErr.ExitCode())}
+		}
+		return result, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		result = &ServiceResult{}
+	}
+	return result, nil
+}
+
+// inspectService runs "docker container inspect" for the service's container.
+func (c *composeBackend) inspectService(ctx context.Context, svcname string) (*ServiceResult, error) {
+	id, err := c.ContainerID(ctx, svcname)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("no container was found for %s", svcname)
+	}
+	inspectCommand := c.inspectContainerCommand(ctx, id)
+	inspectCommand.Env = os.Environ()
+	inspectCommand.Stderr = logWriter
+	out, err := inspectCommand.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to inspect the container for %s", svcname)
+	}
+	var details containerDetails
+	if err = json.Unmarshal(out, &details); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the details of the container for %s", svcname)
+	}
+	return details.result(), nil
+}
+
+// stop runs "docker-compose stop" for a single service.
+func (c *composeBackend) stop(svcname string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	stopCommand := c.stopCommand(ctx, svcname)
+	stopCommand.Env = os.Environ()
+	stopCommand.Stdout = logWriter
+	stopCommand.Stderr = logWriter
+	if err := stopCommand.Run(); err != nil {
+		log.Error(errors.Wrapf(err, "failed to stop %s", svcname))
+	}
+}
+
+// inspectImage runs "docker image inspect" for the image.
+func (c *composeBackend) inspectImage(ctx context.Context, image string) (*imageDetails, error) {
+	inspectCommand := c.inspectCommand(ctx, image)
+	inspectCommand.Env = os.Environ()
+	inspectCommand.Stderr = logWriter
+	out, err := inspectCommand.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to inspect %s", image)
+	}
+	details := &imageDetails{}
+	if err = json.Unmarshal(out, details); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the details of %s", image)
+	}
+	return details, nil
+}
+
+// Images returns the sorted, de-duplicated list of images used by the job.
+func (c *composeBackend) Images() []string {
+	return jobImages(c.composer)
+}
+
+// ImageDigests inspects each of the job's images.
+func (c *composeBackend) ImageDigests(ctx context.Context) (map[string]string, error) {
+	digests := make(map[string]string)
+	for _, image := range jobImages(c.composer) {
+		details, err := c.inspectImage(ctx, image)
+		if err != nil {
+			return nil, err
+		}
+		digests[image] = details.digest(image)
+	}
+	return digests, nil
+}
+
+// PinImages switches the job's services over to the digests of the images
+// that were pulled and rewrites the docker-compose file that the later
+// docker-compose commands read.
+func (c *composeBackend) PinImages(ctx context.Context) (map[string]PinnedImage, error) {
+	return pinImages(ctx, c.composer, c.composeFile, c.inspectImage)
+}
+
+// ContainerID runs "docker-compose ps -q" for the service.
+func (c *composeBackend) ContainerID(ctx context.Context, svcname string) (string, error) {
+	psCommand := c.psCommand(ctx, svcname)
+	psCommand.Env = os.Environ()
+	psCommand.Dir = c.workingDir
+	out, err := psCommand.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to list the container for %s", svcname)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Down runs "docker-compose down -v" for the job.
+func (c *composeBackend) Down(ctx context.Context, stdout, stderr io.Writer) error {
+	downCommand := c.downCommand(ctx)
+	downCommand.Stdout = stdout
+	downCommand.Stderr = stderr
+	return downCommand.Run()
+}
+
+func (c *composeBackend) planLogin(registry, username, password string) [][]string {
+	return [][]string{c.loginCommand(context.Background(), registry, username, password).Args}
+}
+
+func (c *composeBackend) planPull() [][]string {
+	return [][]string{c.pullCommand(context.Background()).Args}
+}
+
+func (c *composeBackend) planRunService(svcname string) ([][]string, error) {
+	return [][]string{c.upCommand(context.Background(), svcname).Args}, nil
+}
+
+func (c *composeBackend) planDown() [][]string {
+	return [][]string{c.downCommand(context.Background()).Args}
+}
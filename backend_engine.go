@@ -0,0 +1,892 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// DefaultDockerSocket is the path to the Docker Engine API socket used when
+// docker.socket isn't set in the config.
+const DefaultDockerSocket = "/var/run/docker.sock"
+
+// DefaultPodmanSocket is the path to podman's Docker-compatible API socket used
+// when podman.socket isn't set in the config.
+const DefaultPodmanSocket = "/run/podman/podman.sock"
+
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// engineClient is a minimal client for the Docker Engine API. It only
+// implements the endpoints that road-runner needs.
+type engineClient struct {
+	http *http.Client
+}
+
+func newEngineClient(socket string) *engineClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &engineClient{
+		http: &http.Client{Transport: transport},
+	}
+}
+
+// engineError is the format of the error messages returned by the Engine API.
+type engineError struct {
+	Message string `json:"message"`
+}
+
+func (c *engineClient) do(ctx context.Context, method, endpoint string, query url.Values, headers map[string]string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	u := "http://docker" + endpoint
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s failed", method, endpoint)
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var e engineError
+		if err = json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Message == "" {
+			return nil, fmt.Errorf("%s %s returned status %d", method, endpoint, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("%s %s returned status %d: %s", method, endpoint, resp.StatusCode, e.Message)
+	}
+
+	return resp, nil
+}
+
+// call performs a request and decodes the JSON response into out, if out is
+// not nil.
+func (c *engineClient) call(ctx context.Context, method, endpoint string, query url.Values, body, out interface{}) error {
+	resp, err := c.do(ctx, method, endpoint, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// engineAuth is the format of the credentials sent to the Engine API.
+type engineAuth struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	ServerAddress string `json:"serveraddress"`
+}
+
+// engineHostConfig is the subset of the Engine API's HostConfig that can be
+// set from a dcompose.Service.
+type engineHostConfig struct {
+	Binds            []string                   `json:",omitempty"`
+	VolumesFrom      []string                   `json:",omitempty"`
+	CapAdd           []string                   `json:",omitempty"`
+	CapDrop          []string                   `json:",omitempty"`
+	SecurityOpt      []string                   `json:",omitempty"`
+	GroupAdd         []string                   `json:",omitempty"`
+	ReadonlyRootfs   bool                       `json:",omitempty"`
+	DNS              []string                   `json:"Dns,omitempty"`
+	DNSSearch        []string                   `json:"DnsSearch,omitempty"`
+	Tmpfs            map[string]string          `json:",omitempty"`
+	NetworkMode      string                     `json:",omitempty"`
+	LogConfig        *engineLogConfig           `json:",omitempty"`
+	Devices          []engineDevice             `json:",omitempty"`
+	Memory           int64                      `json:",omitempty"`
+	MemorySwap       int64                      `json:",omitempty"`
+	MemorySwappiness *int64                     `json:",omitempty"`
+	NanoCPUs         int64                      `json:"NanoCpus,omitempty"`
+	CPUShares        int64                      `json:"CpuShares,omitempty"`
+	CPUQuota         int64                      `json:"CpuQuota,omitempty"`
+	CpusetCpus       string                     `json:",omitempty"`
+	PidsLimit        int64                      `json:",omitempty"`
+	PortBindings     map[string][]engineBinding `json:",omitempty"`
+}
+
+type engineLogConfig struct {
+	Type   string
+	Config map[string]string `json:",omitempty"`
+}
+
+type engineDevice struct {
+	PathOnHost        string
+	PathInContainer   string
+	CgroupPermissions string
+}
+
+type engineBinding struct {
+	HostIP   string `json:"HostIp,omitempty"`
+	HostPort string `json:",omitempty"`
+}
+
+// engineContainerConfig is the request body for creating a container.
+type engineContainerConfig struct {
+	Image        string
+	User         string              `json:",omitempty"`
+	Cmd          []string            `json:",omitempty"`
+	Entrypoint   []string            `json:",omitempty"`
+	Env          []string            `json:",omitempty"`
+	WorkingDir   string              `json:",omitempty"`
+	Labels       map[string]string   `json:",omitempty"`
+	Volumes      map[string]struct{} `json:",omitempty"`
+	ExposedPorts map[string]struct{} `json:",omitempty"`
+	AttachStdout bool
+	AttachStderr bool
+	HostConfig   engineHostConfig
+}
+
+// engineBackend is a ContainerBackend that runs the job's services through the
+// Docker Engine API, or podman's Docker-compatible version of it.
+type engineBackend struct {
+	client      *engineClient
+	composer    *dcompose.JobCompose
+	project     string
+	workingDir  string
+	composeFile string
+	auths       map[string]string
+
+	// networks records the job's networks that are known to exist.
+	networksMu sync.Mutex
+	networks   map[string]bool
+}
+
+func newEngineBackend(cfg *viper.Viper, composer *dcompose.JobCompose, project, workingDir, composeFile string) (*engineBackend, error) {
+	var socket string
+	if usesPodman(cfg) {
+		socket = cfg.GetString("podman.socket")
+		if socket == "" {
+			socket = DefaultPodmanSocket
+		}
+	} else {
+		socket = cfg.GetString("docker.socket")
+		if socket == "" {
+			socket = DefaultDockerSocket
+		}
+	}
+	return &engineBackend{
+		client:      newEngineClient(socket),
+		composer:    composer,
+		project:     project,
+		workingDir:  workingDir,
+		composeFile: composeFile,
+		auths:       make(map[string]string),
+		networks:    make(map[string]bool),
+	}, nil
+}
+
+// Login validates the credentials against the registry and keeps them around
+// for use when pulling images.
+func (e *engineBackend) Login(ctx context.Context, registry, username, password string) error {
+	auth := engineAuth{
+		Username:      username,
+		Password:      password,
+		ServerAddress: registry,
+	}
+	if err := e.client.call(ctx, http.MethodPost, "/auth", nil, auth, nil); err != nil {
+		return err
+	}
+	b, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+	e.auths[registry] = base64.URLEncoding.EncodeToString(b)
+	return nil
+}
+
+// Images returns the sorted, de-duplicated list of images used by the job.
+func (e *engineBackend) Images() []string {
+	return jobImages(e.composer)
+}
+
+// pullMessage is a single progress message returned while pulling an image.
+type pullMessage struct {
+	Status   string `json:"status"`
+	ID       string `json:"id"`
+	Progress string `json:"progress"`
+	Error    string `json:"error"`
+}
+
+// Pull pulls each of the images used by the job's services.
+func (e *engineBackend) Pull(ctx context.Context, stdout, stderr io.Writer) error {
+	for _, image := range e.Images() {
+		if err := e.pullImage(ctx, image, stdout, stderr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PullService pulls the image for a single service.
+func (e *engineBackend) PullService(ctx context.Context, svcname string, stdout, stderr io.Writer) error {
+	svc, ok := e.composer.Services[svcname]
+	if !ok {
+		return fmt.Errorf("no such service: %s", svcname)
+	}
+	return e.pullImage(ctx, svc.Image, stdout, stderr)
+}
+
+// pullImage pulls an image, writing the progress to stdout.
+func (e *engineBackend) pullImage(ctx context.Context, image string, stdout, stderr io.Writer) error {
+	name, tag := splitImageRef(image)
+	query := url.Values{}
+	query.Set("fromImage", name)
+	query.Set("tag", tag)
+
+	headers := map[string]string{}
+	if auth, ok := e.auths[parseRepo(name)]; ok {
+		headers["X-Registry-Auth"] = auth
+	}
+
+	resp, err := e.client.do(ctx, http.MethodPost, "/images/create", query, headers, nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to pull %s", image)
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg pullMessage
+		if err = decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrapf(err, "failed to read the pull progress for %s", image)
+		}
+		if msg.Error != "" {
+			fmt.Fprintln(stderr, msg.Error)
+			return fmt.Errorf("failed to pull %s: %s", image, msg.Error)
+		}
+		if msg.ID != "" {
+			fmt.Fprintf(stdout, "%s: %s %s\n", msg.ID, msg.Status, msg.Progress)
+		} else {
+			fmt.Fprintln(stdout, msg.Status)
+		}
+	}
+}
+
+// inspectImage inspects the image.
+func (e *engineBackend) inspectImage(ctx context.Context, image string) (*imageDetails, error) {
+	details := &imageDetails{}
+	if err := e.client.call(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, details); err != nil {
+		return nil, errors.Wrapf(err, "failed to inspect %s", image)
+	}
+	return details, nil
+}
+
+// ImageDigests inspects each of the job's images.
+func (e *engineBackend) ImageDigests(ctx context.Context) (map[string]string, error) {
+	digests := make(map[string]string)
+	for _, image := range e.Images() {
+		details, err := e.inspectImage(ctx, image)
+		if err != nil {
+			return nil, err
+		}
+		digests[image] = details.digest(image)
+	}
+	return digests, nil
+}
+
+// PinImages switches the job's services over to the digests of the images
+// that were pulled. The docker-compose file isn't used to run anything, but
+// it's rewritten so that it matches what was run.
+func (e *engineBackend) PinImages(ctx context.Context) (map[string]PinnedImage, error) {
+	return pinImages(ctx, e.composer, e.composeFile, e.inspectImage)
+}
+
+// containerName returns the name of the container for a service. Follows the
+// naming convention used by docker-compose if the service doesn't set one.
+func (e *engineBackend) containerName(svcname string) string {
+	if svc, ok := e.composer.Services[svcname]; ok && svc.ContainerName != "" {
+		return svc.ContainerName
+	}
+	return fmt.Sprintf("%s_%s_1", e.project, svcname)
+}
+
+// hostPath resolves relative bind mount sources against the working directory
+// the same way that docker-compose resolves them against the project directory.
+func (e *engineBackend) hostPath(p string) string {
+	if strings.HasPrefix(p, ".") {
+		return filepath.Join(e.workingDir, p)
+	}
+	return p
+}
+
+// securityOpt converts a security_opt from the docker-compose file into the
+// form the Engine API expects. The API takes the contents of a seccomp profile
+// rather than its path, so the profile is read the same way the docker CLI
+// reads it.
+func (e *engineBackend) securityOpt(opt string) (string, error) {
+	profile := strings.TrimPrefix(opt, "seccomp=")
+	if profile == opt || profile == "unconfined" {
+		return opt, nil
+	}
+	b, err := os.ReadFile(e.hostPath(profile))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read the seccomp profile")
+	}
+	var compacted bytes.Buffer
+	if err = json.Compact(&compacted, b); err != nil {
+		return "", errors.Wrapf(err, "failed to parse the seccomp profile %s", profile)
+	}
+	return "seccomp=" + compacted.String(), nil
+}
+
+// containerConfig converts a dcompose.Service into an Engine API container
+// config.
+func (e *engineBackend) containerConfig(svcname string, svc *dcompose.Service) (*engineContainerConfig, error) {
+	var err error
+
+	cfg := &engineContainerConfig{
+		Image:        svc.Image,
+		User:         svc.User,
+		Cmd:          svc.Command,
+		WorkingDir:   svc.WorkingDir,
+		Labels:       map[string]string{},
+		Volumes:      map[string]struct{}{},
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+
+	if svc.EntryPoint != "" {
+		cfg.Entrypoint = strings.Fields(svc.EntryPoint)
+	}
+
+	var envKeys []string
+	for k := range svc.Environment {
+		envKeys = append(envKeys, k)
+	}
+	sort.Strings(envKeys)
+	for _, k := range envKeys {
+		cfg.Env = append(cfg.Env, fmt.Sprintf("%s=%s", k, svc.Environment[k]))
+	}
+
+	for k, v := range svc.Labels {
+		cfg.Labels[k] = v
+	}
+	cfg.Labels[composeProjectLabel] = e.project
+	cfg.Labels[composeServiceLabel] = svcname
+
+	hc := &cfg.HostConfig
+	hc.CapAdd = svc.CapAdd
+	hc.CapDrop = svc.CapDrop
+	hc.ReadonlyRootfs = svc.ReadOnly
+	hc.GroupAdd = svc.GroupAdd
+	for _, opt := range svc.SecurityOpt {
+		if opt, err = e.securityOpt(opt); err != nil {
+			return nil, errors.Wrapf(err, "invalid security_opt for %s", svcname)
+		}
+		hc.SecurityOpt = append(hc.SecurityOpt, opt)
+	}
+	hc.DNS = svc.DNS
+	hc.DNSSearch = svc.DNSSearch
+	hc.NetworkMode = svc.NetworkMode
+	if key := serviceNetwork(svc); key != "" {
+		hc.NetworkMode = e.networkName(key)
+	}
+	hc.CPUShares = svc.CPUShares
+	hc.CpusetCpus = svc.CPUSet
+	hc.PidsLimit = svc.PIDsLimit
+
+	for _, v := range svc.Volumes {
+		parts := strings.Split(v, ":")
+		if len(parts) > 1 && parts[0] == "" {
+			// A data container without a host path, such as ":/data:ro", is
+			// an anonymous volume at the container path.
+			cfg.Volumes[parts[1]] = struct{}{}
+			continue
+		}
+		switch len(parts) {
+		case 1:
+			cfg.Volumes[parts[0]] = struct{}{}
+		case 2:
+			if strings.HasPrefix(parts[0], "/") && (parts[1] == "ro" || parts[1] == "rw") {
+				// An anonymous volume with a mode, which the API doesn't support.
+				cfg.Volumes[parts[0]] = struct{}{}
+			} else {
+				hc.Binds = append(hc.Binds, fmt.Sprintf("%s:%s", e.hostPath(parts[0]), parts[1]))
+			}
+		default:
+			hc.Binds = append(hc.Binds, fmt.Sprintf("%s:%s", e.hostPath(parts[0]), strings.Join(parts[1:], ":")))
+		}
+	}
+
+	for _, from := range svc.VolumesFrom {
+		hc.VolumesFrom = append(hc.VolumesFrom, e.containerName(from))
+	}
+
+	for _, d := range svc.Devices {
+		parts := strings.Split(d, ":")
+		device := engineDevice{PathOnHost: parts[0], PathInContainer: parts[0], CgroupPermissions: "rwm"}
+		if len(parts) > 1 && parts[1] != "" {
+			device.PathInContainer = parts[1]
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			device.CgroupPermissions = parts[2]
+		}
+		hc.Devices = append(hc.Devices, device)
+	}
+
+	if len(svc.TMPFS) > 0 {
+		hc.Tmpfs = make(map[string]string)
+		for _, t := range svc.TMPFS {
+			hc.Tmpfs[t] = ""
+		}
+	}
+
+	if svc.Logging != nil {
+		hc.LogConfig = &engineLogConfig{
+			Type:   svc.Logging.Driver,
+			Config: svc.Logging.Options,
+		}
+	}
+
+	if svc.MemLimit != "" {
+		if hc.Memory, err = strconv.ParseInt(svc.MemLimit, 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid mem_limit %s for %s", svc.MemLimit, svcname)
+		}
+	}
+
+	if svc.MemSwapLimit != "" {
+		if hc.MemorySwap, err = strconv.ParseInt(svc.MemSwapLimit, 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid memswap_limit %s for %s", svc.MemSwapLimit, svcname)
+		}
+	}
+
+	if svc.MemSwappiness != "" {
+		swappiness, err := strconv.ParseInt(svc.MemSwappiness, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid mem_swappiness %s for %s", svc.MemSwappiness, svcname)
+		}
+		hc.MemorySwappiness = &swappiness
+	}
+
+	if svc.CPUs != "" {
+		cpus, err := strconv.ParseFloat(svc.CPUs, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid cpus %s for %s", svc.CPUs, svcname)
+		}
+		hc.NanoCPUs = int64(cpus * 1e9)
+	}
+
+	if svc.CPUQuota != "" {
+		if hc.CPUQuota, err = strconv.ParseInt(svc.CPUQuota, 10, 64); err != nil {
+			return nil, errors.Wrapf(err, "invalid cpu_quota %s for %s", svc.CPUQuota, svcname)
+		}
+	}
+
+	for _, p := range svc.Expose {
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = make(map[string]struct{})
+		}
+		cfg.ExposedPorts[p+"/tcp"] = struct{}{}
+	}
+
+	for _, p := range svc.Ports {
+		parts := strings.Split(p, ":")
+		containerPort := parts[len(parts)-1] + "/tcp"
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = make(map[string]struct{})
+		}
+		cfg.ExposedPorts[containerPort] = struct{}{}
+		if hc.PortBindings == nil {
+			hc.PortBindings = make(map[string][]engineBinding)
+		}
+		binding := engineBinding{}
+		if len(parts) > 1 {
+			binding.HostPort = parts[len(parts)-2]
+		}
+		if len(parts) > 2 {
+			binding.HostIP = parts[0]
+		}
+		hc.PortBindings[containerPort] = append(hc.PortBindings[containerPort], binding)
+	}
+
+	return cfg, nil
+}
+
+// engineNetworkConfig is the request body for creating a network.
+type engineNetworkConfig struct {
+	Name     string
+	Driver   string            `json:",omitempty"`
+	Internal bool              `json:",omitempty"`
+	Options  map[string]string `json:",omitempty"`
+	Labels   map[string]string `json:",omitempty"`
+}
+
+// serviceNetwork returns the key of the network in the docker-compose file
+// that the service is attached to, or an empty string if it uses its
+// network_mode instead. Containers are created on a single network, so only
+// the first one is used.
+func serviceNetwork(svc *dcompose.Service) string {
+	if svc.NetworkMode != "" || len(svc.Networks) == 0 {
+		return ""
+	}
+	var keys []string
+	for k := range svc.Networks {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys[0]
+}
+
+// networkName returns the name of the job's network, named the same way that
+// docker-compose names it.
+func (e *engineBackend) networkName(key string) string {
+	return fmt.Sprintf("%s_%s", e.project, key)
+}
+
+// ensureNetwork creates the network from the docker-compose file if it doesn't
+// exist yet. It's labeled with the project so that Down can remove it.
+func (e *engineBackend) ensureNetwork(ctx context.Context, key string) error {
+	e.networksMu.Lock()
+	defer e.networksMu.Unlock()
+	if e.networks[key] {
+		return nil
+	}
+
+	name := e.networkName(key)
+	err := e.client.call(ctx, http.MethodGet, "/networks/"+name, nil, nil, nil)
+	if err != nil && !strings.Contains(err.Error(), "status 404") {
+		return errors.Wrapf(err, "failed to inspect network %s", name)
+	}
+	if err != nil {
+		network := &dcompose.Network{Driver: "bridge"}
+		if n, ok := e.composer.Networks[key]; ok && n != nil {
+			network = n
+		}
+		body := &engineNetworkConfig{
+			Name:     name,
+			Driver:   network.Driver,
+			Internal: network.Internal,
+			Options:  network.DriverOpts,
+			Labels:   map[string]string{composeProjectLabel: e.project},
+		}
+		for k, v := range network.Labels {
+			body.Labels[k] = v
+		}
+		if err = e.client.call(ctx, http.MethodPost, "/networks/create", nil, body, nil); err != nil {
+			return errors.Wrapf(err, "failed to create network %s", name)
+		}
+	}
+
+	if e.networks == nil {
+		e.networks = make(map[string]bool)
+	}
+	e.networks[key] = true
+	return nil
+}
+
+// removeContainer force-removes a container along with its anonymous volumes.
+// Missing containers are not treated as an error.
+func (e *engineBackend) removeContainer(ctx context.Context, nameOrID string) error {
+	query := url.Values{}
+	query.Set("force", "1")
+	query.Set("v", "1")
+	resp, err := e.client.do(ctx, http.MethodDelete, "/containers/"+nameOrID, query, nil, nil)
+	if err != nil {
+		if strings.Contains(err.Error(), "status 404") {
+			return nil
+		}
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// stopContainer stops a running container, giving it a few seconds to exit on
+// its own.
+func (e *engineBackend) stopContainer(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	query := url.Values{}
+	query.Set("t", "10")
+	if err := e.client.call(ctx, http.MethodPost, "/containers/"+id+"/stop", query, nil, nil); err != nil {
+		log.Error(err)
+	}
+}
+
+// demux copies a multiplexed attach stream to stdout and stderr.
+func demux(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var w io.Writer
+		switch header[0] {
+		case 2:
+			w = stderr
+		default:
+			w = stdout
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// attach attaches to the output streams of a container. The returned reader
+// is the raw multiplexed stream.
+func (e *engineBackend) attach(ctx context.Context, id string) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("stream", "1")
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	headers := map[string]string{
+		"Connection": "Upgrade",
+		"Upgrade":    "tcp",
+	}
+	resp, err := e.client.do(ctx, http.MethodPost, "/containers/"+id+"/attach", query, headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// RunService creates, starts, and waits on the container for a service.
+func (e *engineBackend) RunService(ctx context.Context, svcname string, stdout, stderr io.Writer) (*ServiceResult, error) {
+	svc, ok := e.composer.Services[svcname]
+	if !ok {
+		return nil, fmt.Errorf("no such service: %s", svcname)
+	}
+
+	cfg, err := e.containerConfig(svcname, svc)
+	if err != nil {
+		return nil, err
+	}
+
+	if key := serviceNetwork(svc); key != "" {
+		if err = e.ensureNetwork(ctx, key); err != nil {
+			return nil, err
+		}
+	}
+
+	name := e.containerName(svcname)
+	if err = e.removeContainer(ctx, name); err != nil {
+		return nil, errors.Wrapf(err, "failed to remove existing container %s", name)
+	}
+
+	var created struct {
+		ID string `json:"Id"`
+	}
+	query := url.Values{}
+	query.Set("name", name)
+	if err = e.client.call(ctx, http.MethodPost, "/containers/create", query, cfg, &created); err != nil {
+		return nil, errors.Wrapf(err, "failed to create container for %s", svcname)
+	}
+
+	stream, err := e.attach(ctx, created.ID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to attach to container for %s", svcname)
+	}
+	defer stream.Close()
+
+	copied := make(chan error, 1)
+	go func() {
+		copied <- demux(bufio.NewReader(stream), stdout, stderr)
+	}()
+
+	if err = e.client.call(ctx, http.MethodPost, "/containers/"+created.ID+"/start", nil, nil, nil); err != nil {
+		return nil, errors.Wrapf(err, "failed to start container for %s", svcname)
+	}
+
+	var waited struct {
+		StatusCode int
+	}
+	if err = e.client.call(ctx, http.MethodPost, "/containers/"+created.ID+"/wait", nil, nil, &waited); err != nil {
+		if ctx.Err() != nil {
+			e.stopContainer(created.ID)
+			return nil, ctx.Err()
+		}
+		return nil, errors.Wrapf(err, "failed to wait on container for %s", svcname)
+	}
+
+	if err = <-copied; err != nil {
+		log.Error(errors.Wrapf(err, "error reading output from %s", svcname))
+	}
+
+	var inspected containerDetails
+	if err = e.client.call(ctx, http.MethodGet, "/containers/"+created.ID+"/json", nil, nil, &inspected); err != nil {
+		return nil, errors.Wrapf(err, "failed to inspect container for %s", svcname)
+	}
+
+	result := inspected.result()
+
+	if waited.StatusCode != 0 {
+		return result, fmt.Errorf("%s exited with a status of %d", svcname, waited.StatusCode)
+	}
+	return result, nil
+}
+
+// ContainerID inspects the container for the service by name.
+func (e *engineBackend) ContainerID(ctx context.Context, svcname string) (string, error) {
+	var inspected containerDetails
+	err := e.client.call(ctx, http.MethodGet, "/containers/"+e.containerName(svcname)+"/json", nil, nil, &inspected)
+	if err != nil {
+		if strings.Contains(err.Error(), "status 404") {
+			return "", nil
+		}
+		return "", errors.Wrapf(err, "failed to inspect the container for %s", svcname)
+	}
+	return inspected.ID, nil
+}
+
+// Down removes every container labeled with the job's project name, along with
+// their anonymous volumes.
+func (e *engineBackend) Down(ctx context.Context, stdout, stderr io.Writer) error {
+	filters, err := json.Marshal(map[string][]string{
+		"label": {fmt.Sprintf("%s=%s", composeProjectLabel, e.project)},
+	})
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("all", "1")
+	query.Set("filters", string(filters))
+
+	var containers []struct {
+		ID    string `json:"Id"`
+		Names []string
+	}
+	if err = e.client.call(ctx, http.MethodGet, "/containers/json", query, nil, &containers); err != nil {
+		return err
+	}
+
+	for _, c := range containers {
+		fmt.Fprintf(stdout, "Removing %s\n", strings.Join(c.Names, ","))
+		if err = e.removeContainer(ctx, c.ID); err != nil {
+			fmt.Fprintln(stderr, err)
+			return err
+		}
+	}
+
+	var networks []struct {
+		ID   string `json:"Id"`
+		Name string
+	}
+	query = url.Values{}
+	query.Set("filters", string(filters))
+	if err = e.client.call(ctx, http.MethodGet, "/networks", query, nil, &networks); err != nil {
+		return err
+	}
+	for _, n := range networks {
+		fmt.Fprintf(stdout, "Removing network %s\n", n.Name)
+		if err = e.client.call(ctx, http.MethodDelete, "/networks/"+n.ID, nil, nil, nil); err != nil {
+			fmt.Fprintln(stderr, err)
+			return err
+		}
+	}
+
+	e.networksMu.Lock()
+	e.networks = make(map[string]bool)
+	e.networksMu.Unlock()
+	return nil
+}
+
+func (e *engineBackend) planLogin(registry, username, password string) [][]string {
+	return [][]string{{http.MethodPost, "/auth", registry}}
+}
+
+func (e *engineBackend) planPull() [][]string {
+	var cmds [][]string
+	for _, image := range e.Images() {
+		name, tag := splitImageRef(image)
+		query := url.Values{}
+		query.Set("fromImage", name)
+		query.Set("tag", tag)
+		cmds = append(cmds, []string{http.MethodPost, "/images/create?" + query.Encode()})
+	}
+	return cmds
+}
+
+func (e *engineBackend) planRunService(svcname string) ([][]string, error) {
+	svc, ok := e.composer.Services[svcname]
+	if !ok {
+		return nil, fmt.Errorf("no such service: %s", svcname)
+	}
+	cfg, err := e.containerConfig(svcname, svc)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var cmds [][]string
+	if key := serviceNetwork(svc); key != "" {
+		cmds = append(cmds,
+			[]string{http.MethodGet, "/networks/" + e.networkName(key)},
+			[]string{http.MethodPost, "/networks/create", e.networkName(key)},
+		)
+	}
+	name := e.containerName(svcname)
+	return append(cmds, [][]string{
+		{http.MethodDelete, "/containers/" + name + "?force=1&v=1"},
+		{http.MethodPost, "/containers/create?name=" + url.QueryEscape(name), string(body)},
+		{http.MethodPost, "/containers/" + name + "/attach?stderr=1&stdout=1&stream=1"},
+		{http.MethodPost, "/containers/" + name + "/start"},
+		{http.MethodPost, "/containers/" + name + "/wait"},
+		{http.MethodGet, "/containers/" + name + "/json"},
+	}...), nil
+}
+
+func (e *engineBackend) planDown() [][]string {
+	return [][]string{
+		{http.MethodGet, "/containers/json?all=1&label=" + composeProjectLabel + "=" + e.project},
+		{http.MethodDelete, "/containers/<each container>?force=1&v=1"},
+		{http.MethodGet, "/networks?label=" + composeProjectLabel + "=" + e.project},
+		{http.MethodDelete, "/networks/<each network>"},
+	}
+}
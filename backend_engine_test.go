@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cyverse-de/model"
+	"github.com/cyverse-de/road-runner/dcompose"
+)
+
+func TestSplitImageRef(t *testing.T) {
+	tests := []struct {
+		ref, name, tag string
+	}{
+		{"alpine", "alpine", "latest"},
+		{"alpine:3.18", "alpine", "3.18"},
+		{"harbor.example.org:5000/de/porklock", "harbor.example.org:5000/de/porklock", "latest"},
+		{"harbor.example.org:5000/de/porklock:qa", "harbor.example.org:5000/de/porklock", "qa"},
+		{"alpine@sha256:abcd", "alpine", "sha256:abcd"},
+	}
+	for _, test := range tests {
+		name, tag := splitImageRef(test.ref)
+		if name != test.name {
+			t.Errorf("name of %s was %s instead of %s", test.ref, name, test.name)
+		}
+		if tag != test.tag {
+			t.Errorf("tag of %s was %s instead of %s", test.ref, tag, test.tag)
+		}
+	}
+}
+
+func TestServiceResultString(t *testing.T) {
+	tests := []struct {
+		result   ServiceResult
+		expected string
+	}{
+		{ServiceResult{ExitCode: 1}, "exit code 1"},
+		{ServiceResult{ExitCode: 137, Signal: exitSignal(137), OOMKilled: true}, "exit code 137, killed by signal 9 (killed), out of memory"},
+	}
+	for _, test := range tests {
+		if actual := test.result.String(); actual != test.expected {
+			t.Errorf("result was %q instead of %q", actual, test.expected)
+		}
+	}
+	if exitSignal(1) != 0 || exitSignal(128) != 0 {
+		t.Error("an ordinary exit code was reported as a signal")
+	}
+}
+
+func frame(stream byte, content string) []byte {
+	header := make([]byte, 8)
+	header[0] = stream
+	binary.BigEndian.PutUint32(header[4:], uint32(len(content)))
+	return append(header, []byte(content)...)
+}
+
+func TestDemux(t *testing.T) {
+	var input []byte
+	input = append(input, frame(1, "out1\n")...)
+	input = append(input, frame(2, "err1\n")...)
+	input = append(input, frame(1, "out2\n")...)
+
+	var stdout, stderr bytes.Buffer
+	if err := demux(bytes.NewReader(input), &stdout, &stderr); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "out1\nout2\n" {
+		t.Errorf("stdout was %q", stdout.String())
+	}
+	if stderr.String() != "err1\n" {
+		t.Errorf("stderr was %q", stderr.String())
+	}
+}
+
+func TestEngineContainerConfig(t *testing.T) {
+	jc, err := dcompose.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jc.Services["data_0_0"] = &dcompose.Service{
+		Image:         "data:1",
+		ContainerName: "data-container",
+	}
+	svc := &dcompose.Service{
+		Image:       "tool:1.0",
+		Command:     []string{"--help"},
+		EntryPoint:  "/bin/tool",
+		Environment: map[string]string{"B": "2", "A": "1"},
+		WorkingDir:  dcompose.WORKDIR,
+		MemLimit:    "1024",
+		CPUs:        "1.500000",
+		PIDsLimit:   64,
+		Volumes: []string{
+			"/host/work:/de-app-work:rw",
+			"./tmpfiles:/tmp:rw",
+			"/anonymous:rw",
+			":/data:ro",
+		},
+		VolumesFrom: []string{"data_0_0"},
+		Devices:     []string{"/dev/fuse:/dev/fuse:rwm"},
+		Logging:     &dcompose.LoggingConfig{Driver: "none"},
+	}
+	jc.Services["step_0"] = svc
+
+	b := &engineBackend{composer: jc, project: "testproject", workingDir: "/work"}
+	cfg, err := b.containerConfig("step_0", svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(cfg.Entrypoint, []string{"/bin/tool"}) {
+		t.Errorf("entrypoint was %v", cfg.Entrypoint)
+	}
+	if !reflect.DeepEqual(cfg.Env, []string{"A=1", "B=2"}) {
+		t.Errorf("env was %v", cfg.Env)
+	}
+	if !reflect.DeepEqual(cfg.HostConfig.Binds, []string{"/host/work:/de-app-work:rw", "/work/tmpfiles:/tmp:rw"}) {
+		t.Errorf("binds were %v", cfg.HostConfig.Binds)
+	}
+	if _, ok := cfg.Volumes["/anonymous"]; !ok {
+		t.Errorf("anonymous volume was missing from %v", cfg.Volumes)
+	}
+	if _, ok := cfg.Volumes["/data"]; !ok {
+		t.Errorf("volume without a host path was missing from %v", cfg.Volumes)
+	}
+	if !reflect.DeepEqual(cfg.HostConfig.VolumesFrom, []string{"data-container"}) {
+		t.Errorf("volumes from was %v", cfg.HostConfig.VolumesFrom)
+	}
+	if cfg.HostConfig.Memory != 1024 {
+		t.Errorf("memory was %d", cfg.HostConfig.Memory)
+	}
+	if cfg.HostConfig.NanoCPUs != 1500000000 {
+		t.Errorf("nano cpus was %d", cfg.HostConfig.NanoCPUs)
+	}
+	if cfg.HostConfig.PidsLimit != 64 {
+		t.Errorf("pids limit was %d", cfg.HostConfig.PidsLimit)
+	}
+	if len(cfg.HostConfig.Devices) != 1 || cfg.HostConfig.Devices[0].PathInContainer != "/dev/fuse" {
+		t.Errorf("devices were %v", cfg.HostConfig.Devices)
+	}
+	if cfg.Labels[composeProjectLabel] != "testproject" {
+		t.Errorf("project label was %s", cfg.Labels[composeProjectLabel])
+	}
+	if cfg.Labels[composeServiceLabel] != "step_0" {
+		t.Errorf("service label was %s", cfg.Labels[composeServiceLabel])
+	}
+	if cfg.HostConfig.LogConfig.Type != "none" {
+		t.Errorf("log driver was %s", cfg.HostConfig.LogConfig.Type)
+	}
+
+	svc.MemLimit = "lots"
+	if _, err = b.containerConfig("step_0", svc); err == nil {
+		t.Error("an invalid mem_limit did not return an error")
+	}
+}
+
+func TestEngineContainerConfigSecurity(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(path.Join(dir, "seccomp.json"), []byte("{\n  \"defaultAction\": \"SCMP_ACT_ERRNO\"\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	jc, err := dcompose.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &dcompose.Service{
+		Image:       "tool:1.0",
+		CapDrop:     []string{"ALL"},
+		CapAdd:      []string{"CHOWN"},
+		SecurityOpt: []string{"no-new-privileges:true", "seccomp=./seccomp.json", "apparmor=docker-default"},
+		ReadOnly:    true,
+		User:        "1000:1000",
+		GroupAdd:    []string{"2000"},
+	}
+	jc.Services["step_0"] = svc
+
+	b := &engineBackend{composer: jc, project: "testproject", workingDir: dir}
+	cfg, err := b.containerConfig("step_0", svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"no-new-privileges:true", `seccomp={"defaultAction":"SCMP_ACT_ERRNO"}`, "apparmor=docker-default"}
+	if !reflect.DeepEqual(cfg.HostConfig.SecurityOpt, expected) {
+		t.Errorf("security options were %v", cfg.HostConfig.SecurityOpt)
+	}
+	if !cfg.HostConfig.ReadonlyRootfs || cfg.User != "1000:1000" {
+		t.Errorf("read only was %v, user was %q", cfg.HostConfig.ReadonlyRootfs, cfg.User)
+	}
+	if !reflect.DeepEqual(cfg.HostConfig.GroupAdd, []string{"2000"}) {
+		t.Errorf("groups were %v", cfg.HostConfig.GroupAdd)
+	}
+	if !reflect.DeepEqual(cfg.HostConfig.CapDrop, []string{"ALL"}) || !reflect.DeepEqual(cfg.HostConfig.CapAdd, []string{"CHOWN"}) {
+		t.Errorf("capabilities were %v and %v", cfg.HostConfig.CapDrop, cfg.HostConfig.CapAdd)
+	}
+
+	svc.SecurityOpt = []string{"seccomp=missing.json"}
+	if _, err = b.containerConfig("step_0", svc); err == nil {
+		t.Error("a missing seccomp profile did not return an error")
+	}
+}
+
+func TestEngineNetworks(t *testing.T) {
+	var mu sync.Mutex
+	var created []engineNetworkConfig
+	var requests []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req.Method+" "+req.URL.Path)
+		switch {
+		case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/networks/"):
+			http.NotFound(w, req)
+		case req.URL.Path == "/networks/create":
+			var body engineNetworkConfig
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				t.Error(err)
+			}
+			created = append(created, body)
+			w.Write([]byte(`{"Id": "abc"}`))
+		case req.Method == http.MethodGet && req.URL.Path == "/networks":
+			w.Write([]byte(`[{"Id": "abc", "Name": "testproject_steps"}]`))
+		case req.Method == http.MethodGet && req.URL.Path == "/containers/json":
+			w.Write([]byte(`[]`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	socket := path.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	jc, err := dcompose.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jc.Services["step_0"] = &dcompose.Service{Image: "tool:1.0"}
+	jc.InitNetworks("invocation-id", dcompose.EgressInternal)
+	b := &engineBackend{client: newEngineClient(socket), composer: jc, project: "testproject"}
+
+	cfg, err := b.containerConfig("step_0", jc.Services["step_0"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HostConfig.NetworkMode != "testproject_steps" {
+		t.Errorf("network mode was %q", cfg.HostConfig.NetworkMode)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = b.ensureNetwork(context.Background(), dcompose.StepsNetwork); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(created) != 1 {
+		t.Fatalf("%d networks were created", len(created))
+	}
+	n := created[0]
+	if n.Name != "testproject_steps" || !n.Internal || n.Labels[model.DockerLabelKey] != "invocation-id" || n.Labels[composeProjectLabel] != "testproject" {
+		t.Errorf("network was %+v", n)
+	}
+
+	if err = b.Down(context.Background(), io.Discard, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if last := requests[len(requests)-1]; last != "DELETE /networks/abc" {
+		t.Errorf("the last request was %q", last)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/cyverse-de/road-runner/fs"
+)
+
+// containsString returns true if the string is in the list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsInt returns true if the int is in the list.
+func containsInt(list []int, i int) bool {
+	for _, item := range list {
+		if item == i {
+			return true
+		}
+	}
+	return false
+}
+
+// resumeEnabled returns true if road-runner was started with --resume.
+func (r *JobRunner) resumeEnabled() bool {
+	return r.cfg != nil && r.cfg.GetBool("job.resume")
+}
+
+// loadCheckpoint reads the checkpoint left behind by an earlier run of the job
+// in the same working directory. It's only used if it's for the same job and
+// none of the files it recorded in the working volume have changed since.
+// Otherwise the job starts over.
+func (r *JobRunner) loadCheckpoint() {
+	r.checkpoint = &fs.Checkpoint{InvocationID: r.job.InvocationID}
+
+	cp, err := fs.ReadCheckpoint(fs.FS, r.workingDir)
+	if err != nil {
+		log.Error(err)
+		running(r.client, r.job, "No usable checkpoint was found, running the whole job")
+		return
+	}
+
+	if cp.InvocationID != r.job.InvocationID {
+		running(r.client, r.job, fmt.Sprintf("The checkpoint is for job %s, running the whole job", cp.InvocationID))
+		return
+	}
+
+	if changed := fs.ChangedFiles(r.volumeDir, cp.Files); len(changed) > 0 {
+		running(r.client, r.job, fmt.Sprintf(
+			"The working volume no longer matches the checkpoint, running the whole job. Changed files: %s",
+			strings.Join(changed, ", "),
+		))
+		return
+	}
+
+	r.resumeFrom = cp
+	r.checkpoint.Inputs = append(r.checkpoint.Inputs, cp.Inputs...)
+	r.checkpoint.Steps = append(r.checkpoint.Steps, cp.Steps...)
+	r.checkpoint.Files = cp.Files
+	for _, phase := range cp.Phases {
+		if phase != string(PhasePull) {
+			r.checkpoint.Phases = append(r.checkpoint.Phases, phase)
+		}
+	}
+
+	running(r.client, r.job, fmt.Sprintf(
+		"Resuming the job from its checkpoint, %d inputs and %d steps have already finished",
+		len(cp.Inputs),
+		len(cp.Steps),
+	))
+}
+
+// saveCheckpoint writes out the checkpoint. Must be called with the
+// checkpoint mutex held.
+func (r *JobRunner) saveCheckpoint() {
+	if err := fs.WriteCheckpoint(fs.FS, r.workingDir, r.checkpoint); err != nil {
+		log.Error(err)
+	}
+}
+
+// recordImageDigests records the digests of the pulled images in the
+// checkpoint, if the backend can inspect them. If the job is being resumed and
+// any of the images changed since the earlier run, the steps that already
+// finished are run again.
+func (r *JobRunner) recordImageDigests(ctx context.Context) {
+	inspector, ok := r.backend.(imageInspector)
+	if !ok {
+		return
+	}
+	digests, err := inspector.ImageDigests(ctx)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	// Keep using the references from the job so that the digests can be
+	// compared with the ones recorded before the job was resumed.
+	digests = r.unpinnedDigests(digests)
+
+	r.checkpointMutex.Lock()
+	defer r.checkpointMutex.Unlock()
+
+	r.checkpoint.ImageDigests = digests
+
+	if r.resumeFrom != nil && len(r.checkpoint.Steps) > 0 {
+		for image, digest := range digests {
+			if previous, ok := r.resumeFrom.ImageDigests[image]; ok && previous != digest {
+				running(r.client, r.job, fmt.Sprintf(
+					"Image %s changed from %s to %s since the job was checkpointed, running all of the steps again",
+					image,
+					previous,
+					digest,
+				))
+				r.checkpoint.Steps = nil
+				r.resumeFrom.Steps = nil
+				var phases []string
+				for _, phase := range r.checkpoint.Phases {
+					if phase != string(PhaseSteps) {
+						phases = append(phases, phase)
+					}
+				}
+				r.checkpoint.Phases = phases
+				break
+			}
+		}
+	}
+
+	r.saveCheckpoint()
+}
+
+// inputDownloaded returns true if the input download service finished in an
+// earlier run of the job.
+func (r *JobRunner) inputDownloaded(svcname string) bool {
+	return r.resumeFrom != nil && containsString(r.resumeFrom.Inputs, svcname)
+}
+
+// stepFinished returns true if the step finished in an earlier run of the job.
+func (r *JobRunner) stepFinished(idx int) bool {
+	return r.resumeFrom != nil && containsInt(r.resumeFrom.Steps, idx)
+}
+
+// phaseFinished returns true if the phase finished in an earlier run of the
+// job and nothing since has invalidated it, like an image that changed.
+func (r *JobRunner) phaseFinished(phase JobPhase) bool {
+	r.checkpointMutex.Lock()
+	defer r.checkpointMutex.Unlock()
+
+	return r.resumeFrom != nil && containsString(r.checkpoint.Phases, string(phase))
+}
+
+// recordInput records a finished input download in the checkpoint along with
+// the state of the files it downloaded. Downloads with an input path list
+// record the whole working volume.
+func (r *JobRunner) recordInput(svcname, source string) {
+	root := r.volumeDir
+	if source != "" {
+		root = path.Join(r.volumeDir, source)
+	}
+	files, err := fs.ScanFiles(r.volumeDir, root, "logs")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	r.checkpointMutex.Lock()
+	defer r.checkpointMutex.Unlock()
+
+	if r.checkpoint.Files == nil {
+		r.checkpoint.Files = make(map[string]fs.FileState)
+	}
+	for rel, state := range files {
+		r.checkpoint.Files[rel] = state
+	}
+	r.checkpoint.Inputs = append(r.checkpoint.Inputs, svcname)
+	r.saveCheckpoint()
+}
+
+// recordStep records a finished step in the checkpoint along with the state of
+// the working volume.
+func (r *JobRunner) recordStep(idx int) {
+	files, err := fs.ScanFiles(r.volumeDir, r.volumeDir, "logs")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	r.checkpointMutex.Lock()
+	defer r.checkpointMutex.Unlock()
+
+	r.checkpoint.Files = files
+	r.checkpoint.Steps = append(r.checkpoint.Steps, idx)
+	r.saveCheckpoint()
+}
+
+// recordPhase records a finished phase in the checkpoint.
+func (r *JobRunner) recordPhase(phase JobPhase) {
+	r.checkpointMutex.Lock()
+	defer r.checkpointMutex.Unlock()
+
+	if !containsString(r.checkpoint.Phases, string(phase)) {
+		r.checkpoint.Phases = append(r.checkpoint.Phases, string(phase))
+	}
+	r.saveCheckpoint()
+}
+
+// checkpointHook records the phases that can be skipped when a job is resumed
+// in the checkpoint as they finish.
+type checkpointHook struct{}
+
+func (h *checkpointHook) BeforePhase(ctx context.Context, r *JobRunner, phase JobPhase) error {
+	return nil
+}
+
+func (h *checkpointHook) AfterPhase(ctx context.Context, r *JobRunner, result *PhaseResult) {
+	if result.Outcome != PhaseSucceeded {
+		return
+	}
+	switch result.Phase {
+	case PhasePull:
+		r.recordImageDigests(ctx)
+		r.recordPhase(PhasePull)
+	case PhaseDownload, PhaseSteps:
+		r.recordPhase(result.Phase)
+	}
+}
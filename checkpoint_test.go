@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/road-runner/fs"
+	"github.com/spf13/viper"
+)
+
+// digestBackend is a testBackend that can report image digests.
+type digestBackend struct {
+	testBackend
+	digests map[string]string
+}
+
+func (b *digestBackend) ImageDigests(ctx context.Context) (map[string]string, error) {
+	return b.digests, nil
+}
+
+// downloadFiles simulates input downloads by writing each input into the
+// working volume.
+func downloadFiles(volumeDir string) func(ctx context.Context, svcname string) (*ServiceResult, error) {
+	return func(ctx context.Context, svcname string) (*ServiceResult, error) {
+		if strings.HasPrefix(svcname, "input_") {
+			name := "input-" + strings.TrimPrefix(svcname, "input_") + ".txt"
+			if err := os.WriteFile(path.Join(volumeDir, name), []byte(svcname), 0644); err != nil {
+				return nil, err
+			}
+		}
+		return &ServiceResult{}, nil
+	}
+}
+
+// runCheckpointed downloads the inputs and runs the steps the same way Run
+// does, returning the services that were run.
+func runCheckpointed(t *testing.T, r *JobRunner, backend *digestBackend) []string {
+	backend.services = nil
+	if r.resumeEnabled() {
+		r.loadCheckpoint()
+	}
+	r.recordImageDigests(context.Background())
+	r.recordPhase(PhasePull)
+	if _, err := r.downloadInputs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	r.recordPhase(PhaseDownload)
+	if _, err := r.runAllSteps(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	r.recordPhase(PhaseSteps)
+	return backend.services
+}
+
+// newCheckpointRunners returns two runners for the same job that share a
+// working directory. The second one resumes the job.
+func newCheckpointRunners(t *testing.T, backend *digestBackend) (*JobRunner, *JobRunner) {
+	job := inputsJob(2)
+	first, _ := newTestRunner(t, job, backend)
+	backend.run = downloadFiles(first.volumeDir)
+
+	second, _ := newTestRunner(t, job, backend)
+	second.workingDir = first.workingDir
+	second.volumeDir = first.volumeDir
+	second.cfg = viper.New()
+	second.cfg.Set("job.resume", true)
+	return first, second
+}
+
+func TestResumeSkipsFinishedWork(t *testing.T) {
+	backend := &digestBackend{digests: map[string]string{"tool-0:latest": "sha256:1"}}
+	first, second := newCheckpointRunners(t, backend)
+
+	services := runCheckpointed(t, first, backend)
+	if len(services) != 3 {
+		t.Fatalf("services were %v", services)
+	}
+
+	cp, err := fs.ReadCheckpoint(fs.FS, first.workingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cp.Phases, []string{string(PhasePull), string(PhaseDownload), string(PhaseSteps)}) {
+		t.Errorf("phases were %v", cp.Phases)
+	}
+	if !reflect.DeepEqual(cp.Steps, []int{0}) {
+		t.Errorf("steps were %v", cp.Steps)
+	}
+	if len(cp.Files) != 2 {
+		t.Errorf("files were %v", cp.Files)
+	}
+
+	if services = runCheckpointed(t, second, backend); len(services) != 0 {
+		t.Errorf("services %v were run again", services)
+	}
+}
+
+func TestResumeChangedVolume(t *testing.T) {
+	backend := &digestBackend{}
+	first, second := newCheckpointRunners(t, backend)
+	runCheckpointed(t, first, backend)
+
+	if err := os.WriteFile(path.Join(first.volumeDir, "input-0.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	services := runCheckpointed(t, second, backend)
+	if second.resumeFrom != nil {
+		t.Error("the checkpoint was used after the working volume changed")
+	}
+	if len(services) != 3 {
+		t.Errorf("services were %v", services)
+	}
+}
+
+func TestResumeChangedImage(t *testing.T) {
+	backend := &digestBackend{digests: map[string]string{"tool-0:latest": "sha256:1"}}
+	first, second := newCheckpointRunners(t, backend)
+	runCheckpointed(t, first, backend)
+
+	backend.digests = map[string]string{"tool-0:latest": "sha256:2"}
+	services := runCheckpointed(t, second, backend)
+	if !reflect.DeepEqual(services, []string{"step_0"}) {
+		t.Errorf("services were %v", services)
+	}
+}
+
+func TestImageDetailsDigest(t *testing.T) {
+	tests := []struct {
+		details  imageDetails
+		ref      string
+		expected string
+	}{
+		{
+			imageDetails{ID: "sha256:id", RepoDigests: []string{"other/image@sha256:a", "discoenv/tool@sha256:b"}},
+			"discoenv/tool:1.0",
+			"sha256:b",
+		},
+		{
+			imageDetails{ID: "sha256:id", RepoDigests: []string{"other/image@sha256:a"}},
+			"discoenv/tool:1.0",
+			"sha256:a",
+		},
+		{
+			imageDetails{ID: "sha256:id"},
+			"local:latest",
+			"sha256:id",
+		},
+	}
+	for _, tt := range tests {
+		if actual := tt.details.digest(tt.ref); actual != tt.expected {
+			t.Errorf("digest for %s was %s instead of %s", tt.ref, actual, tt.expected)
+		}
+	}
+}
+
+func TestResumeSkipsFinishedPhases(t *testing.T) {
+	backend := &testBackend{}
+	r, client := newTestRunner(t, inputsJob(1), backend)
+	hook := &recordingHook{}
+	r.AddPhaseHook(hook)
+	r.resumeFrom = &fs.Checkpoint{InvocationID: r.job.InvocationID}
+	r.checkpoint.Phases = []string{string(PhaseDownload), string(PhaseSteps)}
+
+	r.runLifecycle(context.Background())
+
+	expected := []JobPhase{PhaseInit, PhaseLogin, PhasePull, PhaseDataContainers, PhaseUpload, PhaseCleanup}
+	if !reflect.DeepEqual(hook.phases(), expected) {
+		t.Errorf("phases were %v instead of %v", hook.phases(), expected)
+	}
+	if !reflect.DeepEqual(backend.services, []string{"upload_outputs"}) {
+		t.Errorf("services were %v", backend.services)
+	}
+	var skipped []string
+	for _, u := range client.updates {
+		if strings.HasPrefix(u.Message, "Skipping phase ") {
+			skipped = append(skipped, u.Message)
+		}
+	}
+	if len(skipped) != 2 {
+		t.Errorf("skipped phases were %v", skipped)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"path"
+	"strings"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/cyverse-de/road-runner/fs"
+)
+
+// checksum is an expected checksum from the job definition.
+type checksum struct {
+	algorithm string
+	newHash   func() hash.Hash
+	sum       []byte
+}
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// parseChecksum parses a checksum written as "<algorithm>:<hex>", where the
+// algorithm is md5, sha1, sha256 or sha512. iRODS checksums, which are written
+// as "sha2:<base64>", are accepted too. A bare hex checksum is taken to be
+// SHA-256 or MD5 depending on its length.
+func parseChecksum(s string) (*checksum, error) {
+	s = strings.TrimSpace(s)
+	algorithm, value := "", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		algorithm, value = strings.ToLower(s[:i]), s[i+1:]
+	}
+
+	var (
+		sum []byte
+		err error
+	)
+	switch algorithm {
+	case "sha2":
+		algorithm = "sha256"
+		sum, err = base64.StdEncoding.DecodeString(value)
+	case "":
+		switch len(value) {
+		case 2 * sha256.Size:
+			algorithm = "sha256"
+		case 2 * md5.Size:
+			algorithm = "md5"
+		default:
+			return nil, fmt.Errorf("can't tell which algorithm the checksum %q uses", s)
+		}
+		sum, err = hex.DecodeString(value)
+	default:
+		algorithm = strings.ReplaceAll(algorithm, "-", "")
+		sum, err = hex.DecodeString(value)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("the checksum %q isn't encoded properly", s)
+	}
+
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("the checksum %q uses an unsupported algorithm", s)
+	}
+	if len(sum) != newHash().Size() {
+		return nil, fmt.Errorf("the checksum %q is the wrong length for %s", s, algorithm)
+	}
+	return &checksum{algorithm: algorithm, newHash: newHash, sum: sum}, nil
+}
+
+// ChecksumError is returned when a downloaded input doesn't match the checksum
+// in the job definition.
+type ChecksumError struct {
+	Path      string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf(
+		"Input file %s is corrupt: its %s checksum is %s, but the job expected %s",
+		e.Path, e.Algorithm, e.Actual, e.Expected,
+	)
+}
+
+// verifyInputs compares the downloaded inputs that have checksums in the job
+// definition against them. Collections can't be checked, so they're skipped.
+// The check can be turned off by setting inputs.verify_checksums to false.
+func (r *JobRunner) verifyInputs(ctx context.Context) (messaging.StatusCode, error) {
+	if r.cfg != nil && r.cfg.IsSet("inputs.verify_checksums") && !r.cfg.GetBool("inputs.verify_checksums") {
+		return messaging.Success, nil
+	}
+	for i, step := range r.job.Steps {
+		for j, input := range step.Config.Inputs {
+			expected := r.opts.InputChecksum(i, j)
+			if expected == "" {
+				continue
+			}
+			if input.Multiplicity == "collection" {
+				running(r.client, r.job, fmt.Sprintf("Not verifying the checksum of %s, it's a collection", input.IRODSPath()))
+				continue
+			}
+			if ctx.Err() != nil {
+				return messaging.StatusInputFailed, ctx.Err()
+			}
+
+			c, err := parseChecksum(expected)
+			if err != nil {
+				return messaging.StatusInputFailed, err
+			}
+			running(r.client, r.job, fmt.Sprintf("Verifying the %s checksum of %s", c.algorithm, input.IRODSPath()))
+			actual, err := fs.Checksum(path.Join(r.volumeDir, input.Source()), c.newHash())
+			if err != nil {
+				r.failureMessage = fmt.Sprintf("Failed to verify input file %s: %s", input.IRODSPath(), err)
+				running(r.client, r.job, r.failureMessage)
+				return messaging.StatusInputFailed, err
+			}
+			if !bytes.Equal(actual, c.sum) {
+				cErr := &ChecksumError{
+					Path:      input.IRODSPath(),
+					Algorithm: c.algorithm,
+					Expected:  hex.EncodeToString(c.sum),
+					Actual:    hex.EncodeToString(actual),
+				}
+				r.failureMessage = cErr.Error()
+				running(r.client, r.job, r.failureMessage)
+				return messaging.StatusInputFailed, cErr
+			}
+		}
+	}
+	return messaging.Success, nil
+}
+
+// downloadPhase downloads the job's inputs and then verifies their checksums.
+func (r *JobRunner) downloadPhase(ctx context.Context) (messaging.StatusCode, error) {
+	if status, err := r.downloadInputs(ctx); err != nil {
+		return status, err
+	}
+	return r.verifyInputs(ctx)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/cyverse-de/model"
+)
+
+// The checksums of "hello\n".
+const (
+	helloSHA256 = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+	helloMD5    = "b1946ac92492d2347c6235b4d2611184"
+	helloSHA2   = "WJG1tSLV3whtD/CxEPvZ0hu0/HFjrzTQgoai6Eb2vgM="
+)
+
+func TestParseChecksum(t *testing.T) {
+	tests := map[string]string{
+		"sha256:" + helloSHA256:  "sha256",
+		"SHA-256:" + helloSHA256: "sha256",
+		helloSHA256:              "sha256",
+		"md5:" + helloMD5:        "md5",
+		helloMD5:                 "md5",
+		"sha2:" + helloSHA2:      "sha256",
+	}
+	for s, algorithm := range tests {
+		c, err := parseChecksum(s)
+		if err != nil {
+			t.Errorf("parseChecksum(%q) returned %v", s, err)
+			continue
+		}
+		if c.algorithm != algorithm {
+			t.Errorf("algorithm of %q was %s instead of %s", s, c.algorithm, algorithm)
+		}
+	}
+
+	for _, s := range []string{"abc", "sha256:" + helloMD5, "crc32:00000000", "md5:not-hex"} {
+		if _, err := parseChecksum(s); err == nil {
+			t.Errorf("no error was returned for %q", s)
+		}
+	}
+}
+
+func TestParseJobOptionsChecksums(t *testing.T) {
+	opts, err := ParseJobOptions([]byte(`{"steps": [{"config": {"input": [{}, {"checksum": "md5:` + helloMD5 + `"}]}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := opts.InputChecksum(0, 1); c != "md5:"+helloMD5 {
+		t.Errorf("checksum was %q", c)
+	}
+	if c := opts.InputChecksum(0, 0); c != "" {
+		t.Errorf("checksum was %q", c)
+	}
+	if c := opts.InputChecksum(1, 0); c != "" {
+		t.Errorf("checksum was %q", c)
+	}
+
+	if _, err = ParseJobOptions([]byte(`{"steps": [{"config": {"input": [{"checksum": "abc"}]}}]}`)); err == nil {
+		t.Error("no error was returned for an invalid checksum")
+	}
+}
+
+// checksumRunner returns a runner for a job with a single input, hello.txt,
+// that has the checksum.
+func checksumRunner(t *testing.T, checksum string) *JobRunner {
+	job := stepsJob(1)
+	job.Steps[0].Config.Inputs = []model.StepInput{{Value: "/iplant/home/test/hello.txt", Multiplicity: "single"}}
+	r, _ := newTestRunner(t, job, &testBackend{})
+	opts, err := ParseJobOptions([]byte(`{"steps": [{"config": {"input": [{"checksum": "` + checksum + `"}]}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.opts = opts
+	if err = os.WriteFile(path.Join(r.volumeDir, "hello.txt"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestVerifyInputs(t *testing.T) {
+	for _, c := range []string{helloSHA256, "md5:" + helloMD5, "sha2:" + helloSHA2} {
+		r := checksumRunner(t, c)
+		if status, err := r.verifyInputs(context.Background()); status != messaging.Success || err != nil {
+			t.Errorf("status was %d, error was %v for %s", status, err, c)
+		}
+	}
+}
+
+func TestVerifyInputsMismatch(t *testing.T) {
+	r := checksumRunner(t, "md5:00000000000000000000000000000000")
+	status, err := r.verifyInputs(context.Background())
+	if status != messaging.StatusInputFailed || err == nil {
+		t.Fatalf("status was %d, error was %v", status, err)
+	}
+	if !strings.HasPrefix(r.failureMessage, "Input file /iplant/home/test/hello.txt is corrupt") {
+		t.Errorf("failure message was %q", r.failureMessage)
+	}
+}
+
+func TestVerifyInputsMissing(t *testing.T) {
+	r := checksumRunner(t, helloSHA256)
+	if err := os.Remove(path.Join(r.volumeDir, "hello.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := r.verifyInputs(context.Background()); status != messaging.StatusInputFailed || err == nil {
+		t.Errorf("status was %d, error was %v", status, err)
+	}
+}
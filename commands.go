@@ -7,6 +7,18 @@ import (
 	"github.com/spf13/viper"
 )
 
+// usesPodman returns true if the jobs should be run with podman instead of
+// docker.
+func usesPodman(cfg *viper.Viper) bool {
+	return cfg.GetString("docker.runtime") == PodmanRuntime
+}
+
+// usesApptainer returns true if the jobs should be run with apptainer rather
+// than a container daemon.
+func usesApptainer(cfg *viper.Viper) bool {
+	return cfg.GetString("docker.backend") == ApptainerBackend
+}
+
 // Creates a command that can be used to run docker-compose.
 func DockerComposeCommand(cfg *viper.Viper, args ...string) *exec.Cmd {
 	return DockerComposeCommandContext(cfg, context.Background(), args...)
@@ -17,17 +29,25 @@ func DockerCommand(cfg *viper.Viper, args ...string) *exec.Cmd {
 	return DockerCommandContext(cfg, context.Background(), args...)
 }
 
-// Creates a command that can be used to run docker-compose in a context.
+// Creates a command that can be used to run docker-compose in a context. Uses
+// podman-compose or `podman compose` if the podman runtime is configured.
 func DockerComposeCommandContext(cfg *viper.Viper, ctx context.Context, args ...string) *exec.Cmd {
 	dockerComposePath := cfg.GetString("docker-compose.path")
+	if usesPodman(cfg) {
+		dockerComposePath = cfg.GetString("podman-compose.path")
+	}
 	if dockerComposePath != "" {
 		return exec.CommandContext(ctx, dockerComposePath, args...)
 	}
 	return DockerCommandContext(cfg, ctx, append([]string{"compose"}, args...)...)
 }
 
-// Creates a command that can be used to run docker in a context.
+// Creates a command that can be used to run docker in a context. Uses podman
+// if the podman runtime is configured.
 func DockerCommandContext(cfg *viper.Viper, ctx context.Context, args ...string) *exec.Cmd {
 	dockerPath := cfg.GetString("docker.path")
+	if usesPodman(cfg) {
+		dockerPath = cfg.GetString("podman.path")
+	}
 	return exec.CommandContext(ctx, dockerPath, args...)
 }
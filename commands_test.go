@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestDockerComposeCommandContext(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("docker.path", "/usr/bin/docker")
+	cfg.Set("podman.path", "/usr/bin/podman")
+
+	cmd := DockerComposeCommand(cfg, "pull")
+	if !reflect.DeepEqual(cmd.Args, []string{"/usr/bin/docker", "compose", "pull"}) {
+		t.Errorf("docker args were %v", cmd.Args)
+	}
+
+	cfg.Set("docker.runtime", PodmanRuntime)
+	cmd = DockerComposeCommand(cfg, "pull")
+	if !reflect.DeepEqual(cmd.Args, []string{"/usr/bin/podman", "compose", "pull"}) {
+		t.Errorf("podman args were %v", cmd.Args)
+	}
+
+	cfg.Set("podman-compose.path", "/usr/bin/podman-compose")
+	cmd = DockerComposeCommand(cfg, "pull")
+	if !reflect.DeepEqual(cmd.Args, []string{"/usr/bin/podman-compose", "pull"}) {
+		t.Errorf("podman-compose args were %v", cmd.Args)
+	}
+}
+
+func TestDockerCommandContext(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("docker.path", "/usr/bin/docker")
+	cfg.Set("podman.path", "/usr/bin/podman")
+
+	if cmd := DockerCommand(cfg, "login"); cmd.Path != "/usr/bin/docker" {
+		t.Errorf("path was %s instead of /usr/bin/docker", cmd.Path)
+	}
+
+	cfg.Set("docker.runtime", PodmanRuntime)
+	if cmd := DockerCommand(cfg, "login"); cmd.Path != "/usr/bin/podman" {
+		t.Errorf("path was %s instead of /usr/bin/podman", cmd.Path)
+	}
+}
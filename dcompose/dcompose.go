@@ -49,6 +49,9 @@ const (
 
 	// OutputContainer is the value used in the TypeLabel for output containers.
 	OutputContainer
+
+	// HookContainer is the value used in the TypeLabel for hook containers.
+	HookContainer
 )
 
 var (
@@ -66,7 +69,9 @@ type Volume struct {
 type Network struct {
 	Driver string
 	// EnableIPv6 bool              `yaml:"enable_ipv6"`
-	DriverOpts map[string]string `yaml:"driver_opts"`
+	DriverOpts map[string]string `yaml:"driver_opts,omitempty"`
+	Internal   bool              `yaml:",omitempty"`
+	Labels     map[string]string `yaml:",omitempty"`
 }
 
 // LoggingConfig configures the logging for a docker-compose service.
@@ -95,6 +100,7 @@ type Service struct {
 	Devices       []string          `yaml:",omitempty"`
 	DNS           []string          `yaml:",omitempty"`
 	DNSSearch     []string          `yaml:"dns_search,omitempty"`
+	GroupAdd      []string          `yaml:"group_add,omitempty"`
 	TMPFS         []string          `yaml:",omitempty"`
 	EntryPoint    string            `yaml:",omitempty"`
 	Environment   map[string]string `yaml:",omitempty"`
@@ -109,6 +115,9 @@ type Service struct {
 	Networks      map[string]*ServiceNetworkConfig `yaml:",omitempty"`
 	PIDsLimit     int64                            `yaml:"pids_limit,omitempty"`
 	Ports         []string                         `yaml:",omitempty"`
+	ReadOnly      bool                             `yaml:"read_only,omitempty"`
+	SecurityOpt   []string                         `yaml:"security_opt,omitempty"`
+	User          string                           `yaml:"user,omitempty"`
 	Volumes       []string                         `yaml:",omitempty"`
 	VolumesFrom   []string                         `yaml:"volumes_from,omitempty"`
 	WorkingDir    string                           `yaml:"working_dir,omitempty"`
@@ -143,8 +152,9 @@ func New(ld string, pathprefix string) (*JobCompose, error) {
 }
 
 // InitFromJob fills out values as appropriate for running in the DE's Condor
-// Cluster.
-func (j *JobCompose) InitFromJob(job *model.Job, cfg *viper.Viper, workingdir string) {
+// Cluster. Returns an error if the security profile, the run_as settings or
+// the hooks in the config are invalid.
+func (j *JobCompose) InitFromJob(job *model.Job, cfg *viper.Viper, workingdir string) error {
 	// The host path for the working directory volume mount
 	workingVolumeHostPath := path.Join(workingdir, VOLUMEDIR)
 	irodsConfigPath := path.Join(workingdir, IRODSCONFIGNAME)
@@ -186,8 +196,23 @@ func (j *JobCompose) InitFromJob(job *model.Job, cfg *viper.Viper, workingdir st
 	}
 
 	// Add the steps to the docker-compose file.
+	profile, err := ReadSecurityProfile(cfg)
+	if err != nil {
+		return err
+	}
+	runAs, err := ReadRunAs(cfg)
+	if err != nil {
+		return err
+	}
 	for index, step := range job.Steps {
 		j.ConvertStep(&step, index, job.Submitter, job.InvocationID, workingVolumeHostPath)
+		svc := j.Services[fmt.Sprintf("step_%d", index)]
+		if profile != nil {
+			profile.Apply(svc)
+		}
+		if runAs != nil {
+			runAs.Apply(svc)
+		}
 	}
 
 	// Add the final output job
@@ -208,6 +233,26 @@ func (j *JobCompose) InitFromJob(job *model.Job, cfg *viper.Viper, workingdir st
 	)
 
 	j.Services["upload_outputs"] = uploadOutputsSvc
+
+	// porklock runs as the same user as the steps, so that it can read their
+	// outputs and write the inputs where they can use them.
+	if runAs != nil {
+		for name, svc := range j.Services {
+			if name == "download_inputs" || name == "upload_outputs" || strings.HasPrefix(name, "input_") {
+				runAs.Apply(svc)
+			}
+		}
+	}
+
+	// Add the hooks from the config.
+	hooks, err := ReadHooks(cfg)
+	if err != nil {
+		return err
+	}
+	for i := range hooks {
+		j.Services[hooks[i].ServiceName()] = NewHookService(&hooks[i], job.InvocationID, workingVolumeHostPath)
+	}
+	return nil
 }
 
 // NewPorklockService generates a docker-compose service for porklock
@@ -314,6 +359,10 @@ func (j *JobCompose) ConvertStep(step *model.Step, index int, user, invID, worki
 		svc.EntryPoint = stepContainer.EntryPoint
 	}
 
+	if stepContainer.UID > 0 {
+		svc.User = strconv.Itoa(stepContainer.UID)
+	}
+
 	if stepContainer.MemoryLimit > 0 {
 		svc.MemLimit = strconv.FormatInt(stepContainer.MemoryLimit, 10)
 	}
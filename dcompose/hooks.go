@@ -0,0 +1,114 @@
+package dcompose
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/cyverse-de/model"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// HookConfig describes a container that the site running road-runner wants
+// to run at a point in every job's lifecycle. Hooks are listed under the
+// "hooks" key in the config.
+type HookConfig struct {
+	// Name identifies the hook. The hook's service is called hook_<name>.
+	Name string
+
+	// Phase is the job phase the hook runs around, for example "steps".
+	Phase string
+
+	// When is "before", "after", "success" or "failure". Failure hooks run
+	// after the phase fails or is cancelled.
+	When string
+
+	Image   string
+	Command []string
+
+	// Environment lists the hook's environment variables as KEY=value
+	// strings. It's not a map because viper lowercases map keys.
+	Environment []string
+
+	// Volumes are extra volumes for the hook container, in the same format as
+	// docker-compose volumes. The job's working volume is always mounted at
+	// the hook's working directory.
+	Volumes []string
+
+	// Timeout limits how long the hook can run, for example "5m". There's no
+	// limit by default.
+	Timeout string
+
+	// FailureStatus is the name of the job status used when the hook fails.
+	// An empty value means failures are reported but don't affect the job.
+	FailureStatus string `mapstructure:"failure_status"`
+}
+
+// ServiceName returns the name of the docker-compose service for the hook.
+func (h *HookConfig) ServiceName() string {
+	return fmt.Sprintf("hook_%s", h.Name)
+}
+
+var hookNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// ReadHooks returns the hooks defined in the config. An error is returned if
+// a hook is missing its name or image, or if two hooks have the same name.
+func ReadHooks(cfg *viper.Viper) ([]HookConfig, error) {
+	var hooks []HookConfig
+	if cfg == nil || !cfg.IsSet("hooks") {
+		return hooks, nil
+	}
+	if err := cfg.UnmarshalKey("hooks", &hooks); err != nil {
+		return nil, errors.Wrap(err, "failed to read the hooks from the config")
+	}
+
+	seen := make(map[string]bool)
+	for i, h := range hooks {
+		if !hookNamePattern.MatchString(h.Name) {
+			return nil, fmt.Errorf("hook %d has an invalid name %q", i, h.Name)
+		}
+		if seen[h.Name] {
+			return nil, fmt.Errorf("there is more than one hook named %s", h.Name)
+		}
+		seen[h.Name] = true
+		if h.Image == "" {
+			return nil, fmt.Errorf("hook %s doesn't have an image", h.Name)
+		}
+		hooks[i].When = strings.ToLower(h.When)
+	}
+	return hooks, nil
+}
+
+// NewHookService generates a docker-compose service for a hook.
+func NewHookService(hook *HookConfig, invocationID, workingVolumeHostPath string) *Service {
+	env := map[string]string{
+		"JOB_UUID":   invocationID,
+		"HOOK_PHASE": hook.Phase,
+		"HOOK_WHEN":  hook.When,
+	}
+	for _, e := range hook.Environment {
+		parts := strings.SplitN(e, "=", 2)
+		if len(parts) == 2 {
+			env[parts[0]] = parts[1]
+		} else {
+			env[parts[0]] = ""
+		}
+	}
+
+	volumes := []string{strings.Join([]string{workingVolumeHostPath, WORKDIR, "rw"}, ":")}
+	volumes = append(volumes, hook.Volumes...)
+
+	return &Service{
+		Image:       hook.Image,
+		Command:     hook.Command,
+		Environment: env,
+		WorkingDir:  WORKDIR,
+		Volumes:     volumes,
+		Labels: map[string]string{
+			model.DockerLabelKey: invocationID,
+			TypeLabel:            strconv.Itoa(HookContainer),
+		},
+	}
+}
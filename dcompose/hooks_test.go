@@ -0,0 +1,116 @@
+package dcompose
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func hooksConfig(t *testing.T, yml string) *viper.Viper {
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	if err := cfg.ReadConfig(bytes.NewBufferString(yml)); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestReadHooks(t *testing.T) {
+	cfg := hooksConfig(t, `
+hooks:
+  - name: scrub
+    phase: upload
+    when: Before
+    image: example/scrub:1.0
+    command: [scrub, /de-app-work]
+    environment: [LEVEL=high]
+    timeout: 5m
+    failure_status: output_failed
+`)
+	hooks, err := ReadHooks(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hooks) != 1 {
+		t.Fatalf("%d hooks were read", len(hooks))
+	}
+	h := hooks[0]
+	if h.Name != "scrub" || h.Phase != "upload" || h.When != "before" || h.Image != "example/scrub:1.0" {
+		t.Errorf("unexpected hook: %+v", h)
+	}
+	if strings.Join(h.Command, " ") != "scrub /de-app-work" {
+		t.Errorf("command was %v", h.Command)
+	}
+	if strings.Join(h.Environment, ",") != "LEVEL=high" {
+		t.Errorf("environment was %v", h.Environment)
+	}
+	if h.Timeout != "5m" || h.FailureStatus != "output_failed" {
+		t.Errorf("unexpected hook: %+v", h)
+	}
+	if h.ServiceName() != "hook_scrub" {
+		t.Errorf("service name was %s", h.ServiceName())
+	}
+}
+
+func TestReadHooksErrors(t *testing.T) {
+	tests := map[string]string{
+		"name":      "hooks:\n  - name: 'bad name'\n    image: x\n",
+		"image":     "hooks:\n  - name: noimage\n",
+		"duplicate": "hooks:\n  - name: a\n    image: x\n  - name: a\n    image: y\n",
+	}
+	for name, yml := range tests {
+		if _, err := ReadHooks(hooksConfig(t, yml)); err == nil {
+			t.Errorf("%s: no error was returned", name)
+		}
+	}
+
+	hooks, err := ReadHooks(viper.New())
+	if err != nil || len(hooks) != 0 {
+		t.Errorf("got %v and %v without any hooks", hooks, err)
+	}
+}
+
+func TestInitFromJobHooks(t *testing.T) {
+	cfg := hooksConfig(t, `
+porklock:
+  image: porklock
+  tag: latest
+hooks:
+  - name: license
+    phase: steps
+    when: before
+    image: example/license:1.0
+    command: [check]
+    environment: [LICENSE_SERVER=lic.example.org]
+    volumes: ["/etc/licenses:/licenses:ro"]
+`)
+	jc, err := New("de-logging", "/var/lib/condor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = jc.InitFromJob(testJob, cfg, "/work"); err != nil {
+		t.Fatal(err)
+	}
+
+	svc, ok := jc.Services["hook_license"]
+	if !ok {
+		t.Fatal("the hook service wasn't added")
+	}
+	if svc.Image != "example/license:1.0" || svc.WorkingDir != WORKDIR {
+		t.Errorf("unexpected service: %+v", svc)
+	}
+	expectedVolumes := []string{"/work/workingvolume:/de-app-work:rw", "/etc/licenses:/licenses:ro"}
+	if strings.Join(svc.Volumes, ",") != strings.Join(expectedVolumes, ",") {
+		t.Errorf("volumes were %v", svc.Volumes)
+	}
+	if svc.Environment["JOB_UUID"] != testJob.InvocationID ||
+		svc.Environment["HOOK_PHASE"] != "steps" ||
+		svc.Environment["LICENSE_SERVER"] != "lic.example.org" {
+		t.Errorf("environment was %v", svc.Environment)
+	}
+	if svc.Labels[TypeLabel] == "" {
+		t.Errorf("labels were %v", svc.Labels)
+	}
+}
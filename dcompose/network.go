@@ -0,0 +1,113 @@
+package dcompose
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/model"
+	"github.com/spf13/viper"
+)
+
+// The egress policies for a job's steps.
+const (
+	// EgressNone runs the steps without any networking.
+	EgressNone = "none"
+
+	// EgressInternal lets the steps reach each other, but nothing outside of
+	// the job.
+	EgressInternal = "internal"
+
+	// EgressFull gives the steps the same network access as the host. It's
+	// the default.
+	EgressFull = "full"
+)
+
+const (
+	// StepsNetwork is the job's network for its steps and data containers.
+	StepsNetwork = "steps"
+
+	// TransferNetwork is the job's network for porklock and the hooks. It
+	// always has outside access so that iRODS can be reached.
+	TransferNetwork = "transfer"
+)
+
+// egressLevels orders the egress policies from the most to the least
+// restrictive.
+var egressLevels = map[string]int{
+	EgressNone:     0,
+	EgressInternal: 1,
+	EgressFull:     2,
+}
+
+// ValidateEgress returns an error if the egress policy isn't one of the
+// supported values. An empty string is allowed, and means it isn't set.
+func ValidateEgress(egress string) error {
+	if _, ok := egressLevels[egress]; !ok && egress != "" {
+		return fmt.Errorf("unknown egress policy %q, it should be %s, %s or %s", egress, EgressNone, EgressInternal, EgressFull)
+	}
+	return nil
+}
+
+// ReadEgress returns the egress policy from network.egress in the config.
+func ReadEgress(cfg *viper.Viper) (string, error) {
+	if cfg == nil || cfg.GetString("network.egress") == "" {
+		return EgressFull, nil
+	}
+	egress := strings.ToLower(cfg.GetString("network.egress"))
+	if err := ValidateEgress(egress); err != nil {
+		return "", err
+	}
+	return egress, nil
+}
+
+// StricterEgress returns the more restrictive of the two egress policies. An
+// empty policy doesn't restrict anything.
+func StricterEgress(a, b string) string {
+	if b == "" || (a != "" && egressLevels[a] <= egressLevels[b]) {
+		return a
+	}
+	return b
+}
+
+// isTransferService returns true for the porklock and hook services, which
+// always need to reach iRODS and the site's own services.
+func isTransferService(name string) bool {
+	return name == "download_inputs" ||
+		name == "upload_outputs" ||
+		strings.HasPrefix(name, "input_") ||
+		strings.HasPrefix(name, "hook_")
+}
+
+// InitNetworks gives the job its own networks, labeled with the invocation ID
+// so that network-pruner can clean them up, and attaches every service to
+// one of them. The steps and data containers are limited by the egress policy.
+// A step's own network_mode is kept unless the policy is stricter than full.
+func (j *JobCompose) InitNetworks(invocationID, egress string) {
+	labels := map[string]string{model.DockerLabelKey: invocationID}
+	j.Networks[TransferNetwork] = &Network{Driver: "bridge", Labels: labels}
+	if egress != EgressNone {
+		j.Networks[StepsNetwork] = &Network{
+			Driver:   "bridge",
+			Internal: egress == EgressInternal,
+			Labels:   labels,
+		}
+	} else {
+		delete(j.Networks, StepsNetwork)
+	}
+
+	for name, svc := range j.Services {
+		switch {
+		case isTransferService(name):
+			svc.NetworkMode = ""
+			svc.Networks = map[string]*ServiceNetworkConfig{TransferNetwork: {}}
+		case egress == EgressNone:
+			svc.NetworkMode = "none"
+			svc.Networks = nil
+		case svc.NetworkMode == "none" || (svc.NetworkMode != "" && egress == EgressFull):
+			svc.Networks = nil
+		default:
+			svc.NetworkMode = ""
+			svc.Networks = map[string]*ServiceNetworkConfig{StepsNetwork: {}}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package dcompose
+
+import (
+	"testing"
+
+	"github.com/cyverse-de/model"
+)
+
+func TestReadEgress(t *testing.T) {
+	tests := map[string]string{
+		"porklock:\n  tag: latest\n":     EgressFull,
+		"network:\n  egress: none\n":     EgressNone,
+		"network:\n  egress: Internal\n": EgressInternal,
+	}
+	for yml, expected := range tests {
+		if egress, err := ReadEgress(hooksConfig(t, yml)); err != nil || egress != expected {
+			t.Errorf("egress for %q was %q, error was %v", yml, egress, err)
+		}
+	}
+	if _, err := ReadEgress(hooksConfig(t, "network:\n  egress: some\n")); err == nil {
+		t.Error("an unknown egress policy didn't return an error")
+	}
+}
+
+func TestStricterEgress(t *testing.T) {
+	tests := []struct {
+		a, b, expected string
+	}{
+		{EgressFull, "", EgressFull},
+		{EgressFull, EgressInternal, EgressInternal},
+		{EgressInternal, EgressFull, EgressInternal},
+		{EgressNone, EgressInternal, EgressNone},
+		{"", EgressNone, EgressNone},
+	}
+	for _, tt := range tests {
+		if actual := StricterEgress(tt.a, tt.b); actual != tt.expected {
+			t.Errorf("StricterEgress(%q, %q) was %q", tt.a, tt.b, actual)
+		}
+	}
+}
+
+// networkedCompose returns the docker-compose file for testJob with the
+// job's networks set up for the egress policy.
+func networkedCompose(t *testing.T, egress string) *JobCompose {
+	cfg := hooksConfig(t, `
+porklock:
+  image: porklock
+  tag: latest
+hooks:
+  - name: license
+    phase: steps
+    when: before
+    image: example/license-check:1.0
+`)
+	jc, err := New("de-logging", "/var/lib/condor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = jc.InitFromJob(testJob, cfg, "/work"); err != nil {
+		t.Fatal(err)
+	}
+	jc.InitNetworks(testJob.InvocationID, egress)
+	return jc
+}
+
+func TestInitNetworks(t *testing.T) {
+	jc := networkedCompose(t, EgressInternal)
+	steps, transfer := jc.Networks[StepsNetwork], jc.Networks[TransferNetwork]
+	if steps == nil || !steps.Internal || transfer == nil || transfer.Internal {
+		t.Fatalf("networks were %+v", jc.Networks)
+	}
+	if steps.Labels[model.DockerLabelKey] != testJob.InvocationID || transfer.Labels[model.DockerLabelKey] != testJob.InvocationID {
+		t.Errorf("networks weren't labeled with the invocation ID: %+v", jc.Networks)
+	}
+	for name, svc := range jc.Services {
+		expected := StepsNetwork
+		if isTransferService(name) {
+			expected = TransferNetwork
+		}
+		if _, ok := svc.Networks[expected]; !ok || len(svc.Networks) != 1 || svc.NetworkMode != "" {
+			t.Errorf("%s had network mode %q and networks %v", name, svc.NetworkMode, svc.Networks)
+		}
+	}
+
+	// Without egress, the steps don't get a network at all, but porklock
+	// still does.
+	jc = networkedCompose(t, EgressNone)
+	if _, ok := jc.Networks[StepsNetwork]; ok {
+		t.Error("the steps network was created when the egress policy was none")
+	}
+	if svc := jc.Services["step_0"]; svc.NetworkMode != "none" || svc.Networks != nil {
+		t.Errorf("step_0 had network mode %q and networks %v", svc.NetworkMode, svc.Networks)
+	}
+	if _, ok := jc.Services["upload_outputs"].Networks[TransferNetwork]; !ok {
+		t.Error("upload_outputs wasn't on the transfer network")
+	}
+
+	// With full access, a network mode from the job is kept.
+	jc = networkedCompose(t, EgressFull)
+	if _, ok := jc.Services["step_0"].Networks[StepsNetwork]; !ok || jc.Networks[StepsNetwork].Internal {
+		t.Errorf("step_0 wasn't on an external steps network: %+v", jc.Networks)
+	}
+	jc.Services["step_0"].NetworkMode = "host"
+	jc.InitNetworks(testJob.InvocationID, EgressFull)
+	if svc := jc.Services["step_0"]; svc.NetworkMode != "host" || svc.Networks != nil {
+		t.Errorf("step_0 had network mode %q and networks %v", svc.NetworkMode, svc.Networks)
+	}
+	jc.InitNetworks(testJob.InvocationID, EgressInternal)
+	if svc := jc.Services["step_0"]; svc.NetworkMode != "" {
+		t.Errorf("step_0 kept the network mode %q with internal egress", svc.NetworkMode)
+	}
+	if _, ok := jc.Services["hook_license"].Networks[TransferNetwork]; !ok {
+		t.Error("hook_license wasn't on the transfer network")
+	}
+}
@@ -0,0 +1,188 @@
+package dcompose
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// SecuritySettings are the hardening options that can be applied to a tool
+// step's container. Fields that aren't set are left alone.
+type SecuritySettings struct {
+	// CapDrop and CapAdd are the capabilities removed from and added to the
+	// container, for example ["ALL"] and ["CHOWN", "SETUID"].
+	CapDrop []string `mapstructure:"cap_drop"`
+	CapAdd  []string `mapstructure:"cap_add"`
+
+	// NoNewPrivileges stops the container's processes from gaining privileges
+	// through setuid binaries.
+	NoNewPrivileges *bool `mapstructure:"no_new_privileges"`
+
+	// Seccomp is the path to a seccomp profile, or "unconfined".
+	Seccomp *string
+
+	// AppArmor is the name of an AppArmor profile loaded on the host, or
+	// "unconfined".
+	AppArmor *string
+
+	// ReadOnly makes the container's root filesystem read-only. The working
+	// directory and /tmp are always mounted read-write.
+	ReadOnly *bool `mapstructure:"read_only"`
+
+	// User is the user the container runs as, either "uid" or "uid:gid".
+	User *string
+}
+
+// SecurityOverride changes the security settings for the steps that use a
+// particular image.
+type SecurityOverride struct {
+	// Image is the image the override applies to, with or without a tag. It
+	// can contain path.Match wildcards, for example "discoenv/*".
+	Image string
+
+	SecuritySettings `mapstructure:",squash"`
+}
+
+// SecurityProfile is the site's hardening for the containers that run the
+// job's tool steps. It's read from the "security" key in the config.
+type SecurityProfile struct {
+	SecuritySettings `mapstructure:",squash"`
+
+	// Overrides are applied in order after the settings above, so later
+	// overrides win.
+	Overrides []SecurityOverride
+}
+
+var (
+	capabilityPattern = regexp.MustCompile(`^(?i:cap_)?[A-Z_]+$`)
+	userPattern       = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_.-]*(:[a-zA-Z0-9_][a-zA-Z0-9_.-]*)?$`)
+)
+
+// validate checks the values of the settings. The name identifies the
+// settings in errors.
+func (s *SecuritySettings) validate(name string) error {
+	for _, c := range append(append([]string{}, s.CapDrop...), s.CapAdd...) {
+		if !capabilityPattern.MatchString(c) {
+			return fmt.Errorf("%s has an invalid capability %q", name, c)
+		}
+	}
+	if s.Seccomp != nil && *s.Seccomp != "unconfined" {
+		if _, err := os.Stat(*s.Seccomp); err != nil {
+			return errors.Wrapf(err, "%s has an invalid seccomp profile", name)
+		}
+	}
+	if s.User != nil && !userPattern.MatchString(*s.User) {
+		return fmt.Errorf("%s has an invalid user %q", name, *s.User)
+	}
+	return nil
+}
+
+// merge returns the settings with the fields that are set in o replaced.
+func (s SecuritySettings) merge(o SecuritySettings) SecuritySettings {
+	if o.CapDrop != nil {
+		s.CapDrop = o.CapDrop
+	}
+	if o.CapAdd != nil {
+		s.CapAdd = o.CapAdd
+	}
+	if o.NoNewPrivileges != nil {
+		s.NoNewPrivileges = o.NoNewPrivileges
+	}
+	if o.Seccomp != nil {
+		s.Seccomp = o.Seccomp
+	}
+	if o.AppArmor != nil {
+		s.AppArmor = o.AppArmor
+	}
+	if o.ReadOnly != nil {
+		s.ReadOnly = o.ReadOnly
+	}
+	if o.User != nil {
+		s.User = o.User
+	}
+	return s
+}
+
+// ReadSecurityProfile returns the security profile defined in the config, or
+// nil if there isn't one.
+func ReadSecurityProfile(cfg *viper.Viper) (*SecurityProfile, error) {
+	if cfg == nil || !cfg.IsSet("security") {
+		return nil, nil
+	}
+	p := &SecurityProfile{}
+	if err := cfg.UnmarshalKey("security", p); err != nil {
+		return nil, errors.Wrap(err, "failed to read the security profile from the config")
+	}
+	if err := p.validate("the security profile"); err != nil {
+		return nil, err
+	}
+	for i, o := range p.Overrides {
+		if o.Image == "" {
+			return nil, fmt.Errorf("security override %d doesn't have an image", i)
+		}
+		if _, err := path.Match(o.Image, ""); err != nil {
+			return nil, errors.Wrapf(err, "security override %d has an invalid image pattern", i)
+		}
+		if err := o.validate(fmt.Sprintf("the security override for %s", o.Image)); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// matches returns true if the override applies to the image.
+func (o *SecurityOverride) matches(image string) bool {
+	name := image
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	for _, candidate := range []string{image, name} {
+		if ok, _ := path.Match(o.Image, candidate); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Settings returns the settings for a container running the image, with the
+// matching overrides applied.
+func (p *SecurityProfile) Settings(image string) SecuritySettings {
+	s := p.SecuritySettings
+	for i := range p.Overrides {
+		if p.Overrides[i].matches(image) {
+			s = s.merge(p.Overrides[i].SecuritySettings)
+		}
+	}
+	return s
+}
+
+// Apply sets the security options on the service based on its image.
+func (p *SecurityProfile) Apply(svc *Service) {
+	s := p.Settings(svc.Image)
+	if s.CapDrop != nil {
+		svc.CapDrop = s.CapDrop
+	}
+	if s.CapAdd != nil {
+		svc.CapAdd = s.CapAdd
+	}
+	if s.NoNewPrivileges != nil && *s.NoNewPrivileges {
+		svc.SecurityOpt = append(svc.SecurityOpt, "no-new-privileges:true")
+	}
+	if s.Seccomp != nil && *s.Seccomp != "" {
+		svc.SecurityOpt = append(svc.SecurityOpt, "seccomp="+*s.Seccomp)
+	}
+	if s.AppArmor != nil && *s.AppArmor != "" {
+		svc.SecurityOpt = append(svc.SecurityOpt, "apparmor="+*s.AppArmor)
+	}
+	if s.ReadOnly != nil {
+		svc.ReadOnly = *s.ReadOnly
+	}
+	if s.User != nil {
+		svc.User = *s.User
+	}
+}
@@ -0,0 +1,143 @@
+package dcompose
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const securityConfig = `
+porklock:
+  image: porklock
+  tag: latest
+security:
+  cap_drop: [ALL]
+  cap_add: [CHOWN, DAC_OVERRIDE]
+  no_new_privileges: true
+  apparmor: docker-default
+  read_only: true
+  user: "1000:1000"
+  overrides:
+    - image: container-image-name-1
+      read_only: false
+      cap_add: [CHOWN, SYS_PTRACE]
+    - image: legacy/*
+      user: root
+      no_new_privileges: false
+`
+
+func TestReadSecurityProfile(t *testing.T) {
+	p, err := ReadSecurityProfile(hooksConfig(t, securityConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := p.Settings("other/tool:1.0")
+	if !reflect.DeepEqual(s.CapAdd, []string{"CHOWN", "DAC_OVERRIDE"}) || !*s.ReadOnly || *s.User != "1000:1000" {
+		t.Errorf("settings were %+v", s)
+	}
+
+	s = p.Settings("container-image-name-1:container-image-tag-1")
+	if !reflect.DeepEqual(s.CapAdd, []string{"CHOWN", "SYS_PTRACE"}) || *s.ReadOnly || *s.User != "1000:1000" {
+		t.Errorf("settings were %+v", s)
+	}
+
+	s = p.Settings("legacy/tool:2")
+	if *s.NoNewPrivileges || *s.User != "root" || !*s.ReadOnly {
+		t.Errorf("settings were %+v", s)
+	}
+
+	if p, err = ReadSecurityProfile(hooksConfig(t, "porklock: {image: porklock}\n")); p != nil || err != nil {
+		t.Errorf("profile was %+v, error was %v", p, err)
+	}
+}
+
+func TestReadSecurityProfileErrors(t *testing.T) {
+	tests := map[string]string{
+		"capability": "security:\n  cap_drop: [all-of-them]\n",
+		"seccomp":    "security:\n  seccomp: /does/not/exist.json\n",
+		"user":       "security:\n  user: 'a b'\n",
+		"image":      "security:\n  overrides:\n    - read_only: false\n",
+		"pattern":    "security:\n  overrides:\n    - image: '['\n",
+	}
+	for name, yml := range tests {
+		if _, err := ReadSecurityProfile(hooksConfig(t, yml)); err == nil {
+			t.Errorf("no error was returned for an invalid %s", name)
+		}
+	}
+}
+
+func TestInitFromJobSecurity(t *testing.T) {
+	seccomp := path.Join(t.TempDir(), "seccomp.json")
+	if err := os.WriteFile(seccomp, []byte(`{"defaultAction": "SCMP_ACT_ERRNO"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := hooksConfig(t, strings.Replace(securityConfig, "  read_only: true\n", "  read_only: true\n  seccomp: "+seccomp+"\n", 1))
+
+	jc, err := New("de-logging", "/var/lib/condor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = jc.InitFromJob(testJob, cfg, "/work"); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := jc.Services["step_0"]
+	if !reflect.DeepEqual(svc.CapDrop, []string{"ALL"}) || !reflect.DeepEqual(svc.CapAdd, []string{"CHOWN", "SYS_PTRACE"}) {
+		t.Errorf("capabilities were %v and %v", svc.CapDrop, svc.CapAdd)
+	}
+	expectedOpts := []string{"no-new-privileges:true", "seccomp=" + seccomp, "apparmor=docker-default"}
+	if !reflect.DeepEqual(svc.SecurityOpt, expectedOpts) {
+		t.Errorf("security options were %v", svc.SecurityOpt)
+	}
+	if svc.ReadOnly || svc.User != "1000:1000" {
+		t.Errorf("read only was %v, user was %q", svc.ReadOnly, svc.User)
+	}
+
+	// Only the tool steps are hardened.
+	if upload := jc.Services["upload_outputs"]; upload.User != "" || len(upload.SecurityOpt) != 0 {
+		t.Errorf("upload service was %+v", upload)
+	}
+
+	// The new fields come out as valid docker-compose settings.
+	b, err := yaml.Marshal(jc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		Services map[string]map[string]interface{}
+	}
+	if err = yaml.Unmarshal(b, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	step := parsed.Services["step_0"]
+	if step["user"] != "1000:1000" || step["security_opt"] == nil {
+		t.Errorf("step_0 was %v", step)
+	}
+	if _, ok := step["read_only"]; ok {
+		t.Errorf("read_only was included when it's false: %v", step)
+	}
+	if !strings.Contains(string(b), "cap_drop: [ALL]") {
+		t.Errorf("cap_drop was missing from:\n%s", b)
+	}
+}
+
+func TestInitFromJobInvalidConfig(t *testing.T) {
+	tests := map[string]string{
+		"security profile": "porklock: {image: porklock}\nsecurity:\n  cap_drop: [all-of-them]\n",
+		"run_as settings":  "porklock: {image: porklock}\nrun_as:\n  uid: 1000\n  gid: -1\n",
+	}
+	for name, yml := range tests {
+		jc, err := New("de-logging", "/var/lib/condor")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = jc.InitFromJob(testJob, hooksConfig(t, yml), "/work"); err == nil {
+			t.Errorf("no error was returned for invalid %s", name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package dcompose
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// RunAs is the unprivileged user that the job's steps and porklock run as. The
+// working directories are owned by it instead of being world-writable.
+type RunAs struct {
+	UID int
+	GID int
+
+	// UsernsOffset is added to the IDs to get the owner of the working
+	// directories on the host, for daemons that use userns-remap. It's the
+	// start of the remapped user's subordinate ID range.
+	UsernsOffset int
+}
+
+// ReadRunAs returns the user from run_as.uid and run_as.gid in the config. The
+// GID defaults to the UID. Returns nil if run_as.uid isn't set or is negative. The UIDs that
+// the job's containers set don't turn it on, since road-runner may not be able
+// to give the working directories to them.
+func ReadRunAs(cfg *viper.Viper) (*RunAs, error) {
+	if cfg == nil || !cfg.IsSet("run_as.uid") {
+		return nil, nil
+	}
+	u := &RunAs{UID: cfg.GetInt("run_as.uid")}
+	if u.UID < 0 {
+		return nil, nil
+	}
+
+	u.GID = u.UID
+	if cfg.IsSet("run_as.gid") {
+		u.GID = cfg.GetInt("run_as.gid")
+	}
+	u.UsernsOffset = cfg.GetInt("run_as.userns_offset")
+	if u.GID < 0 || u.UsernsOffset < 0 {
+		return nil, fmt.Errorf("run_as.gid and run_as.userns_offset can't be negative")
+	}
+	return u, nil
+}
+
+// User returns the user in the "uid:gid" form used by docker-compose.
+func (u *RunAs) User() string {
+	return fmt.Sprintf("%d:%d", u.UID, u.GID)
+}
+
+// HostIDs returns the owner that the working directories need on the host.
+func (u *RunAs) HostIDs() (int, int) {
+	return u.UID + u.UsernsOffset, u.GID + u.UsernsOffset
+}
+
+// Apply runs the service as the user unless it already has one, for example
+// from the job or the security profile. A service that runs as someone else
+// is added to the user's group so it can still write to the working directory.
+func (u *RunAs) Apply(svc *Service) {
+	if svc.User == "" {
+		svc.User = u.User()
+		return
+	}
+	uid := strings.SplitN(svc.User, ":", 2)[0]
+	if uid == strconv.Itoa(u.UID) {
+		return
+	}
+	gid := strconv.Itoa(u.GID)
+	for _, g := range svc.GroupAdd {
+		if g == gid {
+			return
+		}
+	}
+	svc.GroupAdd = append(svc.GroupAdd, gid)
+}
@@ -0,0 +1,101 @@
+package dcompose
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cyverse-de/model"
+)
+
+// uidJob returns a job whose steps run as the given UIDs. Zero leaves a
+// step's UID unset.
+func uidJob(uids ...int) *model.Job {
+	job := &model.Job{InvocationID: "uid-invocation-id"}
+	for _, uid := range uids {
+		job.Steps = append(job.Steps, model.Step{
+			Component: model.StepComponent{
+				Container: model.Container{
+					Image: model.ContainerImage{Name: "tool", Tag: "1.0"},
+					UID:   uid,
+				},
+			},
+			Environment: model.StepEnvironment{},
+		})
+	}
+	return job
+}
+
+func TestReadRunAs(t *testing.T) {
+	u, err := ReadRunAs(hooksConfig(t, "run_as:\n  uid: 2000\n  userns_offset: 100000\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.User() != "2000:2000" {
+		t.Errorf("user was %s", u.User())
+	}
+	if uid, gid := u.HostIDs(); uid != 102000 || gid != 102000 {
+		t.Errorf("host IDs were %d:%d", uid, gid)
+	}
+
+	u, err = ReadRunAs(hooksConfig(t, "run_as:\n  uid: 1000\n  gid: 100\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.User() != "1000:100" {
+		t.Errorf("user was %s", u.User())
+	}
+
+	// Only run_as.uid turns it on.
+	if u, err = ReadRunAs(hooksConfig(t, "run_as:\n  gid: 100\n")); u != nil || err != nil {
+		t.Errorf("user was %v, error was %v", u, err)
+	}
+	if u, err = ReadRunAs(nil); u != nil || err != nil {
+		t.Errorf("user was %v, error was %v", u, err)
+	}
+	if _, err = ReadRunAs(hooksConfig(t, "run_as:\n  uid: 1000\n  gid: -1\n")); err == nil {
+		t.Error("a negative GID didn't return an error")
+	}
+}
+
+func TestInitFromJobRunAs(t *testing.T) {
+	cfg := hooksConfig(t, `
+porklock:
+  image: porklock
+  tag: latest
+run_as:
+  uid: 1000
+  gid: 1000
+security:
+  overrides:
+    - image: tool
+      user: nobody
+`)
+	job := uidJob(0, 1000, 1001)
+	job.Steps[0].Component.Container.Image.Name = "other"
+	job.Steps[1].Component.Container.Image.Name = "other"
+
+	jc, err := New("de-logging", "/var/lib/condor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = jc.InitFromJob(job, cfg, "/work"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		service  string
+		user     string
+		groupAdd []string
+	}{
+		{"step_0", "1000:1000", nil},
+		{"step_1", "1000", nil},
+		{"step_2", "nobody", []string{"1000"}},
+		{"upload_outputs", "1000:1000", nil},
+	}
+	for _, tt := range tests {
+		svc := jc.Services[tt.service]
+		if svc.User != tt.user || !reflect.DeepEqual(svc.GroupAdd, tt.groupAdd) {
+			t.Errorf("%s ran as %q with groups %v", tt.service, svc.User, svc.GroupAdd)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultDiskReserve is how little free space the working volume can have
+	// while inputs are downloaded and steps run before the job is stopped.
+	defaultDiskReserve = 100 * 1024 * 1024
+
+	// defaultDiskCheckInterval is how often the free space is checked while
+	// inputs are downloaded and steps run.
+	defaultDiskCheckInterval = 10 * time.Second
+)
+
+// diskFree returns the number of bytes available to unprivileged users on the
+// filesystem containing dir. It's a variable so that tests can replace it.
+var diskFree = func(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, errors.Wrapf(err, "failed to get the free space in %s", dir)
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// DiskSpaceError is returned when the working volume doesn't have enough free
+// space for the job.
+type DiskSpaceError struct {
+	Dir      string
+	Free     int64
+	Required int64
+
+	// Activity is what the job was doing when it ran out of space. It's empty
+	// for the check made before the job starts.
+	Activity string
+}
+
+func (e *DiskSpaceError) Error() string {
+	if e.Activity == "" {
+		return fmt.Sprintf(
+			"Not enough disk space to run the job: %s is free in %s, but at least %s is needed",
+			formatBytes(e.Free), e.Dir, formatBytes(e.Required),
+		)
+	}
+	return fmt.Sprintf(
+		"Job ran out of disk space while %s: only %s was free in %s, less than the %s that has to be kept free",
+		e.Activity, formatBytes(e.Free), e.Dir, formatBytes(e.Required),
+	)
+}
+
+// checkDiskSpace makes sure that the working volume has at least the space set
+// by disk.min_free, or the disk space requested by the job's steps if that's
+// larger.
+func (r *JobRunner) checkDiskSpace() error {
+	required := r.job.DiskRequest()
+	if r.cfg != nil && r.cfg.IsSet("disk.min_free") {
+		if min := int64(r.cfg.GetSizeInBytes("disk.min_free")); min > required {
+			required = min
+		}
+	}
+	if required <= 0 {
+		return nil
+	}
+
+	free, err := diskFree(r.volumeDir)
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	if free < required {
+		return &DiskSpaceError{Dir: r.volumeDir, Free: free, Required: required}
+	}
+	return nil
+}
+
+// diskMonitor periodically checks the free space in the working volume and
+// cancels its context when the space drops below the reserve.
+type diskMonitor struct {
+	dir      string
+	reserve  int64
+	activity string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err *DiskSpaceError
+}
+
+// startDiskMonitor starts watching the working volume. The activity is used in
+// the error message, for example "downloading inputs". The interval is set by
+// disk.check_interval, and zero turns the monitor off.
+func (r *JobRunner) startDiskMonitor(ctx context.Context, activity string) *diskMonitor {
+	m := &diskMonitor{
+		dir:      r.volumeDir,
+		reserve:  defaultDiskReserve,
+		activity: activity,
+		done:     make(chan struct{}),
+	}
+	interval := defaultDiskCheckInterval
+	if r.cfg != nil {
+		if r.cfg.IsSet("disk.reserve") {
+			m.reserve = int64(r.cfg.GetSizeInBytes("disk.reserve"))
+		}
+		if r.cfg.IsSet("disk.check_interval") {
+			interval = r.cfg.GetDuration("disk.check_interval")
+		}
+	}
+	m.ctx, m.cancel = context.WithCancel(ctx)
+
+	if interval <= 0 || m.reserve <= 0 {
+		close(m.done)
+		return m
+	}
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.ctx.Done():
+				return
+			case <-ticker.C:
+				if m.check() {
+					m.cancel()
+					return
+				}
+			}
+		}
+	}()
+	return m
+}
+
+// check returns true if the free space is below the reserve, recording the
+// error.
+func (m *diskMonitor) check() bool {
+	free, err := diskFree(m.dir)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	if free >= m.reserve {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = &DiskSpaceError{Dir: m.dir, Free: free, Required: m.reserve, Activity: m.activity}
+	return true
+}
+
+// stop stops the monitor. The free space is checked one more time if the
+// work failed, since a tool that fills the disk usually fails before the next
+// check. Returns the error if the job ran out of space.
+func (m *diskMonitor) stop(failed bool) *DiskSpaceError {
+	m.cancel()
+	<-m.done
+	if m.err == nil && failed && m.reserve > 0 {
+		m.check()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// monitorDisk wraps a phase so that it's stopped when the working volume runs
+// out of space. The phase then fails with the given status and a message
+// saying what the job was doing when it ran out.
+func monitorDisk(run func(*JobRunner, context.Context) (messaging.StatusCode, error), status messaging.StatusCode, activity string) func(*JobRunner, context.Context) (messaging.StatusCode, error) {
+	return func(r *JobRunner, ctx context.Context) (messaging.StatusCode, error) {
+		m := r.startDiskMonitor(ctx, activity)
+		s, err := run(r, m.ctx)
+		if diskErr := m.stop(err != nil); diskErr != nil {
+			r.failureMessage = diskErr.Error()
+			running(r.client, r.job, r.failureMessage)
+			return status, diskErr
+		}
+		return s, err
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/spf13/viper"
+)
+
+// fakeDiskFree makes diskFree report the value returned by free until the
+// test ends.
+func fakeDiskFree(t *testing.T, free func() int64) {
+	orig := diskFree
+	diskFree = func(dir string) (int64, error) {
+		return free(), nil
+	}
+	t.Cleanup(func() {
+		diskFree = orig
+	})
+}
+
+func TestCheckDiskSpace(t *testing.T) {
+	fakeDiskFree(t, func() int64 { return 500 })
+
+	job := stepsJob(2)
+	r, _ := newTestRunner(t, job, &testBackend{})
+	if err := r.checkDiskSpace(); err != nil {
+		t.Errorf("an error was returned without a minimum: %v", err)
+	}
+
+	job.Steps[1].Component.Container.MinDiskSpace = 1000
+	err := r.checkDiskSpace()
+	var diskErr *DiskSpaceError
+	if !errors.As(err, &diskErr) || diskErr.Required != 1000 || diskErr.Free != 500 {
+		t.Errorf("error was %v", err)
+	}
+
+	r.cfg = viper.New()
+	r.cfg.Set("disk.min_free", "1KB")
+	job.Steps[1].Component.Container.MinDiskSpace = 0
+	if err = r.checkDiskSpace(); !errors.As(err, &diskErr) || diskErr.Required != 1024 {
+		t.Errorf("error was %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "Not enough disk space to run the job: 500 B is free") {
+		t.Errorf("message was %q", err.Error())
+	}
+}
+
+func TestInitPhaseDiskSpace(t *testing.T) {
+	fakeDiskFree(t, func() int64 { return 0 })
+
+	job := stepsJob(1)
+	job.Steps[0].Component.Container.MinDiskSpace = 1024
+	backend := &testBackend{}
+	r, _ := newTestRunner(t, job, backend)
+
+	r.runLifecycle(context.Background())
+	if r.status != messaging.StatusInputFailed {
+		t.Errorf("status was %d", r.status)
+	}
+	if r.projectName == "" {
+		t.Error("the project name wasn't set before the job failed")
+	}
+	if _, err := os.Stat(path.Join(r.logsDir, "de-transfer-trigger.log")); err != nil {
+		t.Errorf("init didn't finish before the job failed: %v", err)
+	}
+	if !strings.Contains(r.failureMessage, "Not enough disk space") {
+		t.Errorf("failure message was %q", r.failureMessage)
+	}
+	for _, svcname := range backend.services {
+		if svcname == "step_0" {
+			t.Error("step_0 was run")
+		}
+	}
+}
+
+func TestDiskMonitorStopsSteps(t *testing.T) {
+	var free int64 = 1 << 30
+	fakeDiskFree(t, func() int64 { return atomic.LoadInt64(&free) })
+
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			atomic.StoreInt64(&free, 1024)
+			return blockUntilDone(ctx, svcname)
+		},
+	}
+	r, _ := newTestRunner(t, stepsJob(1), backend)
+	r.cfg = viper.New()
+	r.cfg.Set("disk.check_interval", "10ms")
+
+	run := monitorDisk((*JobRunner).runAllSteps, messaging.StatusStepFailed, "running steps")
+	status, err := run(r, context.Background())
+	if status != messaging.StatusStepFailed {
+		t.Errorf("status was %d", status)
+	}
+	var diskErr *DiskSpaceError
+	if !errors.As(err, &diskErr) {
+		t.Fatalf("error was %v", err)
+	}
+	expected := "Job ran out of disk space while running steps: only 1.0 KiB was free"
+	if !strings.HasPrefix(r.failureMessage, expected) {
+		t.Errorf("failure message was %q", r.failureMessage)
+	}
+}
+
+func TestDiskMonitorCheckAfterFailure(t *testing.T) {
+	fakeDiskFree(t, func() int64 { return 0 })
+
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			return &ServiceResult{ExitCode: 1}, errors.New("write failed: no space left on device")
+		},
+	}
+	r, _ := newTestRunner(t, stepsJob(1), backend)
+	r.cfg = viper.New()
+	r.cfg.Set("disk.check_interval", "1h")
+
+	run := monitorDisk((*JobRunner).runAllSteps, messaging.StatusStepFailed, "running steps")
+	if _, err := run(r, context.Background()); !strings.Contains(err.Error(), "ran out of disk space") {
+		t.Errorf("error was %v", err)
+	}
+}
@@ -2,11 +2,21 @@ package fs
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/cyverse-de/model"
 	"github.com/pkg/errors"
@@ -172,3 +182,639 @@ func WriteJobParameters(fs FileSystem, outputDir string, job *model.Job) error {
 	}
 	return WriteCSV(fileWriter, records)
 }
+
+// Attempt describes a single attempt at running part of a job that can be
+// retried.
+type Attempt struct {
+	Phase    string
+	Target   string
+	Number   int
+	Started  time.Time
+	Duration time.Duration
+	Error    string
+}
+
+// WriteRetryHistory writes out the attempts to a CSV file called
+// "RetryHistory.csv" located in the output directory.
+func WriteRetryHistory(fs FileSystem, outputDir string, attempts []Attempt) error {
+	outputPath := path.Join(outputDir, "RetryHistory.csv")
+	fileWriter, err := fs.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer fileWriter.Close()
+	records := [][]string{
+		{"Phase", "Target", "Attempt", "Started", "Duration", "Error"},
+	}
+	for _, a := range attempts {
+		records = append(records, []string{
+			a.Phase,
+			a.Target,
+			strconv.Itoa(a.Number),
+			a.Started.Format(time.RFC3339),
+			a.Duration.Round(time.Millisecond).String(),
+			a.Error,
+		})
+	}
+	return WriteCSV(fileWriter, records)
+}
+
+// ResourceUsage describes the resources a step's container used while it ran.
+// The memory and pid counts are the highest seen, the CPU time and block I/O
+// are the totals from the last sample taken.
+type ResourceUsage struct {
+	Step        int
+	Service     string
+	Duration    time.Duration
+	PeakMemory  int64
+	CPUSeconds  float64
+	BlockRead   int64
+	BlockWrite  int64
+	PeakPids    int64
+	SampleCount int
+}
+
+// WriteResourceUsage writes out the usage of each step to a CSV file called
+// "ResourceUsage.csv" located in the output directory.
+func WriteResourceUsage(fs FileSystem, outputDir string, usage []ResourceUsage) error {
+	outputPath := path.Join(outputDir, "ResourceUsage.csv")
+	fileWriter, err := fs.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer fileWriter.Close()
+	records := [][]string{
+		{"Step", "Service", "Duration", "Peak Memory Bytes", "CPU Seconds", "Block Read Bytes", "Block Write Bytes", "Peak Pids", "Samples"},
+	}
+	for _, u := range usage {
+		records = append(records, []string{
+			strconv.Itoa(u.Step),
+			u.Service,
+			u.Duration.Round(time.Millisecond).String(),
+			strconv.FormatInt(u.PeakMemory, 10),
+			strconv.FormatFloat(u.CPUSeconds, 'f', 3, 64),
+			strconv.FormatInt(u.BlockRead, 10),
+			strconv.FormatInt(u.BlockWrite, 10),
+			strconv.FormatInt(u.PeakPids, 10),
+			strconv.Itoa(u.SampleCount),
+		})
+	}
+	return WriteCSV(fileWriter, records)
+}
+
+// StepResult records how a step's container exited. Fields that the container
+// backend couldn't determine are left at their zero values.
+type StepResult struct {
+	Step        int        `json:"step"`
+	Service     string     `json:"service"`
+	ContainerID string     `json:"container_id,omitempty"`
+	ExitCode    int        `json:"exit_code"`
+	OOMKilled   bool       `json:"oom_killed"`
+	Signal      int        `json:"signal,omitempty"`
+	SignalName  string     `json:"signal_name,omitempty"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// WriteStepResults writes out the results as JSON to a file called
+// "StepResults.json" located in the output directory.
+func WriteStepResults(fs FileSystem, outputDir string, results []StepResult) error {
+	outputPath := path.Join(outputDir, "StepResults.json")
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the step results")
+	}
+	fileWriter, err := fs.Create(outputPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", outputPath)
+	}
+	defer fileWriter.Close()
+	if _, err = fileWriter.Write(b); err != nil {
+		return errors.Wrapf(err, "failed to write to %s", outputPath)
+	}
+	return nil
+}
+
+// ImageDigest records the digest that one of the job's images was pinned to.
+type ImageDigest struct {
+	Image     string `json:"image"`
+	Digest    string `json:"digest"`
+	Reference string `json:"reference"`
+}
+
+// WriteImageDigests writes out the digests as JSON to a file called
+// "ImageDigests.json" located in the output directory.
+func WriteImageDigests(fs FileSystem, outputDir string, digests []ImageDigest) error {
+	outputPath := path.Join(outputDir, "ImageDigests.json")
+	b, err := json.MarshalIndent(digests, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the image digests")
+	}
+	fileWriter, err := fs.Create(outputPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", outputPath)
+	}
+	defer fileWriter.Close()
+	if _, err = fileWriter.Write(b); err != nil {
+		return errors.Wrapf(err, "failed to write to %s", outputPath)
+	}
+	return nil
+}
+
+// TailFile returns up to the last n lines of the file, reading no more than
+// the last maxBytes of it. A line that's cut off by the byte limit is dropped
+// unless it's the only one.
+func TailFile(filePath string, n int, maxBytes int64) ([]string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", filePath)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to stat %s", filePath)
+	}
+	offset := info.Size() - maxBytes
+	if offset < 0 || maxBytes <= 0 {
+		offset = 0
+	}
+	b := make([]byte, info.Size()-offset)
+	if _, err = f.ReadAt(b, offset); err != nil && err != io.EOF {
+		return nil, errors.Wrapf(err, "failed to read %s", filePath)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if offset > 0 && len(lines) > 1 {
+		lines = lines[1:]
+	}
+	if len(lines) == 1 && lines[0] == "" {
+		return nil, nil
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
+
+// LogFile is a log file that keeps the first HeadBytes and the last TailBytes
+// written to it. The tail is held in memory and written out with a marker
+// saying how much was left out when the file is closed.
+type LogFile struct {
+	f         *os.File
+	headBytes int64
+	tailBytes int64
+
+	mu      sync.Mutex
+	written int64
+	tail    []byte
+	tailPos int
+	dropped int64
+	closed  bool
+}
+
+// CreateLogFile creates the log file at filePath. If maxSize is positive, the
+// file keeps the first and last maxSize/2 bytes written to it.
+func CreateLogFile(filePath string, maxSize int64) (*LogFile, error) {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return nil, err
+	}
+	l := &LogFile{f: f}
+	if maxSize > 0 {
+		l.headBytes = maxSize / 2
+		l.tailBytes = maxSize - l.headBytes
+	}
+	return l, nil
+}
+
+// Write writes to the head of the file until it's full, then keeps the most
+// recent bytes in memory. It never fails once the head is full.
+func (l *LogFile) Write(p []byte) (int, error) {
+	if l == nil {
+		return 0, os.ErrInvalid
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, os.ErrClosed
+	}
+
+	n := len(p)
+	if l.tailBytes == 0 {
+		return l.f.Write(p)
+	}
+	if room := l.headBytes - l.written; room > 0 {
+		k := int64(len(p))
+		if k > room {
+			k = room
+		}
+		w, err := l.f.Write(p[:k])
+		l.written += int64(w)
+		if err != nil {
+			return w, err
+		}
+		p = p[k:]
+	}
+	l.keep(p)
+	return n, nil
+}
+
+// keep adds p to the in-memory tail, which works as a ring buffer once it's
+// full.
+func (l *LogFile) keep(p []byte) {
+	if len(l.tail) < int(l.tailBytes) {
+		k := int(l.tailBytes) - len(l.tail)
+		if k > len(p) {
+			k = len(p)
+		}
+		l.tail = append(l.tail, p[:k]...)
+		p = p[k:]
+	}
+	if len(p) > len(l.tail) {
+		l.dropped += int64(len(p) - len(l.tail))
+		p = p[len(p)-len(l.tail):]
+	}
+	for len(p) > 0 {
+		k := copy(l.tail[l.tailPos:], p)
+		l.dropped += int64(k)
+		l.tailPos = (l.tailPos + k) % len(l.tail)
+		p = p[k:]
+	}
+}
+
+// Close writes out the tail and closes the file. It's safe to call more than
+// once.
+func (l *LogFile) Close() error {
+	if l == nil {
+		return os.ErrInvalid
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+
+	var err error
+	if l.dropped > 0 {
+		_, err = fmt.Fprintf(l.f, "\n[... %d bytes were removed from this log because it reached its size limit ...]\n", l.dropped)
+	}
+	if err == nil && len(l.tail) > 0 {
+		if _, err = l.f.Write(l.tail[l.tailPos:]); err == nil {
+			_, err = l.f.Write(l.tail[:l.tailPos])
+		}
+	}
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// ReadExclusions reads the paths listed one per line in an upload exclusions
+// file. Blank lines are skipped.
+func ReadExclusions(fs FileSystem, filePath string) ([]string, error) {
+	fileReader, err := fs.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", filePath)
+	}
+	defer fileReader.Close()
+	b, err := io.ReadAll(fileReader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", filePath)
+	}
+	var paths []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// WriteExclusions writes out the paths one per line to an upload exclusions
+// file.
+func WriteExclusions(fs FileSystem, filePath string, paths []string) error {
+	fileWriter, err := fs.Create(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", filePath)
+	}
+	defer fileWriter.Close()
+	for _, p := range paths {
+		if _, err = fmt.Fprintln(fileWriter, p); err != nil {
+			return errors.Wrapf(err, "failed to write to %s", filePath)
+		}
+	}
+	return nil
+}
+
+// Excluded returns true if the path, relative to the directory being
+// uploaded, is covered by one of the exclusions. An exclusion covers a path
+// when it matches the whole path, one of its parent directories, or its base
+// name, either exactly or as a glob pattern.
+func Excluded(rel string, exclusions []string) bool {
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	base := path.Base(rel)
+	for _, e := range exclusions {
+		e = strings.TrimSuffix(filepath.ToSlash(filepath.Clean(e)), "/")
+		if e == rel || e == base || strings.HasPrefix(rel, e+"/") {
+			return true
+		}
+		if ok, _ := path.Match(e, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(e, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// UploadSize returns the total size of the regular files under dir that
+// aren't covered by the exclusions.
+func UploadSize(dir string, exclusions []string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if Excluded(rel, exclusions) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to add up the size of %s", dir)
+	}
+	return total, nil
+}
+
+// ManifestFilename is the name of the file in the logs directory that lists
+// the job's outputs.
+const ManifestFilename = "OutputManifest.json"
+
+// ManifestEntry describes one of the files that a job uploads.
+type ManifestEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+}
+
+// OutputManifest lists the files that a job uploads.
+type OutputManifest struct {
+	InvocationID string          `json:"invocation_id"`
+	CreatedAt    time.Time       `json:"created_at"`
+	TotalSize    int64           `json:"total_size"`
+	Files        []ManifestEntry `json:"files"`
+}
+
+// ManifestFiles returns an entry for each regular file under dir that isn't
+// covered by the exclusions, sorted by path. The files are hashed by the given
+// number of workers at once.
+func ManifestFiles(dir string, exclusions []string, workers int) ([]ManifestEntry, error) {
+	var entries []ManifestEntry
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if Excluded(rel, exclusions) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			entries = append(entries, ManifestEntry{
+				Path:    filepath.ToSlash(rel),
+				Size:    info.Size(),
+				ModTime: info.ModTime().UTC(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list the files in %s", dir)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		indexes  = make(chan int)
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				sum, err := hashFile(filepath.Join(dir, filepath.FromSlash(entries[i].Path)))
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					continue
+				}
+				entries[i].SHA256 = sum
+			}
+		}()
+	}
+	for i := range entries {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return entries, nil
+}
+
+// hashFile returns the hex-encoded SHA-256 checksum of the file.
+func hashFile(filePath string) (string, error) {
+	sum, err := Checksum(filePath, sha256.New())
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// Checksum returns the checksum of the file's contents calculated with h.
+func Checksum(filePath string, h hash.Hash) ([]byte, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", filePath)
+	}
+	defer f.Close()
+	if _, err = io.Copy(h, f); err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", filePath)
+	}
+	return h.Sum(nil), nil
+}
+
+// WriteOutputManifest writes out the manifest as JSON to the file called
+// "OutputManifest.json" in the output directory.
+func WriteOutputManifest(fs FileSystem, outputDir string, manifest *OutputManifest) error {
+	outputPath := path.Join(outputDir, ManifestFilename)
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the output manifest")
+	}
+	fileWriter, err := fs.Create(outputPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", outputPath)
+	}
+	defer fileWriter.Close()
+	if _, err = fileWriter.Write(b); err != nil {
+		return errors.Wrapf(err, "failed to write to %s", outputPath)
+	}
+	return nil
+}
+
+// CheckpointFilename is the name of the file in the working directory that
+// records the progress of a job.
+const CheckpointFilename = "road-runner-checkpoint.json"
+
+// FileState is the size and modification time of a file in the working volume
+// when it was recorded in a checkpoint.
+type FileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// Checkpoint records the parts of a job that have finished so that the job
+// can be resumed after road-runner is restarted in the same directory.
+type Checkpoint struct {
+	InvocationID string `json:"invocation_id"`
+
+	// Phases lists the phases of the job that have finished.
+	Phases []string `json:"phases"`
+
+	// Inputs lists the names of the input download services that have
+	// finished.
+	Inputs []string `json:"inputs"`
+
+	// Steps lists the indexes of the steps that have finished.
+	Steps []int `json:"steps"`
+
+	// ImageDigests maps each image used by the job to the digest of the image
+	// that was pulled.
+	ImageDigests map[string]string `json:"image_digests,omitempty"`
+
+	// Files records the state of the files in the working volume, keyed by
+	// their paths relative to it, after the last input download or step
+	// finished.
+	Files map[string]FileState `json:"files"`
+}
+
+// WriteCheckpoint writes out the checkpoint as JSON to the file called
+// "road-runner-checkpoint.json" in the directory.
+func WriteCheckpoint(fs FileSystem, dir string, cp *Checkpoint) error {
+	outputPath := path.Join(dir, CheckpointFilename)
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the checkpoint")
+	}
+	fileWriter, err := fs.Create(outputPath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create %s", outputPath)
+	}
+	defer fileWriter.Close()
+	if _, err = fileWriter.Write(b); err != nil {
+		return errors.Wrapf(err, "failed to write to %s", outputPath)
+	}
+	return nil
+}
+
+// ReadCheckpoint reads the checkpoint written by WriteCheckpoint from the
+// directory.
+func ReadCheckpoint(fs FileSystem, dir string) (*Checkpoint, error) {
+	inputPath := path.Join(dir, CheckpointFilename)
+	fileReader, err := fs.Open(inputPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", inputPath)
+	}
+	defer fileReader.Close()
+	cp := &Checkpoint{}
+	if err = json.NewDecoder(fileReader).Decode(cp); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", inputPath)
+	}
+	return cp, nil
+}
+
+// ScanFiles returns the state of the regular files under root, keyed by their
+// paths relative to dir. Directories named in skip, relative to dir, aren't
+// scanned. A root that doesn't exist has no files.
+func ScanFiles(dir, root string, skip ...string) (map[string]FileState, error) {
+	files := make(map[string]FileState)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && p == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			for _, s := range skip {
+				if rel == s {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() {
+			files[filepath.ToSlash(rel)] = FileState{Size: info.Size(), ModTime: info.ModTime().UTC()}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to scan %s", root)
+	}
+	return files, nil
+}
+
+// ChangedFiles returns the paths of the recorded files that no longer exist in
+// dir or that have a different size or modification time. Files that weren't
+// recorded are ignored.
+func ChangedFiles(dir string, recorded map[string]FileState) []string {
+	var changed []string
+	for rel, want := range recorded {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel)))
+		if err != nil || info.Size() != want.Size || !info.ModTime().UTC().Equal(want.ModTime) {
+			changed = append(changed, rel)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
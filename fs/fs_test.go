@@ -2,6 +2,7 @@ package fs
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"path"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/cyverse-de/model"
 )
@@ -316,3 +318,397 @@ func TestWriteJobParameters(t *testing.T) {
 		t.Errorf("Contents of %s were:\n%s\n\tinstead of:\n%s\n", outPath, actual, expected)
 	}
 }
+
+func TestWriteRetryHistory(t *testing.T) {
+	tfs := newTestFS()
+	started := time.Date(2021, 10, 27, 15, 10, 0, 0, time.UTC)
+	attempts := []Attempt{
+		{Phase: "download", Target: "/iplant/home/test/in.txt", Number: 1, Started: started, Duration: 1500 * time.Millisecond, Error: "exit status 1"},
+		{Phase: "download", Target: "/iplant/home/test/in.txt", Number: 2, Started: started.Add(time.Minute), Duration: 2 * time.Second},
+	}
+	expected := `Phase,Target,Attempt,Started,Duration,Error
+download,/iplant/home/test/in.txt,1,2021-10-27T15:10:00Z,1.5s,exit status 1
+download,/iplant/home/test/in.txt,2,2021-10-27T15:11:00Z,2s,
+`
+	if err := WriteRetryHistory(tfs, "test", attempts); err != nil {
+		t.Error(err)
+	}
+	outPath := "test/RetryHistory.csv"
+	inputreader, err := tfs.Open(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if _, err = io.Copy(buf, inputreader); err != nil {
+		t.Error(err)
+	}
+	if actual := buf.String(); actual != expected {
+		t.Errorf("Contents of %s were:\n%s\n\tinstead of:\n%s\n", outPath, actual, expected)
+	}
+}
+
+func TestWriteResourceUsage(t *testing.T) {
+	tfs := newTestFS()
+	usage := []ResourceUsage{
+		{Step: 0, Service: "step_0", Duration: 90 * time.Second, PeakMemory: 1048576, CPUSeconds: 12.5, BlockRead: 4096, BlockWrite: 512, PeakPids: 3, SampleCount: 18},
+	}
+	expected := `Step,Service,Duration,Peak Memory Bytes,CPU Seconds,Block Read Bytes,Block Write Bytes,Peak Pids,Samples
+0,step_0,1m30s,1048576,12.500,4096,512,3,18
+`
+	if err := WriteResourceUsage(tfs, "test", usage); err != nil {
+		t.Error(err)
+	}
+	outPath := "test/ResourceUsage.csv"
+	inputreader, err := tfs.Open(outPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if _, err = io.Copy(buf, inputreader); err != nil {
+		t.Error(err)
+	}
+	if actual := buf.String(); actual != expected {
+		t.Errorf("Contents of %s were:\n%s\n\tinstead of:\n%s\n", outPath, actual, expected)
+	}
+}
+
+func TestWriteStepResults(t *testing.T) {
+	tfs := newTestFS()
+	started := time.Date(2021, 10, 27, 15, 10, 0, 0, time.UTC)
+	finished := started.Add(time.Minute)
+	results := []StepResult{
+		{Step: 0, Service: "step_0", ContainerID: "abc", StartedAt: &started, FinishedAt: &finished},
+		{Step: 1, Service: "step_1", ExitCode: 137, OOMKilled: true, Signal: 9, SignalName: "killed", Error: "exit status 137"},
+	}
+	if err := WriteStepResults(tfs, "test", results); err != nil {
+		t.Fatal(err)
+	}
+	f, err := tfs.Open("test/StepResults.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []StepResult
+	if err = json.NewDecoder(f).Decode(&actual); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, results) {
+		t.Errorf("results were %+v instead of %+v", actual, results)
+	}
+}
+
+func TestWriteImageDigests(t *testing.T) {
+	tfs := newTestFS()
+	digests := []ImageDigest{
+		{Image: "discoenv/tool:1.0", Digest: "sha256:abc", Reference: "discoenv/tool@sha256:abc"},
+	}
+	if err := WriteImageDigests(tfs, "test", digests); err != nil {
+		t.Fatal(err)
+	}
+	f, err := tfs.Open("test/ImageDigests.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actual []ImageDigest
+	if err = json.NewDecoder(f).Decode(&actual); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, digests) {
+		t.Errorf("digests were %+v instead of %+v", actual, digests)
+	}
+}
+
+func TestTailFile(t *testing.T) {
+	p := path.Join(t.TempDir(), "stderr")
+	if err := os.WriteFile(p, []byte("one\ntwo\nthree\nfour\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		n        int
+		maxBytes int64
+		expected []string
+	}{
+		{2, 1024, []string{"three", "four"}},
+		{10, 1024, []string{"one", "two", "three", "four"}},
+		{10, 12, []string{"three", "four"}},
+		{10, 3, []string{"ur"}},
+	}
+	for _, test := range tests {
+		lines, err := TailFile(p, test.n, test.maxBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(lines, test.expected) {
+			t.Errorf("TailFile(%d, %d) returned %q instead of %q", test.n, test.maxBytes, lines, test.expected)
+		}
+	}
+
+	empty := path.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if lines, err := TailFile(empty, 10, 1024); err != nil || lines != nil {
+		t.Errorf("TailFile returned %q, %v for an empty file", lines, err)
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	tests := []struct {
+		maxSize  int64
+		writes   []string
+		expected string
+	}{
+		{0, []string{"hello ", "world"}, "hello world"},
+		{20, []string{"short"}, "short"},
+		{8, []string{"0123", "4567"}, "01234567"},
+		{8, []string{"0123456789"}, "0123\n[... 2 bytes were removed from this log because it reached its size limit ...]\n6789"},
+		{8, []string{"01", "2345", "67", "89", "abcdef"}, "0123\n[... 8 bytes were removed from this log because it reached its size limit ...]\ncdef"},
+		{8, []string{"0123", "4", "5", "6", "7", "8"}, "0123\n[... 1 bytes were removed from this log because it reached its size limit ...]\n5678"},
+	}
+	for i, test := range tests {
+		p := path.Join(t.TempDir(), "log")
+		l, err := CreateLogFile(p, test.maxSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range test.writes {
+			if n, err := l.Write([]byte(w)); err != nil || n != len(w) {
+				t.Errorf("%d: Write returned %d, %v", i, n, err)
+			}
+		}
+		if err = l.Close(); err != nil {
+			t.Error(err)
+		}
+		if err = l.Close(); err != nil {
+			t.Errorf("%d: second Close returned %v", i, err)
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != test.expected {
+			t.Errorf("%d: log contained %q instead of %q", i, b, test.expected)
+		}
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	exclusions := []string{"input.txt", "logs", "*.tmp", "scratch/"}
+	tests := map[string]bool{
+		"input.txt":          true,
+		"sub/input.txt":      true,
+		"logs":               true,
+		"logs/condor-stdout": true,
+		"a.tmp":              true,
+		"scratch/big.dat":    true,
+		"output.txt":         false,
+		"logsfile":           false,
+	}
+	for rel, expected := range tests {
+		if actual := Excluded(rel, exclusions); actual != expected {
+			t.Errorf("Excluded(%q) was %t", rel, actual)
+		}
+	}
+}
+
+func TestUploadSize(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]int{
+		"output.txt":    10,
+		"results/a.csv": 20,
+		"input.txt":     100,
+		"logs/stderr":   1000,
+		"results/b.tmp": 10000,
+	}
+	for name, size := range files {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size, err := UploadSize(dir, []string{"input.txt", "logs", "*.tmp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 30 {
+		t.Errorf("size was %d instead of 30", size)
+	}
+}
+
+func TestExclusions(t *testing.T) {
+	tfs := newTestFS()
+	if err := WriteExclusions(tfs, "excludes.txt", []string{"a", "b/c"}); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := ReadExclusions(tfs, "excludes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{"a", "b/c"}) {
+		t.Errorf("paths were %v", paths)
+	}
+}
+
+func TestManifestFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"output.txt":    "hello\n",
+		"results/a.csv": "a,b\n",
+		"results/b.tmp": "temporary",
+		"input.txt":     "input",
+		"logs/stderr":   "log",
+	}
+	for name, content := range files {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ManifestFiles(dir, []string{"input.txt", "logs", "*.tmp"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		path string
+		size int64
+		sum  string
+	}{
+		{"output.txt", 6, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"},
+		{"results/a.csv", 4, "5be08c9684a1d25efcee09318204824278b08bbfb4aef973ffefd0b9d7478313"},
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("entries were %+v", entries)
+	}
+	for i, e := range expected {
+		if entries[i].Path != e.path || entries[i].Size != e.size || entries[i].SHA256 != e.sum {
+			t.Errorf("entry %d was %+v", i, entries[i])
+		}
+		if entries[i].ModTime.IsZero() {
+			t.Errorf("entry %d has no modification time", i)
+		}
+	}
+}
+
+func TestWriteOutputManifest(t *testing.T) {
+	tfs := newTestFS()
+	manifest := &OutputManifest{
+		InvocationID: "invocation",
+		CreatedAt:    time.Date(2021, 10, 27, 15, 10, 0, 0, time.UTC),
+		TotalSize:    6,
+		Files: []ManifestEntry{
+			{Path: "output.txt", Size: 6, ModTime: time.Date(2021, 10, 27, 15, 0, 0, 0, time.UTC), SHA256: "abc"},
+		},
+	}
+	if err := WriteOutputManifest(tfs, "test", manifest); err != nil {
+		t.Fatal(err)
+	}
+	f, err := tfs.Open("test/OutputManifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual := &OutputManifest{}
+	if err = json.NewDecoder(f).Decode(actual); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, manifest) {
+		t.Errorf("manifest was %+v instead of %+v", actual, manifest)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	fs := newTestFS()
+	cp := &Checkpoint{
+		InvocationID: "invocation",
+		Phases:       []string{"pull", "download"},
+		Inputs:       []string{"input_0"},
+		Steps:        []int{0, 2},
+		ImageDigests: map[string]string{"alpine:latest": "sha256:abc"},
+		Files: map[string]FileState{
+			"in.txt": {Size: 3, ModTime: time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC)},
+		},
+	}
+	if err := WriteCheckpoint(fs, "/work", cp); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fs.filemap["/work/road-runner-checkpoint.json"]; !ok {
+		t.Fatal("the checkpoint file wasn't created")
+	}
+	actual, err := ReadCheckpoint(fs, "/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actual, cp) {
+		t.Errorf("checkpoint was %#v instead of %#v", actual, cp)
+	}
+
+	if _, err = ReadCheckpoint(newTestFS(), "/work"); err == nil {
+		t.Error("no error was returned for a missing checkpoint")
+	}
+}
+
+func TestScanFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"in.txt", "data/a.txt", "logs/ignored.txt"} {
+		if err := os.MkdirAll(path.Join(dir, path.Dir(p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path.Join(dir, p), []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := ScanFiles(dir, dir, "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files["in.txt"].Size != 6 || files["data/a.txt"].Size != 10 {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	files, err = ScanFiles(dir, path.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := files["data/a.txt"]; !ok || len(files) != 1 {
+		t.Errorf("unexpected files: %v", files)
+	}
+
+	files, err = ScanFiles(dir, path.Join(dir, "missing"))
+	if err != nil || len(files) != 0 {
+		t.Errorf("unexpected files %v and error %v for a missing root", files, err)
+	}
+}
+
+func TestChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{"same.txt", "modified.txt", "deleted.txt"} {
+		if err := os.WriteFile(path.Join(dir, p), []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorded, err := ScanFiles(dir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.WriteFile(path.Join(dir, "modified.txt"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(path.Join(dir, "deleted.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(path.Join(dir, "new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := ChangedFiles(dir, recorded)
+	expected := []string{"deleted.txt", "modified.txt"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("changed files were %v instead of %v", changed, expected)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// The values accepted for a step's on_failure setting.
+const (
+	// OnFailureAbort stops the job when the step fails. It's the default.
+	OnFailureAbort = "abort"
+
+	// OnFailureContinue lets the job carry on when the step fails, without
+	// failing the job.
+	OnFailureContinue = "continue"
+)
+
+// StepOptions contains the settings for a job step that road-runner supports
+// but that aren't part of model.Step. They're read from the same step object
+// in the job definition.
+type StepOptions struct {
+	// DependsOn lists the indexes of the steps that have to finish before this
+	// step can start.
+	DependsOn []int `json:"depends_on"`
+
+	// OnFailure is what happens to the job when the step fails, either
+	// OnFailureAbort or OnFailureContinue.
+	OnFailure string `json:"on_failure"`
+
+	// AlwaysRun steps still run after another step fails, once the steps
+	// they depend on are done.
+	AlwaysRun bool `json:"always_run"`
+
+	Config StepConfigOptions `json:"config"`
+}
+
+// StepConfigOptions contains the settings from a step's config object.
+type StepConfigOptions struct {
+	// Inputs are in the same order as the step's inputs in model.StepConfig.
+	Inputs []InputOptions `json:"input"`
+}
+
+// InputOptions contains the settings for a step input that aren't part of
+// model.StepInput.
+type InputOptions struct {
+	// Checksum is what the downloaded file's checksum should be, such as
+	// "sha256:<hex>". See parseChecksum for the formats that are accepted.
+	// It's only used by road-runner, so the job producer has to add it; the
+	// input's own fields don't carry a checksum.
+	Checksum string `json:"checksum"`
+}
+
+// JobOptions contains the settings for a job that road-runner supports but
+// that aren't part of model.Job. They're read from the same job definition.
+type JobOptions struct {
+	Steps []StepOptions `json:"steps"`
+
+	// Egress limits the network access of the job's steps further than the
+	// network.egress setting in the config. See EgressPolicy.
+	Egress string `json:"egress"`
+}
+
+// ParseJobOptions reads the road-runner specific settings out of a job
+// definition.
+func ParseJobOptions(data []byte) (*JobOptions, error) {
+	opts := &JobOptions{}
+	if err := json.Unmarshal(data, opts); err != nil {
+		return nil, errors.Wrap(err, "failed to parse the job options")
+	}
+	if err := dcompose.ValidateEgress(opts.Egress); err != nil {
+		return nil, err
+	}
+	for i, s := range opts.Steps {
+		switch s.OnFailure {
+		case "", OnFailureAbort, OnFailureContinue:
+		default:
+			return nil, fmt.Errorf("step %d has an unknown on_failure setting %q", i, s.OnFailure)
+		}
+		for j, input := range s.Config.Inputs {
+			if input.Checksum == "" {
+				continue
+			}
+			if _, err := parseChecksum(input.Checksum); err != nil {
+				return nil, errors.Wrapf(err, "input %d of step %d has an invalid checksum", j, i)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// Step returns the options for the step at the index. The zero value is
+// returned for steps without any options.
+func (o *JobOptions) Step(index int) StepOptions {
+	if o == nil || index < 0 || index >= len(o.Steps) {
+		return StepOptions{}
+	}
+	return o.Steps[index]
+}
+
+// DeclaresDependencies returns true if any step in the job lists the steps it
+// depends on.
+func (o *JobOptions) DeclaresDependencies() bool {
+	if o == nil {
+		return false
+	}
+	for _, s := range o.Steps {
+		if s.DependsOn != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// InputChecksum returns the expected checksum of the step's input at the
+// index, or an empty string if it doesn't have one.
+func (o *JobOptions) InputChecksum(step, input int) string {
+	inputs := o.Step(step).Config.Inputs
+	if input < 0 || input >= len(inputs) {
+		return ""
+	}
+	return inputs[input].Checksum
+}
+
+// EgressPolicy returns the egress policy for the job's steps. It's the one
+// from network.egress in the config, unless the job asks for a stricter one.
+// Jobs can't loosen the site's policy.
+func (o *JobOptions) EgressPolicy(cfg *viper.Viper) (string, error) {
+	egress, err := dcompose.ReadEgress(cfg)
+	if err != nil || o == nil {
+		return egress, err
+	}
+	return dcompose.StricterEgress(egress, o.Egress), nil
+}
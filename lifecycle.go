@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// JobPhase is one of the phases of a job's lifecycle.
+type JobPhase string
+
+// The phases of a job, in the order they normally run in.
+const (
+	PhaseInit           JobPhase = "init"
+	PhaseLogin          JobPhase = "login"
+	PhasePull           JobPhase = "pull"
+	PhaseDataContainers JobPhase = "data containers"
+	PhaseDownload       JobPhase = "download"
+	PhaseSteps          JobPhase = "steps"
+	PhaseUpload         JobPhase = "upload"
+	PhaseCleanup        JobPhase = "cleanup"
+
+	// phaseDone isn't a real phase, it's where the lifecycle ends.
+	phaseDone JobPhase = "done"
+)
+
+// PhaseOutcome describes how a phase ended.
+type PhaseOutcome int
+
+const (
+	// PhaseSucceeded means the phase finished without an error.
+	PhaseSucceeded PhaseOutcome = iota
+
+	// PhaseFailed means the phase returned an error.
+	PhaseFailed
+
+	// PhaseCancelled means the job was stopped while the phase was running.
+	PhaseCancelled
+)
+
+func (o PhaseOutcome) String() string {
+	switch o {
+	case PhaseSucceeded:
+		return "succeeded"
+	case PhaseFailed:
+		return "failed"
+	case PhaseCancelled:
+		return "was cancelled"
+	default:
+		return fmt.Sprintf("ended with outcome %d", int(o))
+	}
+}
+
+// PhaseResult contains the details of a phase that has finished.
+type PhaseResult struct {
+	Phase   JobPhase
+	Outcome PhaseOutcome
+
+	// Status is the job status the phase ended with. Phases that don't affect
+	// the job's status, like login, always return messaging.Success.
+	Status messaging.StatusCode
+	Err    error
+
+	Started  time.Time
+	Duration time.Duration
+}
+
+// PhaseHook is implemented by the types that need to run code around each
+// phase of a job. Hooks are called in the order they were added to the
+// JobRunner.
+type PhaseHook interface {
+	// BeforePhase is called before the phase runs. Returning an error fails
+	// the phase without running it.
+	BeforePhase(ctx context.Context, r *JobRunner, phase JobPhase) error
+
+	// AfterPhase is called after the phase finishes, before the job moves on
+	// to the next phase. Hooks can change the result, which changes the phase
+	// that comes next and the job's status.
+	AfterPhase(ctx context.Context, r *JobRunner, result *PhaseResult)
+}
+
+// HookError is returned from BeforePhase by hooks that need the job to fail
+// with a particular status.
+type HookError struct {
+	Status messaging.StatusCode
+	Err    error
+}
+
+func (e *HookError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error that caused the hook to fail.
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// phaseDefinition describes how a phase is run and which phase comes after
+// it.
+type phaseDefinition struct {
+	// description is used in the messages about the phase, for example "Job
+	// exceeded its maximum run time while <description>".
+	description string
+
+	run func(r *JobRunner, ctx context.Context) (messaging.StatusCode, error)
+
+	// hookFailureStatus is the job status used when a hook stops the phase
+	// from running without returning a HookError.
+	hookFailureStatus messaging.StatusCode
+
+	// limited is true for the phases that have to finish within the job's
+	// maximum run time and that get stopped when the job is stopped.
+	limited bool
+
+	onSuccess JobPhase
+	onFailure JobPhase
+	onCancel  JobPhase
+
+	// onFatal is the phase after a failure that sets the job's status, for
+	// phases whose other failures don't stop the job. Defaults to onFailure.
+	onFatal JobPhase
+}
+
+// lifecycle defines the phases of a job and the transitions between them. The
+// outputs are always uploaded, even if an earlier phase failed or the job was
+// stopped, because there might be logs that help debug what went wrong.
+var lifecycle = map[JobPhase]phaseDefinition{
+	PhaseInit: {
+		description:       "initializing the job",
+		run:               (*JobRunner).initPhase,
+		hookFailureStatus: messaging.StatusKilled,
+		limited:           true,
+		onSuccess:         PhaseLogin,
+		onFailure:         PhaseLogin,
+		onCancel:          PhaseUpload,
+		onFatal:           PhaseUpload,
+	},
+	PhaseLogin: {
+		description:       "logging into registries",
+		run:               (*JobRunner).loginPhase,
+		hookFailureStatus: messaging.StatusDockerPullFailed,
+		limited:           true,
+		onSuccess:         PhasePull,
+		onFailure:         PhasePull,
+		onCancel:          PhaseUpload,
+	},
+	PhasePull: {
+		description:       "pulling images",
+		run:               (*JobRunner).pullPhase,
+		hookFailureStatus: messaging.StatusDockerPullFailed,
+		limited:           true,
+		onSuccess:         PhaseDataContainers,
+		onFailure:         PhaseUpload,
+		onCancel:          PhaseUpload,
+	},
+	PhaseDataContainers: {
+		description:       "creating data containers",
+		run:               (*JobRunner).createDataContainers,
+		hookFailureStatus: messaging.StatusDockerCreateFailed,
+		limited:           true,
+		onSuccess:         PhaseDownload,
+		onFailure:         PhaseUpload,
+		onCancel:          PhaseUpload,
+	},
+	PhaseDownload: {
+		description:       "downloading inputs",
+		run:               monitorDisk((*JobRunner).downloadPhase, messaging.StatusInputFailed, "downloading inputs"),
+		hookFailureStatus: messaging.StatusInputFailed,
+		limited:           true,
+		onSuccess:         PhaseSteps,
+		onFailure:         PhaseUpload,
+		onCancel:          PhaseUpload,
+	},
+	PhaseSteps: {
+		description:       "running steps",
+		run:               monitorDisk((*JobRunner).runAllSteps, messaging.StatusStepFailed, "running steps"),
+		hookFailureStatus: messaging.StatusStepFailed,
+		limited:           true,
+		onSuccess:         PhaseUpload,
+		onFailure:         PhaseUpload,
+		onCancel:          PhaseUpload,
+	},
+	PhaseUpload: {
+		description:       "uploading outputs",
+		run:               (*JobRunner).uploadPhase,
+		hookFailureStatus: messaging.StatusOutputFailed,
+		onSuccess:         PhaseCleanup,
+		onFailure:         PhaseCleanup,
+		onCancel:          PhaseCleanup,
+	},
+	PhaseCleanup: {
+		description:       "cleaning up",
+		run:               (*JobRunner).cleanupPhase,
+		hookFailureStatus: messaging.Success,
+		onSuccess:         phaseDone,
+		onFailure:         phaseDone,
+		onCancel:          phaseDone,
+	},
+}
+
+// AddPhaseHook registers a hook that's called around each phase of the job.
+func (r *JobRunner) AddPhaseHook(h PhaseHook) {
+	r.hooks = append(r.hooks, h)
+}
+
+// runPhase runs a single phase along with its hooks.
+func (r *JobRunner) runPhase(ctx context.Context, phase JobPhase, def phaseDefinition) *PhaseResult {
+	result := &PhaseResult{
+		Phase:   phase,
+		Status:  messaging.Success,
+		Started: time.Now(),
+	}
+
+	for _, h := range r.hooks {
+		if err := h.BeforePhase(ctx, r, phase); err != nil {
+			result.Status = def.hookFailureStatus
+			var hookErr *HookError
+			if errors.As(err, &hookErr) {
+				result.Status = hookErr.Status
+			}
+			result.Err = errors.Wrapf(err, "a hook stopped the %s phase", phase)
+			break
+		}
+	}
+
+	if result.Err == nil {
+		result.Status, result.Err = def.run(r, ctx)
+	}
+	result.Duration = time.Since(result.Started)
+
+	switch {
+	case def.limited && ctx.Err() == context.Canceled:
+		result.Outcome = PhaseCancelled
+		if result.Status == messaging.Success {
+			result.Status = messaging.StatusKilled
+		}
+	case result.Err != nil:
+		result.Outcome = PhaseFailed
+	default:
+		result.Outcome = PhaseSucceeded
+	}
+
+	for _, h := range r.hooks {
+		h.AfterPhase(ctx, r, result)
+	}
+
+	return result
+}
+
+// nextPhase returns the phase that comes after the one in the result.
+func nextPhase(def phaseDefinition, result *PhaseResult) JobPhase {
+	switch result.Outcome {
+	case PhaseFailed:
+		if def.onFatal != "" && result.Status != messaging.Success {
+			return def.onFatal
+		}
+		return def.onFailure
+	case PhaseCancelled:
+		return def.onCancel
+	default:
+		return def.onSuccess
+	}
+}
+
+// nonFatal returns true if the phase returned an error but the job carried on
+// as if it succeeded, like init does when it can't copy a file into the logs.
+func (result *PhaseResult) nonFatal() bool {
+	return result.Outcome == PhaseFailed && result.Status == messaging.Success
+}
+
+// publishTransition logs and publishes the move from one phase to the next.
+// Errors that don't stop the job are only logged, so that users aren't told
+// that a phase failed when it didn't matter.
+func (r *JobRunner) publishTransition(result *PhaseResult, next JobPhase) {
+	outcome := result.Outcome.String()
+	if result.nonFatal() {
+		outcome = "finished"
+	}
+	msg := fmt.Sprintf("Phase %s %s after %s", result.Phase, outcome, result.Duration.Round(time.Millisecond))
+	if result.Err != nil && !result.nonFatal() {
+		msg = fmt.Sprintf("%s: %s", msg, result.Err.Error())
+	}
+	if next != phaseDone {
+		msg = fmt.Sprintf("%s, moving on to %s", msg, next)
+	}
+
+	log.WithFields(logrus.Fields{
+		"phase":   string(result.Phase),
+		"outcome": result.Outcome.String(),
+		"next":    string(next),
+	}).Info(msg)
+	running(r.client, r.job, msg)
+}
+
+// runLifecycle runs the job's phases from init through cleanup. The phases
+// that are limited by the job's maximum run time get jobCtx, the others get a
+// context that can't be cancelled so that outputs are uploaded and containers
+// are cleaned up even if the job was stopped. Phases that finished before the
+// job was resumed are skipped.
+func (r *JobRunner) runLifecycle(jobCtx context.Context) {
+	for phase := PhaseInit; phase != phaseDone; {
+		def := lifecycle[phase]
+
+		if r.phaseFinished(phase) {
+			msg := fmt.Sprintf("Skipping phase %s, it finished before the job was resumed", phase)
+			log.WithFields(logrus.Fields{"phase": string(phase)}).Info(msg)
+			running(r.client, r.job, msg)
+			phase = def.onSuccess
+			continue
+		}
+
+		ctx := context.Background()
+		if def.limited {
+			ctx = jobCtx
+		}
+
+		result := r.runPhase(ctx, phase, def)
+		if result.nonFatal() {
+			log.Warn(result.Err)
+		} else if result.Err != nil {
+			log.Error(result.Err)
+		}
+		if result.Status != messaging.Success {
+			r.status = result.Status
+		}
+		if def.limited && result.Outcome == PhaseFailed {
+			r.checkJobTimeLimit(ctx, def.description)
+		}
+
+		next := nextPhase(def, result)
+		r.publishTransition(result, next)
+		phase = next
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/messaging"
+)
+
+// recordingHook records the phases it's called for.
+type recordingHook struct {
+	before  []JobPhase
+	after   []*PhaseResult
+	failFor JobPhase
+}
+
+func (h *recordingHook) BeforePhase(ctx context.Context, r *JobRunner, phase JobPhase) error {
+	h.before = append(h.before, phase)
+	if phase == h.failFor {
+		return errors.New("stopped by the test hook")
+	}
+	return nil
+}
+
+func (h *recordingHook) AfterPhase(ctx context.Context, r *JobRunner, result *PhaseResult) {
+	h.after = append(h.after, result)
+}
+
+func (h *recordingHook) phases() []JobPhase {
+	var phases []JobPhase
+	for _, result := range h.after {
+		phases = append(phases, result.Phase)
+	}
+	return phases
+}
+
+func (h *recordingHook) outcome(phase JobPhase) PhaseOutcome {
+	for _, result := range h.after {
+		if result.Phase == phase {
+			return result.Outcome
+		}
+	}
+	return -1
+}
+
+func TestRunLifecycle(t *testing.T) {
+	backend := &testBackend{}
+	r, client := newTestRunner(t, inputsJob(1), backend)
+	hook := &recordingHook{}
+	r.AddPhaseHook(hook)
+
+	r.runLifecycle(context.Background())
+
+	expected := []JobPhase{
+		PhaseInit,
+		PhaseLogin,
+		PhasePull,
+		PhaseDataContainers,
+		PhaseDownload,
+		PhaseSteps,
+		PhaseUpload,
+		PhaseCleanup,
+	}
+	if !reflect.DeepEqual(hook.before, expected) {
+		t.Errorf("BeforePhase was called for %v instead of %v", hook.before, expected)
+	}
+	if !reflect.DeepEqual(hook.phases(), expected) {
+		t.Errorf("AfterPhase was called for %v instead of %v", hook.phases(), expected)
+	}
+	if !reflect.DeepEqual(backend.services, []string{"input_0", "step_0", "upload_outputs"}) {
+		t.Errorf("services were %v", backend.services)
+	}
+	if r.status != messaging.Success {
+		t.Errorf("status was %d", r.status)
+	}
+
+	var transitions int
+	for _, u := range client.updates {
+		if strings.HasPrefix(u.Message, "Phase ") {
+			transitions++
+		}
+	}
+	if transitions != len(expected) {
+		t.Errorf("%d transitions were published instead of %d", transitions, len(expected))
+	}
+}
+
+func TestRunLifecycleFailure(t *testing.T) {
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			if svcname == "input_0" {
+				return &ServiceResult{ExitCode: 1}, errors.New("exit status 1")
+			}
+			return &ServiceResult{}, nil
+		},
+	}
+	r, _ := newTestRunner(t, inputsJob(1), backend)
+	hook := &recordingHook{}
+	r.AddPhaseHook(hook)
+
+	r.runLifecycle(context.Background())
+
+	expected := []JobPhase{PhaseInit, PhaseLogin, PhasePull, PhaseDataContainers, PhaseDownload, PhaseUpload, PhaseCleanup}
+	if !reflect.DeepEqual(hook.phases(), expected) {
+		t.Errorf("phases were %v instead of %v", hook.phases(), expected)
+	}
+	if hook.outcome(PhaseDownload) != PhaseFailed {
+		t.Errorf("download outcome was %s", hook.outcome(PhaseDownload))
+	}
+	if r.status != messaging.StatusInputFailed {
+		t.Errorf("status was %d", r.status)
+	}
+}
+
+func TestRunLifecycleCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := &testBackend{
+		run: func(c context.Context, svcname string) (*ServiceResult, error) {
+			if svcname == "step_0" {
+				cancel()
+				return blockUntilDone(c, svcname)
+			}
+			return &ServiceResult{}, nil
+		},
+	}
+	r, _ := newTestRunner(t, stepsJob(2), backend)
+	hook := &recordingHook{}
+	r.AddPhaseHook(hook)
+
+	r.runLifecycle(ctx)
+
+	if hook.outcome(PhaseSteps) != PhaseCancelled {
+		t.Errorf("steps outcome was %s", hook.outcome(PhaseSteps))
+	}
+	if hook.outcome(PhaseUpload) != PhaseSucceeded {
+		t.Errorf("upload outcome was %s", hook.outcome(PhaseUpload))
+	}
+	if !reflect.DeepEqual(backend.services, []string{"step_0", "upload_outputs"}) {
+		t.Errorf("services were %v", backend.services)
+	}
+	if r.status == messaging.Success {
+		t.Error("the job succeeded after it was cancelled")
+	}
+}
+
+func TestRunLifecycleHookFailure(t *testing.T) {
+	backend := &testBackend{}
+	r, _ := newTestRunner(t, stepsJob(1), backend)
+	hook := &recordingHook{failFor: PhasePull}
+	r.AddPhaseHook(hook)
+
+	r.runLifecycle(context.Background())
+
+	if hook.outcome(PhasePull) != PhaseFailed {
+		t.Errorf("pull outcome was %s", hook.outcome(PhasePull))
+	}
+	if r.status != messaging.StatusDockerPullFailed {
+		t.Errorf("status was %d", r.status)
+	}
+	if !reflect.DeepEqual(backend.services, []string{"upload_outputs"}) {
+		t.Errorf("services were %v", backend.services)
+	}
+}
+
+func TestPublishTransitionNonFatal(t *testing.T) {
+	r, client := newTestRunner(t, stepsJob(1), &testBackend{})
+	r.publishTransition(&PhaseResult{
+		Phase:   PhaseInit,
+		Outcome: PhaseFailed,
+		Status:  messaging.Success,
+		Err:     errors.New("chmod workingvolume: operation not permitted"),
+	}, PhaseLogin)
+	r.publishTransition(&PhaseResult{
+		Phase:   PhasePull,
+		Outcome: PhaseFailed,
+		Status:  messaging.StatusDockerPullFailed,
+		Err:     errors.New("no such image"),
+	}, PhaseUpload)
+
+	if len(client.updates) != 2 {
+		t.Fatalf("%d updates were published", len(client.updates))
+	}
+	if msg := client.updates[0].Message; msg != "Phase init finished after 0s, moving on to login" {
+		t.Errorf("message for a non-fatal error was %q", msg)
+	}
+	if msg := client.updates[1].Message; !strings.Contains(msg, "Phase pull failed") || !strings.Contains(msg, "no such image") {
+		t.Errorf("message for a failure was %q", msg)
+	}
+}
@@ -1,7 +1,8 @@
 // road-runner
 //
 // Executes jobs based on a JSON blob serialized to a file.
-// Each step of the job runs inside a Docker container. Job results are
+// Each step of the job runs inside a container, either through the Docker or
+// Podman compose CLI, the Engine API, or Apptainer. Job results are
 // transferred back into iRODS with the porklock tool. Job status updates are
 // posted to the **jobs.updates** topic in the **jobs** exchange.
 package main
@@ -71,6 +72,59 @@ type CleanableJob struct {
 	LocalWorkingDir string `json:"local_working_directory"`
 }
 
+// findExecutables records the paths to the container tools needed by the
+// configured backend and runtime in the config. Missing tools are fatal unless
+// this is a dry run, in which case the bare executable names are used.
+func findExecutables(cfg *viper.Viper, dryRun bool) {
+	lookPath := func(name string) (string, error) {
+		p, err := exec.LookPath(name)
+		if err != nil && dryRun {
+			return name, nil
+		}
+		return p, err
+	}
+
+	if usesApptainer(cfg) {
+		apptainerBinPath, err := exec.LookPath("apptainer")
+		if err != nil {
+			log.Info("no apptainer executable found in path; looking for singularity")
+			if apptainerBinPath, err = lookPath("singularity"); err != nil {
+				log.Fatal("no apptainer or singularity executable found in path")
+			}
+		}
+
+		cfg.Set("apptainer.path", apptainerBinPath)
+	} else if usesPodman(cfg) {
+		podmanBinPath, err := lookPath("podman")
+		if err != nil {
+			log.Fatal("no podman executable found in path")
+		}
+
+		podmanComposeBinPath, err := exec.LookPath("podman-compose")
+		if err != nil {
+			log.Info("no podman-compose executable found in path; defaulting to `podman compose`")
+			podmanComposeBinPath = ""
+		}
+
+		cfg.Set("podman-compose.path", podmanComposeBinPath)
+		cfg.Set("podman.path", podmanBinPath)
+	} else {
+		dockerBinPath, err := lookPath("docker")
+		if err != nil {
+			log.Fatal("no docker executable found in path")
+		}
+
+		dockerComposeBinPath, err := exec.LookPath("docker-compose")
+		if err != nil {
+			log.Info("no docker-compose executable found in path; defaulting to `docker compose`")
+			dockerComposeBinPath = ""
+		}
+
+		cfg.Set("docker-compose.path", dockerComposeBinPath)
+		cfg.Set("docker.path", dockerBinPath)
+	}
+}
+
 func main() {
 	var (
 		showVersion = flag.Bool("version", false, "Print the version information")
@@ -81,6 +135,8 @@ func main() {
 		dockerCfg   = flag.String("docker-cfg", "/var/lib/condor/.docker", "The path to the .docker directory.")
 		logdriver   = flag.String("log-driver", "de-logging", "The name of the Docker log driver to use in job steps.")
 		pathprefix  = flag.String("path-prefix", "/var/lib/condor", "The path prefix for the stderr/stdout logs.")
+		dryRun      = flag.Bool("dry-run", false, "Print the docker-compose file and the commands that would be run, then exit.")
+		resume      = flag.Bool("resume", false, "Skip the parts of the job that finished before road-runner was restarted in the same directory.")
 		err         error
 		cfg         *viper.Viper
 	)
@@ -152,20 +208,34 @@ func main() {
 		os.Setenv("PATH", "/usr/bin:/usr/local/bin")
 	}
 
-	dockerBinPath, err := exec.LookPath("docker")
-	if err != nil {
-		log.Fatal("no docker executable found in path")
-	}
+	findExecutables(cfg, *dryRun)
 
-	dockerComposeBinPath, err := exec.LookPath("docker-compose")
-	if err != nil {
-		log.Info("no docker-compose executable found in path; defaulting to `docker compose`")
-		dockerComposeBinPath = ""
+	// Make sure the hooks, security profile, run_as settings, egress policy,
+	// redact patterns, upload quota settings and image trust policy in the
+	// config are valid before anything gets run.
+	if _, err = newServiceHooks(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if _, err = dcompose.ReadSecurityProfile(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if _, err = dcompose.ReadRunAs(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if _, err = dcompose.ReadEgress(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if err = (&Redactor{}).addConfigPatterns(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if err = validateQuotaConfig(cfg); err != nil {
+		log.Fatal(err)
+	}
+	if _, err = loadTrustPolicy(cfg); err != nil {
+		log.Fatal(err)
 	}
-
-	cfg.Set("docker-compose.path", dockerComposeBinPath)
-	cfg.Set("docker.path", dockerBinPath)
 	cfg.Set("docker.cfg", *dockerCfg)
+	cfg.Set("job.resume", *resume)
 
 	wd, err := os.Getwd()
 	if err != nil {
@@ -188,6 +258,21 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// Read the settings from the job definition that the job model doesn't
+	// know about.
+	opts, err := ParseJobOptions(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Print out what would be run and exit without contacting AMQP or Docker.
+	if *dryRun {
+		if err = printDryRun(os.Stdout, job, opts, cfg, wd, *composePath, *logdriver, *pathprefix); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	// Create a cleanable version of the job. Adds a bit more data to allow
 	// image-janitor and network-pruner to do their work.
 	cleanable := &CleanableJob{*job, wd}
@@ -237,7 +322,16 @@ func main() {
 
 	// Populates the data structure that will become the docker-compose file with
 	// information from the job definition.
-	composer.InitFromJob(job, cfg, wd)
+	if err = composer.InitFromJob(job, cfg, wd); err != nil {
+		log.Fatal(err)
+	}
+
+	// Give the job its own networks, limited by the egress policy.
+	egress, err := opts.EgressPolicy(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	composer.InitNetworks(job.InvocationID, egress)
 
 	// Write out the docker-compose file. This will get transferred back with the
 	// job outputs, which makes debugging stuff a lot easier.
@@ -257,6 +351,13 @@ func main() {
 	}
 	c.Close()
 
+	// Set up the backend that will run the containers defined in the
+	// docker-compose file.
+	backend, err := NewContainerBackend(cfg, composer, projectName(job), wd, *composePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// The channel that the exit code will be passed along on.
 	exit := make(chan messaging.StatusCode)
 
@@ -264,7 +365,7 @@ func main() {
 	finalExit := make(chan messaging.StatusCode)
 
 	// Launch the go routine that will handle job exits by signal or timer.
-	go Exit(cfg, exit, finalExit)
+	go Exit(exit, finalExit)
 
 	// Listen for stop requests. Make sure Listen() is called before the stop
 	// request message consumer is added, otherwise there's a race condition that
@@ -287,7 +388,7 @@ func main() {
 	)
 
 	// Actually execute all of the job steps.
-	go Run(ctx, client, job, cfg, exit)
+	go Run(ctx, client, job, opts, backend, cfg, *composePath, exit)
 
 	// Block waiting for the exit code, which will come from Run().
 	exitCode := <-finalExit
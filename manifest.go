@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"runtime"
+	"time"
+
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/cyverse-de/road-runner/fs"
+	"github.com/pkg/errors"
+)
+
+// manifestWorkers returns how many files are hashed at once while the output
+// manifest is generated. It's set by manifest.workers and defaults to the
+// number of CPUs.
+func (r *JobRunner) manifestWorkers() int {
+	if r.cfg != nil && r.cfg.GetInt("manifest.workers") > 0 {
+		return r.cfg.GetInt("manifest.workers")
+	}
+	return runtime.NumCPU()
+}
+
+// writeOutputManifest lists the files that are about to be uploaded, along
+// with their sizes, modification times and SHA-256 checksums, in
+// OutputManifest.json in the logs directory. The logs directory itself isn't
+// listed, since its files keep changing until the upload is done.
+func (r *JobRunner) writeOutputManifest() error {
+	excludesPath := path.Join(r.workingDir, dcompose.UploadExcludesFilename)
+	exclusions, err := fs.ReadExclusions(fs.FS, excludesPath)
+	if err != nil {
+		log.Error(err)
+	}
+	exclusions = append(exclusions, path.Base(r.logsDir))
+
+	files, err := fs.ManifestFiles(r.volumeDir, exclusions, r.manifestWorkers())
+	if err != nil {
+		return errors.Wrap(err, "failed to generate the output manifest")
+	}
+	manifest := &fs.OutputManifest{
+		InvocationID: r.job.InvocationID,
+		CreatedAt:    time.Now().UTC(),
+		Files:        files,
+	}
+	for _, f := range files {
+		manifest.TotalSize += f.Size
+	}
+	if err = fs.WriteOutputManifest(fs.FS, r.logsDir, manifest); err != nil {
+		return err
+	}
+	running(r.client, r.job, fmt.Sprintf("Listed %d output files (%s) in %s", len(files), formatBytes(manifest.TotalSize), fs.ManifestFilename))
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/cyverse-de/road-runner/fs"
+)
+
+func TestUploadPhaseWritesManifest(t *testing.T) {
+	r, _ := newTestRunner(t, stepsJob(1), &testBackend{})
+	r.logsDir = path.Join(r.volumeDir, "logs")
+	for name, content := range map[string]string{"output.txt": "hello\n", "input.txt": "input", "logs/stderr": "log"} {
+		p := path.Join(r.volumeDir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludes := path.Join(r.workingDir, dcompose.UploadExcludesFilename)
+	if err := fs.WriteExclusions(fs.FS, excludes, []string{"input.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, err := r.uploadPhase(context.Background()); status != messaging.Success || err != nil {
+		t.Fatalf("status was %d, error was %v", status, err)
+	}
+
+	b, err := os.ReadFile(path.Join(r.logsDir, fs.ManifestFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &fs.OutputManifest{}
+	if err = json.Unmarshal(b, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.InvocationID != r.job.InvocationID || manifest.TotalSize != 6 || len(manifest.Files) != 1 {
+		t.Fatalf("manifest was %+v", manifest)
+	}
+	if f := manifest.Files[0]; f.Path != "output.txt" || f.SHA256 != "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03" {
+		t.Errorf("file was %+v", f)
+	}
+}
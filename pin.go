@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/cyverse-de/road-runner/fs"
+	"github.com/pkg/errors"
+)
+
+// pinImageDigests switches the job's services over to the digests of the
+// images that were just pulled, so that the same images are used for the whole
+// job even if their tags are moved. The digests are recorded in
+// ImageDigests.json in the logs directory. Pinning can be turned off by setting
+// images.pin_digests to false.
+func (r *JobRunner) pinImageDigests(ctx context.Context) error {
+	if r.cfg != nil && r.cfg.IsSet("images.pin_digests") && !r.cfg.GetBool("images.pin_digests") {
+		return nil
+	}
+	pinner, ok := r.backend.(imagePinner)
+	if !ok {
+		return nil
+	}
+	pinned, err := pinner.PinImages(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to pin the job's images to their digests")
+	}
+	r.pinnedImages = pinned
+	if len(pinned) == 0 {
+		return nil
+	}
+
+	var digests []fs.ImageDigest
+	for image, p := range pinned {
+		running(r.client, r.job, fmt.Sprintf("Pinned image %s to %s", image, p.Digest))
+		digests = append(digests, fs.ImageDigest{Image: image, Digest: p.Digest, Reference: p.Reference})
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i].Image < digests[j].Image })
+	if err = fs.WriteImageDigests(fs.FS, r.logsDir, digests); err != nil {
+		log.Error(err)
+	}
+
+	// Replace the copy of the docker-compose file made by Init with the
+	// pinned one.
+	if err = fs.CopyFile(fs.FS, r.composePath, path.Join(r.logsDir, path.Base(r.composePath))); err != nil {
+		log.Error(err)
+	}
+	return nil
+}
+
+// unpinnedDigests returns the digests keyed by the images' original
+// references rather than the pinned ones.
+func (r *JobRunner) unpinnedDigests(digests map[string]string) map[string]string {
+	for image, p := range r.pinnedImages {
+		if digest, ok := digests[p.Reference]; ok {
+			delete(digests, p.Reference)
+			digests[image] = digest
+		}
+	}
+	return digests
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/road-runner/dcompose"
+)
+
+func TestPinImages(t *testing.T) {
+	jc, err := dcompose.New("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jc.Services["step_0"] = &dcompose.Service{Image: "discoenv/tool:1.0"}
+	jc.Services["step_1"] = &dcompose.Service{Image: "discoenv/tool:1.0"}
+	jc.Services["upload_outputs"] = &dcompose.Service{Image: "discoenv/porklock:latest"}
+	jc.Services["data_0_0"] = &dcompose.Service{Image: "local:latest"}
+	jc.Services["data_0_1"] = &dcompose.Service{Image: "mirror/tool:1.0"}
+	jc.Services["input_0"] = &dcompose.Service{Image: "discoenv/porklock@sha256:old"}
+
+	details := map[string]*imageDetails{
+		"discoenv/tool:1.0":        {ID: "sha256:1", RepoDigests: []string{"discoenv/tool@sha256:a"}},
+		"discoenv/porklock:latest": {ID: "sha256:2", RepoDigests: []string{"discoenv/porklock@sha256:b"}},
+		"local:latest":             {ID: "sha256:3"},
+		"mirror/tool:1.0":          {ID: "sha256:4", RepoDigests: []string{"discoenv/tool@sha256:c"}},
+	}
+	inspect := func(ctx context.Context, image string) (*imageDetails, error) {
+		return details[image], nil
+	}
+
+	composeFile := path.Join(t.TempDir(), "docker-compose.yml")
+	pinned, err := pinImages(context.Background(), jc, composeFile, inspect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]PinnedImage{
+		"discoenv/tool:1.0":        {Digest: "sha256:a", Reference: "discoenv/tool@sha256:a"},
+		"discoenv/porklock:latest": {Digest: "sha256:b", Reference: "discoenv/porklock@sha256:b"},
+	}
+	if !reflect.DeepEqual(pinned, expected) {
+		t.Errorf("pinned images were %+v", pinned)
+	}
+
+	images := map[string]string{
+		"step_0":         "discoenv/tool@sha256:a",
+		"step_1":         "discoenv/tool@sha256:a",
+		"upload_outputs": "discoenv/porklock@sha256:b",
+		"data_0_0":       "local:latest",
+		"data_0_1":       "mirror/tool:1.0",
+		"input_0":        "discoenv/porklock@sha256:old",
+	}
+	for svcname, image := range images {
+		if actual := jc.Services[svcname].Image; actual != image {
+			t.Errorf("image of %s was %s instead of %s", svcname, actual, image)
+		}
+	}
+
+	b, err := os.ReadFile(composeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "image: discoenv/tool@sha256:a") {
+		t.Errorf("compose file wasn't rewritten:\n%s", b)
+	}
+}
+
+// pinningBackend is a digestBackend that pins the images to fixed digests.
+type pinningBackend struct {
+	digestBackend
+	pinned map[string]PinnedImage
+}
+
+func (b *pinningBackend) PinImages(ctx context.Context) (map[string]PinnedImage, error) {
+	return b.pinned, nil
+}
+
+func TestPinImageDigests(t *testing.T) {
+	backend := &pinningBackend{
+		pinned: map[string]PinnedImage{
+			"tool-0:latest": {Digest: "sha256:a", Reference: "tool-0@sha256:a"},
+		},
+	}
+	backend.digests = map[string]string{"tool-0@sha256:a": "sha256:a"}
+	r, _ := newTestRunner(t, stepsJob(1), backend)
+	r.composePath = path.Join(t.TempDir(), "job-compose.yml")
+	if err := os.WriteFile(r.composePath, []byte("image: tool-0@sha256:a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.pinImageDigests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path.Join(r.logsDir, "ImageDigests.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"reference": "tool-0@sha256:a"`) {
+		t.Errorf("ImageDigests.json was %s", b)
+	}
+
+	// The pinned compose file is copied into the logs under its own name.
+	if b, err = os.ReadFile(path.Join(r.logsDir, "job-compose.yml")); err != nil || !strings.Contains(string(b), "tool-0@sha256:a") {
+		t.Errorf("the copied compose file was %q, error was %v", b, err)
+	}
+
+	// The checkpoint keeps using the references from the job.
+	r.recordImageDigests(context.Background())
+	if !reflect.DeepEqual(r.checkpoint.ImageDigests, map[string]string{"tool-0:latest": "sha256:a"}) {
+		t.Errorf("checkpoint digests were %v", r.checkpoint.ImageDigests)
+	}
+}
+
+func TestPinImageDigestsDisabled(t *testing.T) {
+	backend := &pinningBackend{
+		pinned: map[string]PinnedImage{
+			"tool-0:latest": {Digest: "sha256:a", Reference: "tool-0@sha256:a"},
+		},
+	}
+	r, _ := newTestRunner(t, stepsJob(1), backend)
+	r.cfg = hooksConfig(t, "images:\n  pin_digests: false\n")
+
+	if err := r.pinImageDigests(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if r.pinnedImages != nil {
+		t.Errorf("pinned images were %v", r.pinnedImages)
+	}
+	if _, err := os.Stat(path.Join(r.logsDir, "ImageDigests.json")); !os.IsNotExist(err) {
+		t.Errorf("ImageDigests.json was written: %v", err)
+	}
+}
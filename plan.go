@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/cyverse-de/model"
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// redactedPassword replaces registry passwords in the plan output.
+const redactedPassword = "********"
+
+// commandPlanner is implemented by ContainerBackends that can describe the
+// commands they would run without running them.
+type commandPlanner interface {
+	planLogin(registry, username, password string) [][]string
+	planPull() [][]string
+	planRunService(svcname string) ([][]string, error)
+	planDown() [][]string
+}
+
+// PlanStep is a single command in a job's execution plan.
+type PlanStep struct {
+	Phase   string
+	Service string
+	Command []string
+}
+
+// String returns the command in a form that can be pasted into a shell.
+func (p PlanStep) String() string {
+	var quoted []string
+	for _, arg := range p.Command {
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"$\\|&;<>(){}*?") {
+			arg = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// dataContainerServices returns the names of the data container services in
+// the order that they are created by createDataContainers.
+func dataContainerServices(job *model.Job) []string {
+	var svcnames []string
+	for stepIndex, step := range job.Steps {
+		for dcIndex := range step.Component.Container.VolumesFrom {
+			svcnames = append(svcnames, fmt.Sprintf("data_%d_%d", stepIndex, dcIndex))
+		}
+	}
+	return svcnames
+}
+
+// inputServices returns the names of the input download services in the order
+// that they are run by downloadInputs.
+func inputServices(job *model.Job) []string {
+	if job.InputPathListFile != "" {
+		return []string{"download_inputs"}
+	}
+	var svcnames []string
+	for index := range job.Inputs() {
+		svcnames = append(svcnames, fmt.Sprintf("input_%d", index))
+	}
+	return svcnames
+}
+
+// stepServices returns the names of the step services in the order that they
+// are run by runAllSteps.
+func stepServices(job *model.Job) []string {
+	var svcnames []string
+	for index := range job.Steps {
+		svcnames = append(svcnames, fmt.Sprintf("step_%d", index))
+	}
+	return svcnames
+}
+
+// sortedRegistries returns the registries in the credentials map in the order
+// they're logged into.
+func sortedRegistries(creds map[string]*authInfo) []string {
+	var registries []string
+	for registry := range creds {
+		registries = append(registries, registry)
+	}
+	sort.Strings(registries)
+	return registries
+}
+
+// BuildPlan returns the ordered list of commands that Run would execute for
+// the job with the backend, assuming every phase succeeds.
+func BuildPlan(job *model.Job, cfg *viper.Viper, backend ContainerBackend) ([]PlanStep, error) {
+	planner, ok := backend.(commandPlanner)
+	if !ok {
+		return nil, errors.New("the configured backend does not support dry runs")
+	}
+
+	runner, err := NewJobRunner(nil, job, backend, cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hooks, err := newServiceHooks(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var plan []PlanStep
+	add := func(phase, svcname string, cmds [][]string) {
+		for _, cmd := range cmds {
+			plan = append(plan, PlanStep{Phase: phase, Service: svcname, Command: cmd})
+		}
+	}
+	addServices := func(phase string, svcnames []string) error {
+		for _, svcname := range svcnames {
+			cmds, err := planner.planRunService(svcname)
+			if err != nil {
+				return err
+			}
+			add(phase, svcname, cmds)
+		}
+		return nil
+	}
+	addHooks := func(phase JobPhase, whens ...string) error {
+		for _, h := range hooks {
+			if h.phase != phase || !containsString(whens, h.config.When) {
+				continue
+			}
+			label := fmt.Sprintf("hook %s (%s %s)", h.config.Name, h.config.When, h.phase)
+			if err := addServices(label, []string{h.config.ServiceName()}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Each phase is surrounded by the hooks that would run for it when it
+	// succeeds.
+	phases := []struct {
+		phase JobPhase
+		plan  func() error
+	}{
+		{PhaseInit, func() error { return nil }},
+		{PhaseLogin, func() error {
+			creds, err := runner.getDockerCreds()
+			if err != nil {
+				return err
+			}
+			for _, registry := range sortedRegistries(creds) {
+				add("login", "", planner.planLogin(registry, creds[registry].Username, redactedPassword))
+			}
+			return nil
+		}},
+		{PhasePull, func() error {
+			add("pull", "", planner.planPull())
+			return nil
+		}},
+		{PhaseDataContainers, func() error { return addServices("data containers", dataContainerServices(job)) }},
+		{PhaseDownload, func() error { return addServices("download inputs", inputServices(job)) }},
+		{PhaseSteps, func() error { return addServices("steps", stepServices(job)) }},
+		{PhaseUpload, func() error { return addServices("upload outputs", []string{"upload_outputs"}) }},
+		{PhaseCleanup, func() error {
+			add("cleanup", "", planner.planDown())
+			return nil
+		}},
+	}
+
+	for _, p := range phases {
+		if err = addHooks(p.phase, HookBefore); err != nil {
+			return nil, err
+		}
+		if err = p.plan(); err != nil {
+			return nil, err
+		}
+		if err = addHooks(p.phase, HookAfter, HookSuccess); err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// WritePlan writes out the plan in a human readable format, one command per
+// line, grouped by phase.
+func WritePlan(w io.Writer, plan []PlanStep) error {
+	var phase string
+	for _, step := range plan {
+		if step.Phase != phase {
+			phase = step.Phase
+			if _, err := fmt.Fprintf(w, "# %s\n", phase); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w, step.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printDryRun renders the docker-compose file for the job and writes it out,
+// followed by the plan for running it. Nothing is written to disk and no
+// containers are run.
+func printDryRun(w io.Writer, job *model.Job, opts *JobOptions, cfg *viper.Viper, wd, composePath, logdriver, pathprefix string) error {
+	composer, err := dcompose.New(logdriver, pathprefix)
+	if err != nil {
+		return err
+	}
+	if err = composer.InitFromJob(job, cfg, wd); err != nil {
+		return err
+	}
+	egress, err := opts.EgressPolicy(cfg)
+	if err != nil {
+		return err
+	}
+	composer.InitNetworks(job.InvocationID, egress)
+
+	m, err := yaml.Marshal(composer)
+	if err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintf(w, "# %s\n%s\n", composePath, m); err != nil {
+		return err
+	}
+
+	backend, err := NewContainerBackend(cfg, composer, projectName(job), wd, composePath)
+	if err != nil {
+		return err
+	}
+	plan, err := BuildPlan(job, cfg, backend)
+	if err != nil {
+		return err
+	}
+	return WritePlan(w, plan)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestBuildPlan(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("docker.path", "docker")
+
+	backend := newComposeBackend(cfg, nil, "testproject", "/work", "docker-compose.yml")
+	plan, err := BuildPlan(testJob, cfg, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"docker login --username user1 --password '********' docker.example.com",
+		"docker login --username user2 --password '********' docker.example.org",
+		"docker compose -p testproject -f docker-compose.yml pull --parallel",
+		"docker compose -p testproject -f docker-compose.yml up --abort-on-container-exit --exit-code-from data_0_0 --no-color data_0_0",
+		"docker compose -p testproject -f docker-compose.yml up --abort-on-container-exit --exit-code-from data_0_1 --no-color data_0_1",
+		"docker compose -p testproject -f docker-compose.yml up --abort-on-container-exit --exit-code-from data_0_2 --no-color data_0_2",
+		"docker compose -p testproject -f docker-compose.yml up --abort-on-container-exit --exit-code-from step_0 --no-color step_0",
+		"docker compose -p testproject -f docker-compose.yml up --abort-on-container-exit --exit-code-from upload_outputs --no-color upload_outputs",
+		"docker compose -p testproject -f docker-compose.yml down -v",
+	}
+	if len(plan) != len(expected) {
+		t.Fatalf("plan had %d commands instead of %d: %v", len(plan), len(expected), plan)
+	}
+	for i, step := range plan {
+		if step.String() != expected[i] {
+			t.Errorf("command %d was %q instead of %q", i, step.String(), expected[i])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = WritePlan(&buf, plan); err != nil {
+		t.Fatal(err)
+	}
+	for _, phase := range []string{"# login", "# pull", "# data containers", "# steps", "# upload outputs", "# cleanup"} {
+		if !strings.Contains(buf.String(), phase+"\n") {
+			t.Errorf("plan output was missing %q", phase)
+		}
+	}
+	if strings.Contains(buf.String(), "passwd") {
+		t.Error("plan output contained a registry password")
+	}
+}
+
+func TestBuildPlanHooks(t *testing.T) {
+	cfg := hooksConfig(t, `
+hooks:
+  - {name: license, image: x, phase: steps, when: before}
+  - {name: diag, image: x, phase: steps, when: failure}
+  - {name: scrub, image: x, phase: upload, when: before}
+`)
+	cfg.Set("docker.path", "docker")
+
+	backend := newComposeBackend(cfg, nil, "testproject", "/work", "docker-compose.yml")
+	plan, err := BuildPlan(testJob, cfg, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var services []string
+	for _, step := range plan {
+		if step.Service != "" && !strings.HasPrefix(step.Service, "data_") {
+			services = append(services, step.Service)
+		}
+	}
+	expected := []string{"hook_license", "step_0", "hook_scrub", "upload_outputs"}
+	if strings.Join(services, ",") != strings.Join(expected, ",") {
+		t.Errorf("services were %v instead of %v", services, expected)
+	}
+}
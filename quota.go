@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/cyverse-de/road-runner/fs"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// The values accepted for upload.quota_action.
+const (
+	// QuotaActionFail fails the job without uploading anything when its
+	// outputs are over quota. It's the default.
+	QuotaActionFail = "fail"
+
+	// QuotaActionLogs uploads only the logs directory when the job's outputs
+	// are over quota, then fails the job.
+	QuotaActionLogs = "logs"
+)
+
+// validateQuotaConfig checks upload.quota_action and the sizes under
+// upload.user_quotas.
+func validateQuotaConfig(cfg *viper.Viper) error {
+	switch action := cfg.GetString("upload.quota_action"); action {
+	case "", QuotaActionFail, QuotaActionLogs:
+	default:
+		return fmt.Errorf("invalid upload.quota_action %q, must be %q or %q", action, QuotaActionFail, QuotaActionLogs)
+	}
+	for user, q := range cfg.GetStringMapString("upload.user_quotas") {
+		if _, err := parseSize(q); err != nil {
+			return errors.Wrapf(err, "invalid upload quota for %s", user)
+		}
+	}
+	return nil
+}
+
+// uploadQuota returns the most that the job is allowed to upload. A quota for
+// the job's submitter under upload.user_quotas takes precedence over the
+// site-wide upload.max_size. Zero means there's no quota.
+func (r *JobRunner) uploadQuota() int64 {
+	if r.cfg == nil {
+		return 0
+	}
+	// viper lowercases map keys.
+	quotas := r.cfg.GetStringMapString("upload.user_quotas")
+	if q, ok := quotas[strings.ToLower(r.job.Submitter)]; ok {
+		size, err := parseSize(q)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "invalid upload quota for %s", r.job.Submitter))
+		} else {
+			return size
+		}
+	}
+	if r.cfg.IsSet("upload.max_size") {
+		return int64(r.cfg.GetSizeInBytes("upload.max_size"))
+	}
+	return 0
+}
+
+// sizeUnits are the unit letters accepted by parseSize. As with
+// viper.GetSizeInBytes, they can be followed by a "b", so "500g" and "500GB"
+// are the same size.
+var sizeUnits = map[byte]int64{
+	'k': 1 << 10,
+	'm': 1 << 20,
+	'g': 1 << 30,
+	't': 1 << 40,
+}
+
+// parseSize converts a size from a map in the config, such as "500GB" or a
+// number of bytes. viper.GetSizeInBytes can only be used on whole keys.
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(size)), "b")
+	multiplier := int64(1)
+	if len(s) > 0 {
+		if m, ok := sizeUnits[s[len(s)-1]]; ok {
+			multiplier = m
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// QuotaError is returned when the job's outputs are larger than its upload
+// quota.
+type QuotaError struct {
+	Size      int64
+	Quota     int64
+	Submitter string
+	LogsOnly  bool
+}
+
+func (e *QuotaError) Error() string {
+	msg := fmt.Sprintf(
+		"The job's outputs are %s, which is more than the upload quota of %s for %s",
+		formatBytes(e.Size), formatBytes(e.Quota), e.Submitter,
+	)
+	if e.LogsOnly {
+		return msg + ", so only the logs were uploaded"
+	}
+	return msg + ", so nothing was uploaded"
+}
+
+// checkUploadQuota adds up the size of the outputs that will be uploaded and
+// compares it to the job's quota. When upload.quota_action is "logs", the
+// exclusions file is rewritten so that only the logs are uploaded and a
+// QuotaError is returned alongside a nil error to let the upload go ahead.
+// Otherwise the QuotaError is returned as the error.
+func (r *JobRunner) checkUploadQuota() (*QuotaError, error) {
+	quota := r.uploadQuota()
+	if quota <= 0 {
+		return nil, nil
+	}
+
+	excludesPath := path.Join(r.workingDir, dcompose.UploadExcludesFilename)
+	exclusions, err := fs.ReadExclusions(fs.FS, excludesPath)
+	if err != nil {
+		log.Error(err)
+	}
+	size, err := fs.UploadSize(r.volumeDir, exclusions)
+	if err != nil {
+		return nil, err
+	}
+	running(r.client, r.job, fmt.Sprintf("The job's outputs are %s, its upload quota is %s", formatBytes(size), formatBytes(quota)))
+	if size <= quota {
+		return nil, nil
+	}
+
+	qErr := &QuotaError{Size: size, Quota: quota, Submitter: r.job.Submitter}
+	if r.cfg.GetString("upload.quota_action") != QuotaActionLogs {
+		return nil, qErr
+	}
+
+	if err = r.excludeAllButLogs(excludesPath); err != nil {
+		return nil, errors.Wrap(err, "failed to limit the upload to the logs")
+	}
+	qErr.LogsOnly = true
+	return qErr, nil
+}
+
+// excludeAllButLogs rewrites the exclusions file so that everything in the
+// working volume other than the logs directory is excluded.
+func (r *JobRunner) excludeAllButLogs(excludesPath string) error {
+	entries, err := os.ReadDir(r.volumeDir)
+	if err != nil {
+		return errors.Wrapf(err, "failed to list %s", r.volumeDir)
+	}
+	logs := path.Base(r.logsDir)
+	var exclusions []string
+	for _, e := range entries {
+		if e.Name() != logs {
+			exclusions = append(exclusions, e.Name())
+		}
+	}
+	if err = fs.WriteExclusions(fs.FS, excludesPath, exclusions); err != nil {
+		return err
+	}
+
+	// Keep the copy in the logs directory up to date for debugging.
+	return fs.WriteExclusions(fs.FS, path.Join(r.logsDir, dcompose.UploadExcludesFilename), exclusions)
+}
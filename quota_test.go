@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/cyverse-de/road-runner/fs"
+	"github.com/spf13/viper"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"1024":   1024,
+		"10b":    10,
+		"2KB":    2048,
+		"1.5 mb": 1536 * 1024,
+		"3GB":    3 << 30,
+		"1tb":    1 << 40,
+		"500g":   500 << 30,
+		"10M":    10 << 20,
+	}
+	for s, expected := range tests {
+		actual, err := parseSize(s)
+		if err != nil {
+			t.Errorf("parseSize(%q) returned %v", s, err)
+		}
+		if actual != expected {
+			t.Errorf("parseSize(%q) was %d instead of %d", s, actual, expected)
+		}
+	}
+	if _, err := parseSize("5 XB"); err == nil || !strings.Contains(err.Error(), `"5 XB"`) {
+		t.Errorf("error for an invalid size was %v", err)
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	job := stepsJob(1)
+	job.Submitter = "Alice"
+	r, _ := newTestRunner(t, job, &testBackend{})
+	if q := r.uploadQuota(); q != 0 {
+		t.Errorf("quota was %d without a config", q)
+	}
+
+	r.cfg = hooksConfig(t, "upload:\n  max_size: 1GB\n  user_quotas:\n    alice: 5GB\n    bob: 1KB\n")
+	if q := r.uploadQuota(); q != 5<<30 {
+		t.Errorf("quota was %d", q)
+	}
+	job.Submitter = "carol"
+	if q := r.uploadQuota(); q != 1<<30 {
+		t.Errorf("quota was %d", q)
+	}
+}
+
+// quotaRunner returns a runner for a job with 100 bytes of outputs and a
+// quota of 50 bytes.
+func quotaRunner(t *testing.T, action string) (*JobRunner, *testBackend) {
+	backend := &testBackend{}
+	r, _ := newTestRunner(t, stepsJob(1), backend)
+	r.logsDir = path.Join(r.volumeDir, "logs")
+	r.cfg = viper.New()
+	r.cfg.Set("upload.max_size", 50)
+	r.cfg.Set("upload.quota_action", action)
+
+	for name, size := range map[string]int{"output.dat": 100, "input.dat": 1000, "logs/stderr": 10} {
+		p := path.Join(r.volumeDir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	excludes := path.Join(r.workingDir, dcompose.UploadExcludesFilename)
+	if err := fs.WriteExclusions(fs.FS, excludes, []string{"input.dat", "logs"}); err != nil {
+		t.Fatal(err)
+	}
+	return r, backend
+}
+
+func TestUploadPhaseOverQuota(t *testing.T) {
+	r, backend := quotaRunner(t, QuotaActionFail)
+
+	status, err := r.uploadPhase(context.Background())
+	if status != messaging.StatusOutputFailed || err == nil {
+		t.Errorf("status was %d, error was %v", status, err)
+	}
+	if len(backend.services) != 0 {
+		t.Errorf("services were %v", backend.services)
+	}
+	expected := "The job's outputs are 100 B, which is more than the upload quota of 50 B for , so nothing was uploaded"
+	if r.failureMessage != expected {
+		t.Errorf("failure message was %q", r.failureMessage)
+	}
+}
+
+func TestUploadPhaseOverQuotaLogsOnly(t *testing.T) {
+	r, backend := quotaRunner(t, QuotaActionLogs)
+
+	status, err := r.uploadPhase(context.Background())
+	if status != messaging.StatusOutputFailed || err == nil {
+		t.Errorf("status was %d, error was %v", status, err)
+	}
+	if !reflect.DeepEqual(backend.services, []string{"upload_outputs"}) {
+		t.Errorf("services were %v", backend.services)
+	}
+	if !strings.HasSuffix(r.failureMessage, "so only the logs were uploaded") {
+		t.Errorf("failure message was %q", r.failureMessage)
+	}
+
+	exclusions, err := fs.ReadExclusions(fs.FS, path.Join(r.workingDir, dcompose.UploadExcludesFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exclusions, []string{"input.dat", "output.dat"}) {
+		t.Errorf("exclusions were %v", exclusions)
+	}
+}
+
+func TestUploadPhaseUnderQuota(t *testing.T) {
+	r, backend := quotaRunner(t, QuotaActionFail)
+	r.cfg.Set("upload.max_size", 100)
+
+	if status, err := r.uploadPhase(context.Background()); status != messaging.Success || err != nil {
+		t.Errorf("status was %d, error was %v", status, err)
+	}
+	if !reflect.DeepEqual(backend.services, []string{"upload_outputs"}) {
+		t.Errorf("services were %v", backend.services)
+	}
+}
+
+func TestValidateQuotaConfig(t *testing.T) {
+	cfg := viper.New()
+	if err := validateQuotaConfig(cfg); err != nil {
+		t.Error(err)
+	}
+	cfg.Set("upload.quota_action", "delete")
+	if err := validateQuotaConfig(cfg); err == nil {
+		t.Error("no error was returned for an invalid action")
+	}
+	cfg.Set("upload.quota_action", QuotaActionLogs)
+	cfg.Set("upload.user_quotas", map[string]string{"alice": "lots"})
+	if err := validateQuotaConfig(cfg); err == nil {
+		t.Error("no error was returned for an invalid quota")
+	}
+}
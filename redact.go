@@ -0,0 +1,107 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// redacted replaces the secrets removed from log output.
+const redacted = "[REDACTED]"
+
+// secretPatterns match secrets that commonly show up in tool output. The
+// first group of each pattern is kept and the rest of the match is replaced.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)((?:password|passwd|pwd|secret|token|api[_-]?key|access[_-]?key|private[_-]?key)["']?\s*[:=]\s*["']?)[^\s"',;]+`),
+	regexp.MustCompile(`(?i)(authorization:\s*(?:bearer|basic|token)\s+)\S+`),
+	regexp.MustCompile(`(?i)(\b(?:bearer)\s+)[a-z0-9._~+/=-]{16,}`),
+	regexp.MustCompile(`([a-z][a-z0-9+.-]*://[^\s:/@]+:)[^\s@/]+(@)`),
+	regexp.MustCompile(`()\bAKIA[0-9A-Z]{16}\b`),
+}
+
+// secretEnvPattern matches the names of environment variables whose values
+// are treated as secrets.
+var secretEnvPattern = regexp.MustCompile(`(?i)pass|secret|token|key|credential|auth`)
+
+// Redactor removes secrets from text before it's published in a status
+// update.
+type Redactor struct {
+	literals []string
+	patterns []*regexp.Regexp
+}
+
+// newRedactor returns a Redactor for the job. The registry passwords and the
+// values of the step environment variables that look like secrets are redacted
+// wherever they appear, along with anything matching the built-in patterns or
+// the patterns listed under redact.patterns in the config.
+func (r *JobRunner) newRedactor() (*Redactor, error) {
+	red := &Redactor{patterns: secretPatterns}
+
+	if creds, err := r.getDockerCreds(); err == nil {
+		for _, cred := range creds {
+			red.literals = append(red.literals, cred.Password)
+		}
+	}
+	for _, step := range r.job.Steps {
+		for name, value := range step.Environment {
+			if secretEnvPattern.MatchString(name) {
+				red.literals = append(red.literals, value)
+			}
+		}
+	}
+
+	if err := red.addConfigPatterns(r.cfg); err != nil {
+		return nil, err
+	}
+
+	// Longer secrets go first so that secrets containing other secrets are
+	// removed completely.
+	sort.Slice(red.literals, func(i, j int) bool {
+		return len(red.literals[i]) > len(red.literals[j])
+	})
+	return red, nil
+}
+
+// addConfigPatterns adds the patterns from the config. The whole match of each
+// pattern is redacted.
+func (red *Redactor) addConfigPatterns(cfg *viper.Viper) error {
+	if cfg == nil {
+		return nil
+	}
+	for _, p := range cfg.GetStringSlice("redact.patterns") {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return errors.Wrapf(err, "invalid redact pattern %q", p)
+		}
+		red.patterns = append(red.patterns, re)
+	}
+	return nil
+}
+
+// Redact returns the text with the secrets replaced.
+func (red *Redactor) Redact(text string) string {
+	for _, lit := range red.literals {
+		// Short values would remove too much of the output.
+		if len(lit) >= 4 {
+			text = strings.ReplaceAll(text, lit, redacted)
+		}
+	}
+	for _, re := range red.patterns {
+		if re.NumSubexp() == 0 {
+			text = re.ReplaceAllString(text, redacted)
+			continue
+		}
+		text = re.ReplaceAllStringFunc(text, func(m string) string {
+			groups := re.FindStringSubmatch(m)
+			replaced := groups[1] + redacted
+			if len(groups) > 2 {
+				replaced += groups[2]
+			}
+			return replaced
+		})
+	}
+	return text
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/cyverse-de/road-runner/fs"
+	"github.com/spf13/viper"
+)
+
+// Names of the phases that can be retried. They're also the config keys for
+// each phase's retry policy, for example retry.download.max_attempts.
+const (
+	PullPhase     = "pull"
+	DownloadPhase = "download"
+	UploadPhase   = "upload"
+)
+
+// RetryPolicy controls how many times a phase is attempted and how long to
+// wait between attempts.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It doubles with each
+	// subsequent retry, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// Jitter is the fraction of the delay that's randomly added or removed,
+	// between 0 and 1.
+	Jitter float64
+}
+
+// NewRetryPolicy returns the retry policy for the phase from the config. By
+// default each phase is only attempted once.
+func NewRetryPolicy(cfg *viper.Viper, phase string) RetryPolicy {
+	p := RetryPolicy{
+		MaxAttempts: 1,
+		Backoff:     5 * time.Second,
+		MaxBackoff:  5 * time.Minute,
+		Jitter:      0.2,
+	}
+	if cfg == nil {
+		return p
+	}
+
+	prefix := fmt.Sprintf("retry.%s.", phase)
+	if v := cfg.GetInt(prefix + "max_attempts"); v > 0 {
+		p.MaxAttempts = v
+	}
+	if v := cfg.GetDuration(prefix + "backoff"); v > 0 {
+		p.Backoff = v
+	}
+	if v := cfg.GetDuration(prefix + "max_backoff"); v > 0 {
+		p.MaxBackoff = v
+	}
+	if cfg.IsSet(prefix + "jitter") {
+		p.Jitter = math.Min(math.Max(cfg.GetFloat64(prefix+"jitter"), 0), 1)
+	}
+	return p
+}
+
+// Delay returns how long to wait after the numbered attempt fails. The
+// random number generator must return values in [0, 1).
+func (p RetryPolicy) Delay(attempt int, random func() float64) time.Duration {
+	delay := float64(p.Backoff) * math.Pow(2, float64(attempt-1))
+	if delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	delay += delay * p.Jitter * (2*random() - 1)
+	return time.Duration(delay)
+}
+
+// recordAttempt adds an attempt to the runner's history and writes the history
+// out to the logs directory.
+func (r *JobRunner) recordAttempt(a fs.Attempt) {
+	r.attemptsMutex.Lock()
+	defer r.attemptsMutex.Unlock()
+	r.attempts = append(r.attempts, a)
+	if err := fs.WriteRetryHistory(fs.FS, r.logsDir, r.attempts); err != nil {
+		log.Error(err)
+	}
+}
+
+// withRetries calls fn until it succeeds, the phase's retry policy runs out of
+// attempts, or the context is done. A running update is published before each
+// retry. The error from the last attempt is returned.
+func (r *JobRunner) withRetries(ctx context.Context, phase, target string, fn func(attempt int) error) error {
+	policy := NewRetryPolicy(r.cfg, phase)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		started := time.Now()
+		err = fn(attempt)
+
+		a := fs.Attempt{
+			Phase:    phase,
+			Target:   target,
+			Number:   attempt,
+			Started:  started,
+			Duration: time.Since(started),
+		}
+		if err != nil {
+			a.Error = err.Error()
+		}
+		r.recordAttempt(a)
+
+		// Don't retry if the job was stopped or ran out of time.
+		if err == nil || ctx.Err() != nil || attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		delay := policy.Delay(attempt, rand.Float64)
+		running(r.client, r.job, fmt.Sprintf(
+			"Attempt %d of %d to %s %s failed, retrying in %s: %s",
+			attempt,
+			policy.MaxAttempts,
+			phase,
+			target,
+			delay.Round(time.Second),
+			err.Error(),
+		))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/spf13/viper"
+)
+
+func TestNewRetryPolicy(t *testing.T) {
+	p := NewRetryPolicy(nil, DownloadPhase)
+	if p.MaxAttempts != 1 {
+		t.Errorf("default max attempts was %d instead of 1", p.MaxAttempts)
+	}
+
+	cfg := viper.New()
+	cfg.Set("retry.download.max_attempts", 4)
+	cfg.Set("retry.download.backoff", "2s")
+	cfg.Set("retry.download.max_backoff", "10s")
+	cfg.Set("retry.download.jitter", 2.0)
+
+	p = NewRetryPolicy(cfg, DownloadPhase)
+	if p.MaxAttempts != 4 {
+		t.Errorf("max attempts was %d instead of 4", p.MaxAttempts)
+	}
+	if p.Backoff != 2*time.Second {
+		t.Errorf("backoff was %s instead of 2s", p.Backoff)
+	}
+	if p.MaxBackoff != 10*time.Second {
+		t.Errorf("max backoff was %s instead of 10s", p.MaxBackoff)
+	}
+	if p.Jitter != 1 {
+		t.Errorf("jitter was %f instead of being capped at 1", p.Jitter)
+	}
+
+	if p = NewRetryPolicy(cfg, UploadPhase); p.MaxAttempts != 1 {
+		t.Errorf("upload max attempts was %d instead of 1", p.MaxAttempts)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	middle := func() float64 { return 0.5 }
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, e := range expected {
+		if d := p.Delay(i+1, middle); d != e {
+			t.Errorf("delay after attempt %d was %s instead of %s", i+1, d, e)
+		}
+	}
+
+	p.Jitter = 0.5
+	if d := p.Delay(1, func() float64 { return 0 }); d != 500*time.Millisecond {
+		t.Errorf("minimum jittered delay was %s instead of 500ms", d)
+	}
+	if d := p.Delay(1, func() float64 { return 1 }); d != 1500*time.Millisecond {
+		t.Errorf("maximum jittered delay was %s instead of 1.5s", d)
+	}
+}
+
+func TestDownloadInputStepRetries(t *testing.T) {
+	failures := 2
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			if failures > 0 {
+				failures--
+				return &ServiceResult{ExitCode: 1}, errors.New("exit status 1")
+			}
+			return &ServiceResult{}, nil
+		},
+	}
+	r, client := newTestRunner(t, stepsJob(1), backend)
+	r.cfg = viper.New()
+	r.cfg.Set("retry.download.max_attempts", 3)
+	r.cfg.Set("retry.download.backoff", "1ms")
+
+	status, err := r.downloadInputStep(context.Background(), "input_0", "/iplant/home/test/in.txt", "in.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != messaging.Success {
+		t.Errorf("status was %d instead of %d", status, messaging.Success)
+	}
+	if len(backend.services) != 3 {
+		t.Errorf("the service was run %d times instead of 3", len(backend.services))
+	}
+
+	var retries int
+	for _, u := range client.updates {
+		if strings.HasPrefix(u.Message, "Attempt ") {
+			retries++
+		}
+	}
+	if retries != 2 {
+		t.Errorf("%d retry updates were published instead of 2", retries)
+	}
+
+	history, err := os.ReadFile(path.Join(r.logsDir, "RetryHistory.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(history), "\n"); lines != 4 {
+		t.Errorf("the retry history had %d lines instead of 4:\n%s", lines, history)
+	}
+}
+
+func TestDownloadInputStepRetriesExhausted(t *testing.T) {
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			return &ServiceResult{ExitCode: 3}, errors.New("exit status 3")
+		},
+	}
+	r, _ := newTestRunner(t, stepsJob(1), backend)
+	r.cfg = viper.New()
+	r.cfg.Set("retry.download.max_attempts", 2)
+	r.cfg.Set("retry.download.backoff", "1ms")
+
+	status, err := r.downloadInputStep(context.Background(), "input_0", "/iplant/home/test/in.txt", "in.txt")
+	if err == nil {
+		t.Fatal("err was nil")
+	}
+	if status != messaging.StatusInputFailed {
+		t.Errorf("status was %d instead of %d", status, messaging.StatusInputFailed)
+	}
+	if !strings.Contains(err.Error(), "exit code of 3") {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(backend.services) != 2 {
+		t.Errorf("the service was run %d times instead of 2", len(backend.services))
+	}
+}
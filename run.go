@@ -8,6 +8,8 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cyverse-de/messaging"
 	"github.com/cyverse-de/model"
@@ -38,6 +40,7 @@ var logWriter = &logrusProxyWriter{
 // JobRunner provides the functionality needed to run jobs.
 type JobRunner struct {
 	client      JobUpdatePublisher
+	backend     ContainerBackend
 	exit        chan messaging.StatusCode
 	job         *model.Job
 	status      messaging.StatusCode
@@ -47,28 +50,103 @@ type JobRunner struct {
 	workingDir  string
 	projectName string
 	tmpDir      string
+
+	// maxRuntime is the maximum amount of time the job is allowed to run for
+	// before it's stopped. Zero means there's no limit.
+	maxRuntime time.Duration
+
+	// failureMessage replaces the generic message sent in the final failure
+	// update when it's set.
+	failureMessage string
+
+	// failureDetail is added to the end of the final failure update, for
+	// example the end of a failed step's stderr.
+	failureDetail string
+
+	// stepNotes describe the steps that failed without failing the job or that
+	// were skipped. They're added to the final status message.
+	stepNotes []string
+
+	// opts contains the settings from the job definition that aren't part of
+	// model.Job.
+	opts *JobOptions
+
+	// attempts is the history of the attempts at the phases that can be
+	// retried.
+	attempts      []fs.Attempt
+	attemptsMutex sync.Mutex
+
+	// stepResults records how each step's container exited.
+	stepResults      []fs.StepResult
+	stepResultsMutex sync.Mutex
+
+	// usage is the resource usage of the steps that have finished.
+	usage      []fs.ResourceUsage
+	usageMutex sync.Mutex
+
+	// pinnedImages are the images that the job's services were switched over
+	// to after they were pulled, keyed by their original references.
+	pinnedImages map[string]PinnedImage
+
+	// checkpoint records the progress of the job so that it can be resumed.
+	// resumeFrom is the checkpoint left behind by an earlier run of the job,
+	// which is only set when the job is being resumed.
+	checkpoint      *fs.Checkpoint
+	resumeFrom      *fs.Checkpoint
+	checkpointMutex sync.Mutex
+
+	// hooks are called before and after each phase of the job.
+	hooks []PhaseHook
+
+	// composePath is where the docker-compose file for the job was written.
+	composePath string
 }
 
 // NewJobRunner creates a new JobRunner
-func NewJobRunner(client JobUpdatePublisher, job *model.Job, cfg *viper.Viper, exit chan messaging.StatusCode) (*JobRunner, error) {
+func NewJobRunner(client JobUpdatePublisher, job *model.Job, backend ContainerBackend, cfg *viper.Viper, exit chan messaging.StatusCode) (*JobRunner, error) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		return nil, err
 	}
 	runner := &JobRunner{
-		client:     client,
-		exit:       exit,
-		job:        job,
-		cfg:        cfg,
-		status:     messaging.Success,
-		workingDir: cwd,
-		volumeDir:  path.Join(cwd, dcompose.VOLUMEDIR),
-		logsDir:    path.Join(cwd, dcompose.VOLUMEDIR, "logs"),
-		tmpDir:     path.Join(cwd, dcompose.TMPDIR),
+		client:      client,
+		backend:     backend,
+		exit:        exit,
+		job:         job,
+		cfg:         cfg,
+		status:      messaging.Success,
+		workingDir:  cwd,
+		volumeDir:   path.Join(cwd, dcompose.VOLUMEDIR),
+		logsDir:     path.Join(cwd, dcompose.VOLUMEDIR, "logs"),
+		tmpDir:      path.Join(cwd, dcompose.TMPDIR),
+		checkpoint:  &fs.Checkpoint{InvocationID: job.InvocationID},
+		composePath: "docker-compose.yml",
+	}
+	if cfg != nil {
+		runner.maxRuntime = cfg.GetDuration("job.max_runtime")
 	}
 	return runner, nil
 }
 
+// defaultMaxLogFileSize is the default size limit for the log files that
+// road-runner writes.
+const defaultMaxLogFileSize = 20 * 1024 * 1024
+
+// maxLogFileSize returns the size limit for log files from logs.max_file_size.
+// Zero means there's no limit.
+func maxLogFileSize(cfg *viper.Viper) int64 {
+	if cfg == nil || !cfg.IsSet("logs.max_file_size") {
+		return defaultMaxLogFileSize
+	}
+	return int64(cfg.GetSizeInBytes("logs.max_file_size"))
+}
+
+// createLogFile creates a log file in the logs directory, which is capped at
+// the size set by logs.max_file_size.
+func (r *JobRunner) createLogFile(name string) (*fs.LogFile, error) {
+	return fs.CreateLogFile(path.Join(r.logsDir, name), maxLogFileSize(r.cfg))
+}
+
 // Init will initialize the state for a JobRunner. The volumeDir and logsDir
 // will get created.
 func (r *JobRunner) Init() error {
@@ -82,22 +160,13 @@ func (r *JobRunner) Init() error {
 		return err
 	}
 
-	// Set world-write perms on volumeDir, so non-root users can create job outputs.
-	err = os.Chmod(r.volumeDir, 0777)
-	if err != nil {
-		// Log error and continue.
-		log.Error(err)
-	}
-
-	// Set world-write perms on tmpDir, so non-root users can create temp outputs.
-	err = os.Chmod(r.tmpDir, 0777)
-	if err != nil {
+	if err = r.setVolumeOwnership(); err != nil {
 		// Log error and continue.
 		log.Error(err)
 	}
 
 	// Copy docker-compose file to the log dir for debugging purposes.
-	err = fs.CopyFile(fs.FS, "docker-compose.yml", path.Join(r.logsDir, "docker-compose.yml"))
+	err = fs.CopyFile(fs.FS, r.composePath, path.Join(r.logsDir, path.Base(r.composePath)))
 	if err != nil {
 		// Log error and continue.
 		log.Error(err)
@@ -138,6 +207,35 @@ func (r *JobRunner) Init() error {
 	return nil
 }
 
+// setVolumeOwnership lets the containers write to volumeDir and tmpDir. When
+// the job runs as a particular user, the directories are given to that user
+// and its group, and the setgid bit keeps new files in the group for the
+// containers that only share the group. Otherwise, or if road-runner isn't
+// allowed to give them away, they're made world-writable so that non-root
+// users can create job outputs.
+func (r *JobRunner) setVolumeOwnership() error {
+	runAs, err := dcompose.ReadRunAs(r.cfg)
+	if err != nil {
+		return err
+	}
+	for _, dir := range []string{r.volumeDir, r.tmpDir} {
+		if runAs != nil {
+			uid, gid := runAs.HostIDs()
+			if err = os.Chown(dir, uid, gid); err == nil {
+				if err = os.Chmod(dir, 0770|os.ModeSetgid); err != nil {
+					return err
+				}
+				continue
+			}
+			log.Warnf("failed to give %s to %d:%d, making it world-writable instead: %s", dir, uid, gid, err)
+		}
+		if err = os.Chmod(dir, 0777); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetDockerCreds will obtain a list of Docker credentials for the current job. This function assumes that there will be
 // at most one set of credentials for each Docker registry. The result is a map from docker registry to credentials.
 func (r *JobRunner) getDockerCreds() (map[string]*authInfo, error) {
@@ -173,7 +271,7 @@ func (r *JobRunner) getDockerCreds() (map[string]*authInfo, error) {
 	return result, nil
 }
 
-// DockerLogin will run "docker login" with credentials sent with the job.
+// DockerLogin will log into the registries with credentials sent with the job.
 func (r *JobRunner) DockerLogin(ctx context.Context) error {
 	var err error
 
@@ -184,21 +282,9 @@ func (r *JobRunner) DockerLogin(ctx context.Context) error {
 	}
 
 	// Log in to the docker registres so that images can be pulled.
-	for registry, cred := range creds {
-		authCommand := DockerCommandContext(
-			r.cfg,
-			ctx,
-			"login",
-			"--username",
-			cred.Username,
-			"--password",
-			cred.Password,
-			registry,
-		)
-		authCommand.Env = os.Environ()
-		authCommand.Stderr = logWriter
-		authCommand.Stdout = logWriter
-		if err = authCommand.Run(); err != nil {
+	for _, registry := range sortedRegistries(creds) {
+		cred := creds[registry]
+		if err = r.backend.Login(ctx, registry, cred.Username, cred.Password); err != nil {
 			return errors.Wrapf(err, "failed to log into Docker registry %s", registry)
 		}
 	}
@@ -220,23 +306,7 @@ func (r *JobRunner) createDataContainers(ctx context.Context) (messaging.StatusC
 		for dcIndex := range step.Component.Container.VolumesFrom {
 			svcname := fmt.Sprintf("data_%d_%d", stepIndex, dcIndex)
 			running(r.client, r.job, fmt.Sprintf("creating data container %s", svcname))
-			dataCommand := DockerComposeCommandContext(
-				r.cfg,
-				ctx,
-				"-p",
-				r.projectName,
-				"-f",
-				"docker-compose.yml",
-				"up",
-				"--abort-on-container-exit",
-				"--exit-code-from", svcname,
-				"--no-color",
-				svcname,
-			)
-			dataCommand.Env = os.Environ()
-			dataCommand.Stderr = logWriter
-			dataCommand.Stdout = logWriter
-			if err = dataCommand.Run(); err != nil {
+			if _, err = r.backend.RunService(ctx, svcname, logWriter, logWriter); err != nil {
 				running(r.client, r.job, fmt.Sprintf("error creating data container %s: %s", svcname, err.Error()))
 				return messaging.StatusDockerCreateFailed, errors.Wrapf(err, "failed to create data container %s", svcname)
 			}
@@ -246,56 +316,102 @@ func (r *JobRunner) createDataContainers(ctx context.Context) (messaging.StatusC
 	return messaging.Success, nil
 }
 
+// downloadConcurrency returns the number of individual input downloads that are
+// allowed to run at the same time. Defaults to 1.
+func (r *JobRunner) downloadConcurrency() int {
+	if r.cfg == nil || r.cfg.GetInt("download.concurrency") < 1 {
+		return 1
+	}
+	return r.cfg.GetInt("download.concurrency")
+}
+
 func (r *JobRunner) downloadInputs(ctx context.Context) (messaging.StatusCode, error) {
-	env := os.Environ()
-	if job.InputPathListFile != "" {
-		return r.downloadInputStep(ctx, "download_inputs", job.InputPathListFile, env)
+	if r.job.InputPathListFile != "" {
+		if r.inputDownloaded("download_inputs") {
+			running(r.client, r.job, fmt.Sprintf("Skipping %s, it was downloaded before the job was resumed", r.job.InputPathListFile))
+			return messaging.Success, nil
+		}
+		return r.downloadInputStep(ctx, "download_inputs", r.job.InputPathListFile, "")
 	}
+
+	// The remaining downloads get cancelled as soon as one of them fails.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		failed    sync.Once
+		status    = messaging.Success
+		statusErr error
+		slots     = make(chan struct{}, r.downloadConcurrency())
+	)
+
 	for index, input := range r.job.Inputs() {
 		svcname := fmt.Sprintf("input_%d", index)
-		if status, err := r.downloadInputStep(ctx, svcname, input.IRODSPath(), env); err != nil {
-			return status, err
+		if r.inputDownloaded(svcname) {
+			running(r.client, r.job, fmt.Sprintf("Skipping %s, it was downloaded before the job was resumed", input.IRODSPath()))
+			continue
 		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(svcname, inputPath, source string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if s, err := r.downloadInputStep(ctx, svcname, inputPath, source); err != nil {
+				failed.Do(func() {
+					status, statusErr = s, err
+					cancel()
+				})
+			}
+		}(svcname, input.IRODSPath(), input.Source())
 	}
 
-	return messaging.Success, nil
+	wg.Wait()
+	return status, statusErr
 }
 
-func (r *JobRunner) downloadInputStep(ctx context.Context, svcname, inputPath string, env []string) (messaging.StatusCode, error) {
-	var (
-		exitCode int64
-	)
+// downloadInputStep runs a single input download service. The source is the
+// path the input is downloaded to, relative to the working volume, or an empty
+// string if the service downloads more than one input.
+func (r *JobRunner) downloadInputStep(ctx context.Context, svcname, inputPath, source string) (messaging.StatusCode, error) {
 	running(r.client, r.job, fmt.Sprintf("Downloading %s", inputPath))
-	stderr, err := os.Create(path.Join(r.logsDir, fmt.Sprintf("logs-stderr-%s", svcname)))
+	stderr, err := r.createLogFile(fmt.Sprintf("logs-stderr-%s", svcname))
 	if err != nil {
 		log.Error(err)
 	}
 	defer stderr.Close()
-	stdout, err := os.Create(path.Join(r.logsDir, fmt.Sprintf("logs-stdout-%s", svcname)))
+	stdout, err := r.createLogFile(fmt.Sprintf("logs-stdout-%s", svcname))
 	if err != nil {
 		log.Error(err)
 	}
 	defer stdout.Close()
-	downloadCommand := DockerComposeCommandContext(
-		r.cfg,
-		ctx,
-		"-p", r.projectName,
-		"-f", "docker-compose.yml",
-		"up",
-		"--no-color",
-		"--abort-on-container-exit",
-		"--exit-code-from", svcname,
-		svcname,
-	)
-	downloadCommand.Env = env
-	downloadCommand.Stderr = stderr
-	downloadCommand.Stdout = stdout
-	if err = downloadCommand.Run(); err != nil {
+	var result *ServiceResult
+	err = r.withRetries(ctx, DownloadPhase, inputPath, func(attempt int) error {
+		if attempt > 1 {
+			fmt.Fprintf(stderr, "--- attempt %d ---\n", attempt)
+		}
+		result, err = r.backend.RunService(ctx, svcname, stdout, stderr)
+		return err
+	})
+	if err != nil {
+		var exitCode int
+		if result != nil {
+			exitCode = result.ExitCode
+		}
 		running(r.client, r.job, fmt.Sprintf("error downloading %s: %s", inputPath, err.Error()))
 		return messaging.StatusInputFailed, errors.Wrapf(err, "failed to download %s with an exit code of %d", inputPath, exitCode)
 	}
 	stdout.Close()
 	stderr.Close()
+	r.recordInput(svcname, source)
 	running(r.client, r.job, fmt.Sprintf("finished downloading %s", inputPath))
 
 	return messaging.Success, nil
@@ -316,100 +432,182 @@ func parse(b64 string) (*authInfo, error) {
 	return a, err
 }
 
-func (r *JobRunner) runAllSteps(ctx context.Context) (messaging.StatusCode, error) {
-	var err error
+// runStep runs a single step of the job.
+func (r *JobRunner) runStep(ctx context.Context, idx int) (messaging.StatusCode, error) {
+	step := &r.job.Steps[idx]
+
+	running(r.client, r.job,
+		fmt.Sprintf(
+			"Running tool container %s:%s with arguments: %s",
+			step.Component.Container.Image.Name,
+			step.Component.Container.Image.Tag,
+			strings.Join(step.Arguments(), " "),
+		),
+	)
 
-	for idx, step := range r.job.Steps {
-		running(r.client, r.job,
-			fmt.Sprintf(
-				"Running tool container %s:%s with arguments: %s",
-				step.Component.Container.Image.Name,
-				step.Component.Container.Image.Tag,
-				strings.Join(step.Arguments(), " "),
-			),
-		)
+	stdout, err := r.createLogFile(fmt.Sprintf("docker-compose-step-stdout-%d", idx))
+	if err != nil {
+		log.Error(err)
+	}
+	defer stdout.Close()
 
-		stdout, err := os.Create(path.Join(r.logsDir, fmt.Sprintf("docker-compose-step-stdout-%d", idx)))
-		if err != nil {
-			log.Error(err)
+	stderr, err := r.createLogFile(fmt.Sprintf("docker-compose-step-stderr-%d", idx))
+	if err != nil {
+		log.Error(err)
+	}
+	defer stderr.Close()
+
+	svcname := fmt.Sprintf("step_%d", idx)
+	stepCtx, stepCancel := ctx, context.CancelFunc(func() {})
+	if limit := stepTimeLimit(step); limit > 0 {
+		stepCtx, stepCancel = context.WithTimeout(ctx, limit)
+	}
+	started := time.Now()
+	sampler := r.sampleUsage(stepCtx, idx, svcname)
+	result, err := r.backend.RunService(stepCtx, svcname, stdout, stderr)
+	timedOut := stepCtx.Err() == context.DeadlineExceeded
+	stepCancel()
+	r.recordStepResult(idx, svcname, result, err)
+
+	// The end of a capped log is only written out when it's closed.
+	stdout.Close()
+	stderr.Close()
+
+	var usage string
+	if sampler != nil {
+		if u := sampler.stop(time.Since(started)); u.SampleCount > 0 {
+			r.recordUsage(u)
+			usage = usageSummary(&u)
 		}
-		defer stdout.Close()
+	}
 
-		stderr, err := os.Create(path.Join(r.logsDir, fmt.Sprintf("docker-compose-step-stderr-%d", idx)))
-		if err != nil {
-			log.Error(err)
+	if err != nil && timedOut {
+		return r.stepTimedOut(ctx, idx, step, time.Since(started))
+	}
+
+	if err != nil {
+		if result != nil {
+			err = errors.Wrapf(err, "step %d (%s:%s) failed with %s",
+				idx,
+				step.Component.Container.Image.Name,
+				step.Component.Container.Image.Tag,
+				result,
+			)
+		}
+		stepErr := &StepError{Err: err}
+		if tail := r.stderrTail(idx); tail != "" {
+			stepErr.StderrTail = fmt.Sprintf("Last lines of stderr from step %d:\n%s", idx, tail)
 		}
-		defer stderr.Close()
-
-		svcname := fmt.Sprintf("step_%d", idx)
-		runCommand := DockerComposeCommandContext(
-			r.cfg,
-			ctx,
-			"-p", r.projectName,
-			"-f", "docker-compose.yml",
-			"up",
-			"--abort-on-container-exit",
-			"--exit-code-from", svcname,
-			"--no-color",
-			svcname,
+		msg := fmt.Sprintf(
+			"Error running tool container %s:%s with arguments '%s': %s%s",
+			step.Component.Container.Image.Name,
+			step.Component.Container.Image.Tag,
+			strings.Join(step.Arguments(), " "),
+			err.Error(),
+			parenthesize(usage),
 		)
-		runCommand.Env = os.Environ()
-		runCommand.Stdout = stdout
-		runCommand.Stderr = stderr
-		err = runCommand.Run()
+		if stepErr.StderrTail != "" {
+			msg = fmt.Sprintf("%s\n%s", msg, stepErr.StderrTail)
+		}
+		running(r.client, r.job, msg)
 
-		if err != nil {
-			running(r.client, r.job,
-				fmt.Sprintf(
-					"Error running tool container %s:%s with arguments '%s': %s",
-					step.Component.Container.Image.Name,
-					step.Component.Container.Image.Tag,
-					strings.Join(step.Arguments(), " "),
-					err.Error(),
-				),
-			)
+		return messaging.StatusStepFailed, stepErr
+	}
+
+	running(r.client, r.job,
+		fmt.Sprintf("Tool container %s:%s with arguments '%s' finished successfully%s",
+			step.Component.Container.Image.Name,
+			step.Component.Container.Image.Tag,
+			strings.Join(step.Arguments(), " "),
+			parenthesize(usage),
+		),
+	)
+	return messaging.Success, nil
+}
 
-			return messaging.StatusStepFailed, err
+// parenthesize joins the non-empty details into a parenthetical that can be
+// appended to a status message. Returns an empty string if there aren't any.
+func parenthesize(details ...string) string {
+	var nonEmpty []string
+	for _, d := range details {
+		if d != "" {
+			nonEmpty = append(nonEmpty, d)
 		}
+	}
+	if len(nonEmpty) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", strings.Join(nonEmpty, "; "))
+}
 
-		running(r.client, r.job,
-			fmt.Sprintf("Tool container %s:%s with arguments '%s' finished successfully",
-				step.Component.Container.Image.Name,
-				step.Component.Container.Image.Tag,
-				strings.Join(step.Arguments(), " "),
-			),
+// stepTimeLimit returns the time limit for a step from the job definition, or
+// zero if the step doesn't have one.
+func stepTimeLimit(step *model.Step) time.Duration {
+	return time.Duration(step.Component.TimeLimit) * time.Second
+}
+
+// stepTimedOut records that a step was stopped because either its own time
+// limit or the job's maximum run time was reached.
+func (r *JobRunner) stepTimedOut(ctx context.Context, idx int, step *model.Step, elapsed time.Duration) (messaging.StatusCode, error) {
+	var msg string
+	if ctx.Err() == context.DeadlineExceeded {
+		msg = fmt.Sprintf(
+			"Job exceeded its maximum run time of %s while running step %d (%s:%s), which was stopped after %s",
+			r.maxRuntime,
+			idx,
+			step.Component.Container.Image.Name,
+			step.Component.Container.Image.Tag,
+			elapsed.Round(time.Second),
+		)
+	} else {
+		msg = fmt.Sprintf(
+			"Step %d (%s:%s) timed out after %s, its time limit is %s",
+			idx,
+			step.Component.Container.Image.Name,
+			step.Component.Container.Image.Tag,
+			elapsed.Round(time.Second),
+			stepTimeLimit(step),
 		)
-		// stdout.Close()
-		// stderr.Close()
 	}
-	return messaging.Success, err
+	running(r.client, r.job, msg)
+	return messaging.StatusTimeLimit, errors.New(msg)
+}
+
+// checkJobTimeLimit turns a failure caused by the job running past its maximum
+// run time into a StatusTimeLimit failure.
+func (r *JobRunner) checkJobTimeLimit(ctx context.Context, activity string) {
+	if r.status == messaging.Success || r.status == messaging.StatusTimeLimit {
+		return
+	}
+	if ctx.Err() != context.DeadlineExceeded {
+		return
+	}
+	r.status = messaging.StatusTimeLimit
+	r.failureMessage = fmt.Sprintf("Job exceeded its maximum run time of %s while %s", r.maxRuntime, activity)
+	running(r.client, r.job, r.failureMessage)
 }
 
 func (r *JobRunner) uploadOutputs() (messaging.StatusCode, error) {
 	var err error
-	stdout, err := os.Create(path.Join(r.logsDir, "logs-stdout-output"))
+	stdout, err := r.createLogFile("logs-stdout-output")
 	if err != nil {
 		log.Error(err)
 	}
 	defer stdout.Close()
-	stderr, err := os.Create(path.Join(r.logsDir, "logs-stderr-output"))
+	stderr, err := r.createLogFile("logs-stderr-output")
 	if err != nil {
 		log.Error(err)
 	}
 	defer stderr.Close()
-	outputCommand := DockerComposeCommand(
-		r.cfg,
-		"-p", r.projectName,
-		"-f", "docker-compose.yml",
-		"up",
-		"--no-color",
-		"--abort-on-container-exit",
-		"--exit-code-from", "upload_outputs",
-		"upload_outputs",
-	)
-	outputCommand.Stdout = stdout
-	outputCommand.Stderr = stderr
-	err = outputCommand.Run()
+	// Not cancellable, outputs need to be uploaded even if the job was stopped.
+	ctx := context.Background()
+	err = r.withRetries(ctx, UploadPhase, r.job.OutputDirectory(), func(attempt int) error {
+		if attempt > 1 {
+			fmt.Fprintf(stderr, "--- attempt %d ---\n", attempt)
+		}
+		_, err := r.backend.RunService(ctx, "upload_outputs", stdout, stderr)
+		return err
+	})
 
 	if err != nil {
 		running(r.client, r.job, fmt.Sprintf("Error uploading outputs to %s: %s", r.job.OutputDirectory(), err.Error()))
@@ -428,99 +626,153 @@ func parseRepo(imagename string) string {
 	return ""
 }
 
-// Run executes the job, and returns the exit code on the exit channel.
-func Run(ctx context.Context, client JobUpdatePublisher, job *model.Job, cfg *viper.Viper, exit chan messaging.StatusCode) {
-	host, err := os.Hostname()
-	if err != nil {
-		log.Error(err)
-		host = "UNKNOWN"
+// initPhase sets up the directories and log files for the job. Errors are
+// logged but don't stop the job, unless there isn't enough disk space for it.
+func (r *JobRunner) initPhase(ctx context.Context) (messaging.StatusCode, error) {
+	err := r.Init()
+
+	r.projectName = projectName(r.job)
+
+	if r.resumeEnabled() {
+		r.loadCheckpoint()
 	}
 
-	runner, err := NewJobRunner(client, job, cfg, exit)
-	if err != nil {
+	if err := fs.WriteJobSummary(fs.FS, r.logsDir, r.job); err != nil {
 		log.Error(err)
 	}
 
-	err = runner.Init()
-	if err != nil {
+	if err := fs.WriteJobParameters(fs.FS, r.logsDir, r.job); err != nil {
 		log.Error(err)
 	}
 
-	runner.projectName = strings.Replace(runner.job.InvocationID, "-", "", -1)
-
-	// let everyone know the job is running
-	running(runner.client, runner.job, fmt.Sprintf("Job %s is running on host %s", runner.job.InvocationID, host))
-
-	if err = runner.DockerLogin(ctx); err != nil {
-		log.Error(err)
+	// The disk space is checked last so that the logs are complete when the
+	// job fails here and its outputs are uploaded. The inputs are the first
+	// thing that wouldn't fit.
+	var diskErr *DiskSpaceError
+	if spaceErr := r.checkDiskSpace(); errors.As(spaceErr, &diskErr) {
+		r.failureMessage = diskErr.Error()
+		running(r.client, r.job, r.failureMessage)
+		return messaging.StatusInputFailed, spaceErr
+	} else if spaceErr != nil && err == nil {
+		err = spaceErr
 	}
 
-	pullCommand := DockerComposeCommandContext(
-		cfg,
-		ctx,
-		"-p",
-		runner.projectName,
-		"-f",
-		"docker-compose.yml",
-		"pull",
-		"--parallel",
-	)
-	pullCommand.Env = os.Environ()
-	pullCommand.Dir = runner.workingDir
-	pullCommand.Stdout = logWriter
-	pullCommand.Stderr = logWriter
+	return messaging.Success, err
+}
 
-	err = pullCommand.Run()
+// loginPhase logs into the registries used by the job. Errors don't stop the
+// job, since the images might not need the credentials to be pulled.
+func (r *JobRunner) loginPhase(ctx context.Context) (messaging.StatusCode, error) {
+	return messaging.Success, r.DockerLogin(ctx)
+}
+
+// pullPhase pulls the job's images.
+func (r *JobRunner) pullPhase(ctx context.Context) (messaging.StatusCode, error) {
+	err := r.withRetries(ctx, PullPhase, "images", func(attempt int) error {
+		return r.backend.Pull(ctx, logWriter, logWriter)
+	})
 	if err != nil {
-		log.Error(err)
-		runner.status = messaging.StatusDockerPullFailed
+		return messaging.StatusDockerPullFailed, errors.Wrap(err, "failed to pull the job's images")
+	}
+	if err = r.pinImageDigests(ctx); err != nil {
+		return messaging.StatusDockerPullFailed, err
 	}
+	if err = r.enforceTrustPolicy(ctx); err != nil {
+		return messaging.StatusDockerPullFailed, err
+	}
+	return messaging.Success, nil
+}
 
-	if err = fs.WriteJobSummary(fs.FS, runner.logsDir, job); err != nil {
-		log.Error(err)
+// uploadPhase uploads the job's outputs, as long as they fit in its upload
+// quota.
+func (r *JobRunner) uploadPhase(ctx context.Context) (messaging.StatusCode, error) {
+	quotaErr, err := r.checkUploadQuota()
+	if err != nil {
+		var qErr *QuotaError
+		if errors.As(err, &qErr) {
+			r.failureMessage = qErr.Error()
+			running(r.client, r.job, r.failureMessage)
+		}
+		return messaging.StatusOutputFailed, err
 	}
 
-	if err = fs.WriteJobParameters(fs.FS, runner.logsDir, job); err != nil {
+	// The manifest is only a record of the outputs, so the upload goes ahead
+	// without it.
+	if err = r.writeOutputManifest(); err != nil {
 		log.Error(err)
+		running(r.client, r.job, err.Error())
 	}
 
-	if runner.status == messaging.Success {
-		if runner.status, err = runner.createDataContainers(ctx); err != nil {
-			log.Error(err)
-		}
+	running(r.client, r.job, fmt.Sprintf("Beginning to upload outputs to %s", r.job.OutputDirectory()))
+	status, err := r.uploadOutputs()
+	if err == nil && quotaErr != nil {
+		r.failureMessage = quotaErr.Error()
+		running(r.client, r.job, r.failureMessage)
+		return messaging.StatusOutputFailed, quotaErr
 	}
+	return status, err
+}
 
-	// If pulls didn't succeed then we can't guarantee that we've got the
-	// correct versions of the tools. Don't bother pulling in data in that case,
-	// things are already screwed up.
-	if runner.status == messaging.Success {
-		if runner.status, err = runner.downloadInputs(ctx); err != nil {
-			log.Error(err)
-		}
+// cleanupPhase removes the job's containers and volumes. Errors are logged but
+// don't change the job's status.
+func (r *JobRunner) cleanupPhase(ctx context.Context) (messaging.StatusCode, error) {
+	return messaging.Success, r.backend.Down(ctx, logWriter, logWriter)
+}
+
+// Run executes the job, and returns the exit code on the exit channel.
+func Run(ctx context.Context, client JobUpdatePublisher, job *model.Job, opts *JobOptions, backend ContainerBackend, cfg *viper.Viper, composePath string, exit chan messaging.StatusCode) {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Error(err)
+		host = "UNKNOWN"
 	}
-	// Only attempt to run the steps if the input downloads succeeded. No reason
-	// to run the steps if there's no/corrupted data to operate on.
-	if runner.status == messaging.Success {
-		if runner.status, err = runner.runAllSteps(ctx); err != nil {
-			log.Error(err)
-		}
+
+	runner, err := NewJobRunner(client, job, backend, cfg, exit)
+	if err != nil {
+		log.Error(err)
 	}
-	// Always attempt to transfer outputs. There might be logs that can help
-	// debug issues when the job fails.
-	var outputStatus messaging.StatusCode
-	running(runner.client, runner.job, fmt.Sprintf("Beginning to upload outputs to %s", runner.job.OutputDirectory()))
-	if outputStatus, err = runner.uploadOutputs(); err != nil {
+	runner.opts = opts
+	runner.composePath = composePath
+
+	// The configured hooks run before the checkpoint is updated, since they
+	// can fail a phase that had succeeded.
+	hooks, err := newServiceHooks(cfg)
+	if err != nil {
 		log.Error(err)
 	}
-	if outputStatus != messaging.Success {
-		runner.status = outputStatus
+	for _, h := range hooks {
+		runner.AddPhaseHook(h)
+	}
+	runner.AddPhaseHook(&checkpointHook{})
+
+	// Everything up to the output upload has to finish within the job's
+	// maximum run time.
+	jobCtx := ctx
+	if runner.maxRuntime > 0 {
+		var cancelJob context.CancelFunc
+		jobCtx, cancelJob = context.WithTimeout(ctx, runner.maxRuntime)
+		defer cancelJob()
 	}
+
+	// let everyone know the job is running
+	running(runner.client, runner.job, fmt.Sprintf("Job %s is running on host %s", runner.job.InvocationID, host))
+
+	runner.runLifecycle(jobCtx)
+
 	// Always inform upstream of the job status.
 	if runner.status != messaging.Success {
-		err = fail(runner.client, runner.job, fmt.Sprintf("Job exited with a status of %d", runner.status))
+		msg := runner.failureMessage
+		if msg == "" {
+			msg = fmt.Sprintf("Job exited with a status of %d", runner.status)
+		}
+		msg = strings.Join(append([]string{msg}, runner.stepNotes...), ". ")
+		if runner.failureDetail != "" {
+			msg = fmt.Sprintf("%s\n%s", msg, runner.failureDetail)
+		}
+		err = fail(runner.client, runner.job, msg)
 
 	} else {
-		err = success(runner.client, runner.job)
+		err = success(runner.client, runner.job, strings.Join(runner.stepNotes, ". "))
 	}
 	if err != nil {
 		log.Error(err)
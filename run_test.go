@@ -1,11 +1,96 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/cyverse-de/messaging"
 	"github.com/cyverse-de/model"
+	"github.com/cyverse-de/road-runner/fs"
+	"github.com/spf13/viper"
 )
 
+// testBackend is a ContainerBackend that records the services it's asked to
+// run instead of running them.
+type testBackend struct {
+	mu       sync.Mutex
+	services []string
+
+	// run is called for each service, if set. The default is for every
+	// service to succeed immediately.
+	run func(ctx context.Context, svcname string) (*ServiceResult, error)
+}
+
+func (b *testBackend) Login(ctx context.Context, registry, username, password string) error {
+	return nil
+}
+
+func (b *testBackend) Pull(ctx context.Context, stdout, stderr io.Writer) error {
+	return nil
+}
+
+func (b *testBackend) RunService(ctx context.Context, svcname string, stdout, stderr io.Writer) (*ServiceResult, error) {
+	b.mu.Lock()
+	b.services = append(b.services, svcname)
+	b.mu.Unlock()
+	if b.run != nil {
+		return b.run(ctx, svcname)
+	}
+	return &ServiceResult{}, nil
+}
+
+func (b *testBackend) Down(ctx context.Context, stdout, stderr io.Writer) error {
+	return nil
+}
+
+// blockUntilDone simulates a service that runs until it gets stopped.
+func blockUntilDone(ctx context.Context, svcname string) (*ServiceResult, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+// newTestRunner returns a JobRunner for the job that uses the backend and
+// writes its logs to a temporary directory.
+func newTestRunner(t *testing.T, job *model.Job, backend ContainerBackend) (*JobRunner, *TestJobUpdatePublisher) {
+	client := NewTestJobUpdatePublisher(false)
+	r, err := NewJobRunner(client, job, backend, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.workingDir = t.TempDir()
+	r.logsDir = t.TempDir()
+	r.volumeDir = t.TempDir()
+	r.tmpDir = t.TempDir()
+	return r, client
+}
+
+// stepsJob returns a job with the given number of steps.
+func stepsJob(count int) *model.Job {
+	job := &model.Job{InvocationID: "steps-invocation-id"}
+	for i := 0; i < count; i++ {
+		job.Steps = append(job.Steps, model.Step{
+			Component: model.StepComponent{
+				Container: model.Container{
+					Image: model.ContainerImage{
+						Name: fmt.Sprintf("tool-%d", i),
+						Tag:  "latest",
+					},
+				},
+			},
+		})
+	}
+	return job
+}
+
 var testJob = &model.Job{
 	ID:           "test-job-id",
 	InvocationID: "test-invocation-id",
@@ -96,7 +181,7 @@ var testJob = &model.Job{
 }
 
 func TestGetDockerCreds(t *testing.T) {
-	r, err := NewJobRunner(nil, testJob, nil, nil)
+	r, err := NewJobRunner(nil, testJob, nil, nil, nil)
 	if err != nil {
 		t.Fatal("failed to instantiate the test job runner")
 	}
@@ -161,3 +246,263 @@ func TestGetDockerCreds(t *testing.T) {
 // 		t.Errorf("status code was %d instead of %d", sc, messaging.Success)
 // 	}
 // }
+
+func TestRunAllStepsStepTimeLimit(t *testing.T) {
+	job := stepsJob(2)
+	job.Steps[0].Component.TimeLimit = 1
+	backend := &testBackend{run: blockUntilDone}
+	r, _ := newTestRunner(t, job, backend)
+
+	status, err := r.runAllSteps(context.Background())
+	if err == nil {
+		t.Fatal("err was nil")
+	}
+	if status != messaging.StatusTimeLimit {
+		t.Errorf("status was %d instead of %d", status, messaging.StatusTimeLimit)
+	}
+	if !strings.Contains(r.failureMessage, "Step 0 (tool-0:latest) timed out after 1s") {
+		t.Errorf("unexpected failure message: %s", r.failureMessage)
+	}
+	if len(backend.services) != 1 {
+		t.Errorf("%d services were run instead of 1", len(backend.services))
+	}
+}
+
+func TestRunAllStepsFailureDetails(t *testing.T) {
+	started := time.Date(2021, 10, 27, 15, 10, 0, 0, time.UTC)
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			return &ServiceResult{
+				ContainerID: "abc123",
+				ExitCode:    137,
+				OOMKilled:   true,
+				Signal:      exitSignal(137),
+				StartedAt:   started,
+				FinishedAt:  started.Add(time.Minute),
+			}, errors.New("exit status 137")
+		},
+	}
+	r, client := newTestRunner(t, stepsJob(1), backend)
+
+	if _, err := r.runAllSteps(context.Background()); err == nil {
+		t.Fatal("err was nil")
+	}
+	expected := "step 0 (tool-0:latest) failed with exit code 137, killed by signal 9 (killed), out of memory: exit status 137"
+	if r.failureMessage != expected {
+		t.Errorf("failure message was %q instead of %q", r.failureMessage, expected)
+	}
+	var published bool
+	for _, u := range client.updates {
+		if strings.HasPrefix(u.Message, "Error running tool container") {
+			published = true
+			if strings.Count(u.Message, "exit code 137") != 1 {
+				t.Errorf("the exit details were repeated in %q", u.Message)
+			}
+		}
+	}
+	if !published {
+		t.Error("the step failure wasn't published")
+	}
+
+	b, err := os.ReadFile(path.Join(r.logsDir, "StepResults.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []fs.StepResult
+	if err = json.Unmarshal(b, &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("%d results were recorded instead of 1", len(results))
+	}
+	res := results[0]
+	if res.ContainerID != "abc123" || res.ExitCode != 137 || !res.OOMKilled || res.Signal != 9 || res.SignalName != "killed" {
+		t.Errorf("result was %+v", res)
+	}
+	if res.StartedAt == nil || !res.StartedAt.Equal(started) {
+		t.Errorf("started_at was %v", res.StartedAt)
+	}
+}
+
+func TestMaxLogFileSize(t *testing.T) {
+	if size := maxLogFileSize(nil); size != defaultMaxLogFileSize {
+		t.Errorf("default size was %d", size)
+	}
+	cfg := viper.New()
+	cfg.Set("logs.max_file_size", "2MB")
+	if size := maxLogFileSize(cfg); size != 2*1024*1024 {
+		t.Errorf("size was %d", size)
+	}
+	cfg.Set("logs.max_file_size", 0)
+	if size := maxLogFileSize(cfg); size != 0 {
+		t.Errorf("size was %d", size)
+	}
+}
+
+func TestSetVolumeOwnership(t *testing.T) {
+	r, _ := newTestRunner(t, stepsJob(1), &testBackend{})
+	if err := r.setVolumeOwnership(); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(r.volumeDir); err != nil || fi.Mode().Perm() != 0777 {
+		t.Errorf("mode without a user was %v, error was %v", fi.Mode(), err)
+	}
+
+	// Giving the directories to the current user works without root.
+	r.cfg = viper.New()
+	r.cfg.Set("run_as.uid", os.Getuid())
+	r.cfg.Set("run_as.gid", os.Getgid())
+	if err := r.setVolumeOwnership(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{r.volumeDir, r.tmpDir} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0770 || fi.Mode()&os.ModeSetgid == 0 {
+			t.Errorf("mode of %s was %v", dir, fi.Mode())
+		}
+	}
+}
+
+func TestSetVolumeOwnershipFallback(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root can give the directories to anyone")
+	}
+	r, _ := newTestRunner(t, stepsJob(1), &testBackend{})
+	r.cfg = viper.New()
+	r.cfg.Set("run_as.uid", os.Getuid()+1)
+	if err := r.setVolumeOwnership(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{r.volumeDir, r.tmpDir} {
+		if fi, err := os.Stat(dir); err != nil || fi.Mode().Perm() != 0777 {
+			t.Errorf("mode of %s was %v, error was %v", dir, fi.Mode(), err)
+		}
+	}
+}
+
+func TestRunAllStepsJobTimeLimit(t *testing.T) {
+	job := stepsJob(1)
+	backend := &testBackend{run: blockUntilDone}
+	r, _ := newTestRunner(t, job, backend)
+	r.maxRuntime = 50 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.maxRuntime)
+	defer cancel()
+
+	status, _ := r.runAllSteps(ctx)
+	if status != messaging.StatusTimeLimit {
+		t.Errorf("status was %d instead of %d", status, messaging.StatusTimeLimit)
+	}
+	if !strings.Contains(r.failureMessage, "maximum run time of 50ms while running step 0") {
+		t.Errorf("unexpected failure message: %s", r.failureMessage)
+	}
+}
+
+// inputsJob returns a job with a single step that has the given number of
+// inputs.
+func inputsJob(count int) *model.Job {
+	job := stepsJob(1)
+	for i := 0; i < count; i++ {
+		job.Steps[0].Config.Inputs = append(job.Steps[0].Config.Inputs, model.StepInput{
+			Value:        fmt.Sprintf("/iplant/home/test/input-%d.txt", i),
+			Multiplicity: "single",
+		})
+	}
+	return job
+}
+
+func TestDownloadInputsConcurrency(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		current int
+		maximum int
+		reached bool
+	)
+
+	// The downloads wait until three of them are running at once, so the
+	// test doesn't depend on timing. The timeout keeps it from hanging if the
+	// limit is never reached.
+	full := make(chan struct{})
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			mu.Lock()
+			current++
+			if current > maximum {
+				maximum = current
+			}
+			if current == 3 && !reached {
+				reached = true
+				close(full)
+			}
+			mu.Unlock()
+			select {
+			case <-full:
+			case <-time.After(5 * time.Second):
+			}
+			mu.Lock()
+			current--
+			mu.Unlock()
+			return &ServiceResult{}, nil
+		},
+	}
+	r, _ := newTestRunner(t, inputsJob(7), backend)
+	r.cfg = viper.New()
+	r.cfg.Set("download.concurrency", 3)
+
+	status, err := r.downloadInputs(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != messaging.Success {
+		t.Errorf("status was %d instead of %d", status, messaging.Success)
+	}
+	if len(backend.services) != 7 {
+		t.Errorf("%d services were run instead of 7", len(backend.services))
+	}
+	if maximum > 3 {
+		t.Errorf("%d downloads ran at once instead of 3", maximum)
+	}
+	select {
+	case <-full:
+	default:
+		t.Errorf("only %d downloads ran at once instead of 3", maximum)
+	}
+	for i := 0; i < 7; i++ {
+		if _, err = os.Stat(path.Join(r.logsDir, fmt.Sprintf("logs-stdout-input_%d", i))); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDownloadInputsFailure(t *testing.T) {
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			if svcname == "input_2" {
+				return &ServiceResult{ExitCode: 1}, errors.New("exit status 1")
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+				return &ServiceResult{}, nil
+			}
+		},
+	}
+	r, _ := newTestRunner(t, inputsJob(10), backend)
+	r.cfg = viper.New()
+	r.cfg.Set("download.concurrency", 4)
+
+	status, err := r.downloadInputs(context.Background())
+	if status != messaging.StatusInputFailed {
+		t.Errorf("status was %d instead of %d", status, messaging.StatusInputFailed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "/iplant/home/test/input-2.txt") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(backend.services) == 10 {
+		t.Error("the remaining downloads were not cancelled")
+	}
+}
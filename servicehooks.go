@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/cyverse-de/road-runner/dcompose"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// The points in a phase that a hook container can run at.
+const (
+	HookBefore  = "before"
+	HookAfter   = "after"
+	HookSuccess = "success"
+	HookFailure = "failure"
+)
+
+// statusNames maps the names accepted for a hook's failure_status to job
+// statuses.
+var statusNames = map[string]messaging.StatusCode{
+	"docker_pull_failed":   messaging.StatusDockerPullFailed,
+	"docker_create_failed": messaging.StatusDockerCreateFailed,
+	"input_failed":         messaging.StatusInputFailed,
+	"step_failed":          messaging.StatusStepFailed,
+	"output_failed":        messaging.StatusOutputFailed,
+	"killed":               messaging.StatusKilled,
+	"time_limit":           messaging.StatusTimeLimit,
+}
+
+// serviceHook is a PhaseHook that runs one of the hook containers defined in
+// the config.
+type serviceHook struct {
+	config  dcompose.HookConfig
+	phase   JobPhase
+	timeout time.Duration
+
+	// fatal is true if the hook's failures fail the job with failureStatus.
+	fatal         bool
+	failureStatus messaging.StatusCode
+}
+
+// newServiceHooks returns the hooks defined in the config. An error is
+// returned if any of them are invalid.
+func newServiceHooks(cfg *viper.Viper) ([]*serviceHook, error) {
+	configs, err := dcompose.ReadHooks(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []*serviceHook
+	for _, c := range configs {
+		h := &serviceHook{config: c, phase: JobPhase(c.Phase)}
+
+		if _, ok := lifecycle[h.phase]; !ok {
+			return nil, fmt.Errorf("hook %s has an unknown phase %q", c.Name, c.Phase)
+		}
+
+		switch c.When {
+		case HookBefore, HookAfter, HookSuccess, HookFailure:
+		default:
+			return nil, fmt.Errorf("hook %s has an unknown when %q", c.Name, c.When)
+		}
+
+		// The logs directory that the hooks write their output to is created
+		// by init, and the containers have already been removed once cleanup
+		// finishes.
+		if h.phase == PhaseInit && c.When == HookBefore {
+			return nil, fmt.Errorf("hook %s can only run after the init phase", c.Name)
+		}
+		if h.phase == PhaseCleanup && c.When != HookBefore {
+			return nil, fmt.Errorf("hook %s can only run before the cleanup phase", c.Name)
+		}
+
+		if c.Timeout != "" {
+			if h.timeout, err = time.ParseDuration(c.Timeout); err != nil {
+				return nil, errors.Wrapf(err, "hook %s has an invalid timeout", c.Name)
+			}
+		}
+
+		if c.FailureStatus != "" {
+			status, ok := statusNames[c.FailureStatus]
+			if !ok {
+				return nil, fmt.Errorf("hook %s has an unknown failure_status %q", c.Name, c.FailureStatus)
+			}
+			h.fatal = true
+			h.failureStatus = status
+		}
+
+		hooks = append(hooks, h)
+	}
+	return hooks, nil
+}
+
+// beforeImagesPulled returns true if the hook can run before the job's images
+// have been pulled.
+func (h *serviceHook) beforeImagesPulled() bool {
+	return h.phase == PhaseInit || h.phase == PhaseLogin || h.phase == PhasePull
+}
+
+// run runs the hook's container, writing its output to the logs directory.
+func (h *serviceHook) run(ctx context.Context, r *JobRunner) error {
+	svcname := h.config.ServiceName()
+	running(r.client, r.job, fmt.Sprintf("Running hook %s for the %s phase", h.config.Name, h.phase))
+
+	stdout, err := r.createLogFile(fmt.Sprintf("logs-stdout-%s", svcname))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create the stdout log for hook %s", h.config.Name)
+	}
+	defer stdout.Close()
+	stderr, err := r.createLogFile(fmt.Sprintf("logs-stderr-%s", svcname))
+	if err != nil {
+		return errors.Wrapf(err, "failed to create the stderr log for hook %s", h.config.Name)
+	}
+	defer stderr.Close()
+
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	// The job's images haven't necessarily been pulled yet, and some backends
+	// don't pull missing images when they run a service.
+	if puller, ok := r.backend.(servicePuller); ok && h.beforeImagesPulled() {
+		if err = puller.PullService(ctx, svcname, stdout, stderr); err != nil {
+			return errors.Wrapf(err, "failed to pull the image for hook %s", h.config.Name)
+		}
+	}
+
+	result, err := r.backend.RunService(ctx, svcname, stdout, stderr)
+	if err != nil {
+		var exitCode int
+		if result != nil {
+			exitCode = result.ExitCode
+		}
+		return errors.Wrapf(err, "hook %s failed with an exit code of %d", h.config.Name, exitCode)
+	}
+
+	running(r.client, r.job, fmt.Sprintf("Hook %s finished successfully", h.config.Name))
+	return nil
+}
+
+// failed reports a hook failure. A HookError is returned if the failure should
+// fail the job, otherwise nil is returned.
+func (h *serviceHook) failed(r *JobRunner, err error) error {
+	running(r.client, r.job, err.Error())
+	if !h.fatal {
+		return nil
+	}
+	return &HookError{Status: h.failureStatus, Err: err}
+}
+
+// BeforePhase runs "before" hooks.
+func (h *serviceHook) BeforePhase(ctx context.Context, r *JobRunner, phase JobPhase) error {
+	if phase != h.phase || h.config.When != HookBefore {
+		return nil
+	}
+	if err := h.run(ctx, r); err != nil {
+		return h.failed(r, err)
+	}
+	return nil
+}
+
+// AfterPhase runs "after", "success" and "failure" hooks. They run even if
+// the job was stopped, so that failure hooks can collect diagnostics. A fatal
+// failure fails a phase that had succeeded.
+func (h *serviceHook) AfterPhase(ctx context.Context, r *JobRunner, result *PhaseResult) {
+	if result.Phase != h.phase {
+		return
+	}
+	switch h.config.When {
+	case HookAfter:
+	case HookSuccess:
+		if result.Outcome != PhaseSucceeded {
+			return
+		}
+	case HookFailure:
+		if result.Outcome == PhaseSucceeded {
+			return
+		}
+	default:
+		return
+	}
+
+	err := h.run(context.Background(), r)
+	if err == nil {
+		return
+	}
+	if hookErr := h.failed(r, err); hookErr != nil && result.Outcome == PhaseSucceeded {
+		result.Outcome = PhaseFailed
+		result.Status = h.failureStatus
+		result.Err = hookErr
+	}
+}
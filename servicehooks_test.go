@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/spf13/viper"
+)
+
+func hooksConfig(t *testing.T, yml string) *viper.Viper {
+	cfg := viper.New()
+	cfg.SetConfigType("yaml")
+	if err := cfg.ReadConfig(bytes.NewBufferString(yml)); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestNewServiceHooksErrors(t *testing.T) {
+	tests := map[string]string{
+		"phase":   "hooks:\n  - {name: a, image: x, phase: nope, when: before}\n",
+		"when":    "hooks:\n  - {name: a, image: x, phase: steps, when: during}\n",
+		"init":    "hooks:\n  - {name: a, image: x, phase: init, when: before}\n",
+		"cleanup": "hooks:\n  - {name: a, image: x, phase: cleanup, when: after}\n",
+		"timeout": "hooks:\n  - {name: a, image: x, phase: steps, when: before, timeout: soon}\n",
+		"status":  "hooks:\n  - {name: a, image: x, phase: steps, when: before, failure_status: broken}\n",
+	}
+	for name, yml := range tests {
+		if _, err := newServiceHooks(hooksConfig(t, yml)); err == nil {
+			t.Errorf("%s: no error was returned", name)
+		}
+	}
+}
+
+// runWithHooks runs the lifecycle for a job with one step and one input, with
+// the hooks from the config. The services named in failing fail.
+func runWithHooks(t *testing.T, yml string, failing ...string) (*JobRunner, []string) {
+	hooks, err := newServiceHooks(hooksConfig(t, yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			if containsString(failing, svcname) {
+				return &ServiceResult{ExitCode: 2}, errors.New("exit status 2")
+			}
+			return &ServiceResult{}, nil
+		},
+	}
+	r, _ := newTestRunner(t, inputsJob(1), backend)
+	for _, h := range hooks {
+		r.AddPhaseHook(h)
+	}
+	r.runLifecycle(context.Background())
+	return r, backend.services
+}
+
+func TestServiceHooksRun(t *testing.T) {
+	r, services := runWithHooks(t, `
+hooks:
+  - {name: license, image: x, phase: steps, when: before}
+  - {name: scrub, image: x, phase: steps, when: success}
+  - {name: diag, image: x, phase: steps, when: failure}
+  - {name: always, image: x, phase: download, when: after}
+`)
+	expected := []string{"input_0", "hook_always", "hook_license", "step_0", "hook_scrub", "upload_outputs"}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("services were %v instead of %v", services, expected)
+	}
+	if r.status != messaging.Success {
+		t.Errorf("status was %d", r.status)
+	}
+}
+
+func TestServiceHooksFatalBefore(t *testing.T) {
+	r, services := runWithHooks(t, `
+hooks:
+  - {name: license, image: x, phase: steps, when: before, failure_status: killed}
+`, "hook_license")
+	expected := []string{"input_0", "hook_license", "upload_outputs"}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("services were %v instead of %v", services, expected)
+	}
+	if r.status != messaging.StatusKilled {
+		t.Errorf("status was %d", r.status)
+	}
+}
+
+func TestServiceHooksNonFatal(t *testing.T) {
+	r, services := runWithHooks(t, `
+hooks:
+  - {name: license, image: x, phase: steps, when: before}
+`, "hook_license")
+	expected := []string{"input_0", "hook_license", "step_0", "upload_outputs"}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("services were %v instead of %v", services, expected)
+	}
+	if r.status != messaging.Success {
+		t.Errorf("status was %d", r.status)
+	}
+}
+
+func TestServiceHooksFatalAfter(t *testing.T) {
+	r, services := runWithHooks(t, `
+hooks:
+  - {name: verify, image: x, phase: download, when: success, failure_status: input_failed}
+`, "hook_verify")
+	expected := []string{"input_0", "hook_verify", "upload_outputs"}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("services were %v instead of %v", services, expected)
+	}
+	if r.status != messaging.StatusInputFailed {
+		t.Errorf("status was %d", r.status)
+	}
+}
+
+func TestServiceHooksOnFailure(t *testing.T) {
+	r, services := runWithHooks(t, `
+hooks:
+  - {name: diag, image: x, phase: steps, when: failure, failure_status: killed}
+`, "step_0")
+	expected := []string{"input_0", "step_0", "hook_diag", "upload_outputs"}
+	if !reflect.DeepEqual(services, expected) {
+		t.Errorf("services were %v instead of %v", services, expected)
+	}
+	if r.status != messaging.StatusStepFailed {
+		t.Errorf("status was %d", r.status)
+	}
+}
+
+// pullingBackend is a testBackend that records the services it pulls images
+// for one at a time.
+type pullingBackend struct {
+	testBackend
+	pulled []string
+}
+
+func (b *pullingBackend) PullService(ctx context.Context, svcname string, stdout, stderr io.Writer) error {
+	b.pulled = append(b.pulled, svcname)
+	return nil
+}
+
+func TestServiceHooksPullEarlyImages(t *testing.T) {
+	hooks, err := newServiceHooks(hooksConfig(t, `
+hooks:
+  - {name: setup, image: x, phase: init, when: after}
+  - {name: registry, image: x, phase: pull, when: before}
+  - {name: license, image: x, phase: steps, when: before}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &pullingBackend{}
+	r, _ := newTestRunner(t, inputsJob(1), backend)
+	for _, h := range hooks {
+		r.AddPhaseHook(h)
+	}
+	r.runLifecycle(context.Background())
+
+	expected := []string{"hook_setup", "hook_registry"}
+	if !reflect.DeepEqual(backend.pulled, expected) {
+		t.Errorf("pulled %v instead of %v", backend.pulled, expected)
+	}
+	if !containsString(backend.services, "hook_license") {
+		t.Errorf("services were %v", backend.services)
+	}
+}
+
+func TestServiceHookMissingLogsDir(t *testing.T) {
+	hooks, err := newServiceHooks(hooksConfig(t, "hooks:\n  - {name: license, image: x, phase: steps, when: before}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &testBackend{}
+	r, _ := newTestRunner(t, stepsJob(1), backend)
+	r.logsDir = path.Join(t.TempDir(), "missing")
+
+	if err = hooks[0].run(context.Background(), r); err == nil {
+		t.Error("no error was returned when the hook's logs couldn't be created")
+	}
+	if len(backend.services) != 0 {
+		t.Errorf("services were %v", backend.services)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// cosignSignatureAnnotation is the layer annotation that cosign stores
+	// the base64-encoded signature of the layer's payload in.
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	// ociRefNameAnnotation names the manifests in an OCI layout's index.
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+)
+
+// ociDescriptor points to a blob in a registry or OCI layout.
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociManifest is the part of an image manifest that's needed to find the
+// signatures in it.
+type ociManifest struct {
+	Layers []ociDescriptor `json:"layers"`
+}
+
+// ociIndex is the index.json file at the top of an OCI layout.
+type ociIndex struct {
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// simpleSigningPayload is the payload that cosign signs. Only the digest of
+// the signed image is checked.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+	} `json:"critical"`
+}
+
+// signatureStore reads the manifests and blobs that make up an image's
+// signatures.
+type signatureStore interface {
+	manifest(ctx context.Context, r imageRef, tag string) ([]byte, error)
+	blob(ctx context.Context, r imageRef, digest string) ([]byte, error)
+}
+
+// signatureTag returns the tag that cosign stores the signatures of the image
+// with the digest under.
+func signatureTag(digest string) string {
+	return strings.Replace(digest, ":", "-", 1) + ".sig"
+}
+
+// checkDigest makes sure that the content matches the digest it was fetched
+// by.
+func checkDigest(b []byte, digest string) error {
+	sum := sha256.Sum256(b)
+	if actual := "sha256:" + hex.EncodeToString(sum[:]); actual != digest {
+		return fmt.Errorf("blob %s has the digest %s", digest, actual)
+	}
+	return nil
+}
+
+// signatureStore returns the store that the policy reads signatures from.
+func (p *TrustPolicy) signatureStore() signatureStore {
+	if p.OCILayout != "" {
+		return &ociLayoutStore{dir: p.OCILayout}
+	}
+	insecure := make(map[string]bool)
+	for _, registry := range p.InsecureRegistries {
+		insecure[registry] = true
+	}
+	return &registryStore{
+		client:   &http.Client{Timeout: 30 * time.Second},
+		insecure: insecure,
+	}
+}
+
+// verifySignature makes sure that the image has a cosign signature for its
+// digest made with one of the policy's keys. Nothing is looked up in a
+// transparency log, so this works without internet access.
+func (p *TrustPolicy) verifySignature(ctx context.Context, r imageRef) error {
+	store := p.signatureStore()
+	b, err := store.manifest(ctx, r, signatureTag(r.Digest))
+	if err != nil {
+		return errors.Wrap(err, "no signature was found")
+	}
+	var m ociManifest
+	if err = json.Unmarshal(b, &m); err != nil {
+		return errors.Wrap(err, "failed to parse the signature manifest")
+	}
+
+	for _, layer := range m.Layers {
+		encoded, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			log.Warn(errors.Wrapf(err, "invalid signature in %s", layer.Digest))
+			continue
+		}
+		payload, err := store.blob(ctx, r, layer.Digest)
+		if err != nil {
+			return errors.Wrap(err, "failed to read a signature payload")
+		}
+		var sp simpleSigningPayload
+		if err = json.Unmarshal(payload, &sp); err != nil || sp.Critical.Image.DockerManifestDigest != r.Digest {
+			continue
+		}
+		sum := sha256.Sum256(payload)
+		for _, key := range p.keys {
+			if ecdsa.VerifyASN1(key, sum[:], sig) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("it doesn't have a signature for %s made with a trusted key", r.Digest)
+}
+
+// ociLayoutStore reads signatures from an OCI image layout directory, such as
+// one written by "cosign save" or "skopeo copy".
+type ociLayoutStore struct {
+	dir string
+}
+
+// manifest finds the manifest tagged with the tag in the layout's index. The
+// tag can be recorded on its own or along with the image's name.
+func (s *ociLayoutStore) manifest(ctx context.Context, r imageRef, tag string) ([]byte, error) {
+	b, err := os.ReadFile(filepath.Join(s.dir, "index.json"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the index of %s", s.dir)
+	}
+	var index ociIndex
+	if err = json.Unmarshal(b, &index); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the index of %s", s.dir)
+	}
+	names := map[string]bool{
+		tag:                      true,
+		r.Repository + ":" + tag: true,
+		r.Name() + ":" + tag:     true,
+	}
+	for _, m := range index.Manifests {
+		if names[m.Annotations[ociRefNameAnnotation]] {
+			return s.blob(ctx, r, m.Digest)
+		}
+	}
+	return nil, fmt.Errorf("%s isn't in %s", tag, s.dir)
+}
+
+func (s *ociLayoutStore) blob(ctx context.Context, r imageRef, digest string) ([]byte, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || strings.ContainsAny(parts[1], `/\.`) {
+		return nil, fmt.Errorf("unsupported digest %q", digest)
+	}
+	b, err := os.ReadFile(filepath.Join(s.dir, "blobs", parts[0], parts[1]))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read blob %s", digest)
+	}
+	if err = checkDigest(b, digest); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// registryStore reads signatures from the image's registry with the
+// Distribution API. It doesn't log in, so it's meant for local registries and
+// mirrors.
+type registryStore struct {
+	client   *http.Client
+	insecure map[string]bool
+}
+
+// get fetches a manifest or blob from the image's repository.
+func (s *registryStore) get(ctx context.Context, r imageRef, kind, reference string, accept ...string) ([]byte, error) {
+	scheme, host := "https", r.Registry
+	if s.insecure[r.Registry] {
+		scheme = "http"
+	}
+	if host == defaultRegistry {
+		host = "registry-1.docker.io"
+	}
+	url := fmt.Sprintf("%s://%s/v2/%s/%s/%s", scheme, host, r.Repository, kind, reference)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range accept {
+		req.Header.Add("Accept", a)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s", url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", url)
+	}
+	return b, nil
+}
+
+func (s *registryStore) manifest(ctx context.Context, r imageRef, tag string) ([]byte, error) {
+	return s.get(ctx, r, "manifests", tag,
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+	)
+}
+
+func (s *registryStore) blob(ctx context.Context, r imageRef, digest string) ([]byte, error) {
+	b, err := s.get(ctx, r, "blobs", digest)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkDigest(b, digest); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
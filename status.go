@@ -33,12 +33,13 @@ func fail(client JobUpdatePublisher, job *model.Job, msg string) error {
 	})
 }
 
-func success(client JobUpdatePublisher, job *model.Job) error {
+func success(client JobUpdatePublisher, job *model.Job, msg string) error {
 	log.Info("Job success")
 	return client.PublishJobUpdate(&messaging.UpdateMessage{
-		Job:    jobDetailsFromJob(job),
-		State:  messaging.SucceededState,
-		Sender: hostname(),
+		Job:     jobDetailsFromJob(job),
+		State:   messaging.SucceededState,
+		Message: msg,
+		Sender:  hostname(),
 	})
 }
 
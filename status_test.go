@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"sync"
 	"testing"
 
 	"github.com/cyverse-de/messaging"
@@ -9,6 +10,7 @@ import (
 )
 
 type TestJobUpdatePublisher struct {
+	mu      sync.Mutex
 	fail    bool
 	updates []*messaging.UpdateMessage
 }
@@ -24,6 +26,8 @@ func (j *TestJobUpdatePublisher) PublishJobUpdate(m *messaging.UpdateMessage) er
 	if j.fail {
 		return errors.New("failed to publish job update")
 	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
 	j.updates = append(j.updates, m)
 	return nil
 }
@@ -60,7 +64,7 @@ func TestFail(t *testing.T) {
 func TestSuccess(t *testing.T) {
 	j := NewTestJobUpdatePublisher(false)
 	job := &model.Job{InvocationID: "test-id"}
-	err := success(j, job)
+	err := success(j, job, "")
 	if err != nil {
 		t.Error(err)
 	}
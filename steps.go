@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/cyverse-de/model"
+	"github.com/cyverse-de/road-runner/fs"
+	"github.com/pkg/errors"
+)
+
+// The defaults for the amount of a failed step's stderr that's included in
+// its failure updates.
+const (
+	defaultStderrTailLines = 20
+	defaultStderrTailBytes = 4096
+)
+
+// StepGraph records which steps of a job have to finish before each of the
+// other steps can start.
+type StepGraph struct {
+	// Deps contains the indexes of the steps each step depends on.
+	Deps [][]int
+}
+
+// SequentialStepGraph returns a graph where each step depends on the one
+// before it, which is how jobs have always been run.
+func SequentialStepGraph(count int) *StepGraph {
+	g := &StepGraph{Deps: make([][]int, count)}
+	for i := 1; i < count; i++ {
+		g.Deps[i] = []int{i - 1}
+	}
+	return g
+}
+
+// stepPathNames returns the names an input or output path can be referred to
+// by, which is the cleaned path and its base name.
+func stepPathNames(p string) []string {
+	p = strings.TrimSuffix(p, "/")
+	if p == "" || p == "." {
+		return nil
+	}
+	return []string{path.Clean(p), path.Base(p)}
+}
+
+// inferDependency returns true if step b uses one of the outputs of step a as
+// an input.
+func inferDependency(a, b *model.Step) bool {
+	outputs := make(map[string]bool)
+	for _, o := range a.Config.Outputs {
+		for _, n := range stepPathNames(o.Name) {
+			outputs[n] = true
+		}
+	}
+	for _, i := range b.Config.Inputs {
+		for _, n := range stepPathNames(i.Value) {
+			if outputs[n] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewStepGraph builds the dependency graph for the job's steps from the
+// dependencies declared in the options and the ones inferred from the steps'
+// inputs and outputs. A step is only inferred to depend on steps that come
+// before it. An error is returned if a declared dependency doesn't exist or if
+// the dependencies contain a cycle.
+func NewStepGraph(job *model.Job, opts *JobOptions) (*StepGraph, error) {
+	count := len(job.Steps)
+	g := &StepGraph{Deps: make([][]int, count)}
+
+	for i := 0; i < count; i++ {
+		deps := make(map[int]bool)
+
+		for _, d := range opts.Step(i).DependsOn {
+			if d < 0 || d >= count || d == i {
+				return nil, fmt.Errorf("step %d has an invalid dependency on step %d", i, d)
+			}
+			deps[d] = true
+		}
+
+		for j := 0; j < i; j++ {
+			if inferDependency(&job.Steps[j], &job.Steps[i]) {
+				deps[j] = true
+			}
+		}
+
+		for d := range deps {
+			g.Deps[i] = append(g.Deps[i], d)
+		}
+		sort.Ints(g.Deps[i])
+	}
+
+	if _, err := g.Order(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Order returns the step indexes in an order that satisfies the dependencies,
+// preferring lower indexes. An error is returned if there's a cycle.
+func (g *StepGraph) Order() ([]int, error) {
+	remaining := make([]int, len(g.Deps))
+	dependents := make([][]int, len(g.Deps))
+	for i, deps := range g.Deps {
+		remaining[i] = len(deps)
+		for _, d := range deps {
+			dependents[d] = append(dependents[d], i)
+		}
+	}
+
+	var order []int
+	done := make([]bool, len(g.Deps))
+	for len(order) < len(g.Deps) {
+		next := -1
+		for i := range g.Deps {
+			if !done[i] && remaining[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			return nil, fmt.Errorf("the step dependencies contain a cycle")
+		}
+		done[next] = true
+		order = append(order, next)
+		for _, d := range dependents[next] {
+			remaining[d]--
+		}
+	}
+	return order, nil
+}
+
+// StepBudget limits the resources used by the steps that are running at the
+// same time. A zero value for a field means that resource isn't limited.
+type StepBudget struct {
+	CPUs   float64
+	Memory int64
+}
+
+// stepBudget returns the resources available to concurrent steps. Defaults to
+// the largest minimum requested by any step, which is the size of the slot the
+// job was given.
+func (r *JobRunner) stepBudget() StepBudget {
+	budget := StepBudget{
+		CPUs:   float64(r.job.CPURequest()),
+		Memory: r.job.MemoryRequest(),
+	}
+	if r.cfg != nil {
+		if v := r.cfg.GetFloat64("steps.max_cpus"); v > 0 {
+			budget.CPUs = v
+		}
+		if v := r.cfg.GetInt64("steps.max_memory"); v > 0 {
+			budget.Memory = v
+		}
+	}
+	return budget
+}
+
+// stepGraph returns the dependency graph used to run the job's steps. Steps
+// run one after the other unless steps.parallel is enabled or the job
+// declares dependencies between its steps.
+func (r *JobRunner) stepGraph() (*StepGraph, error) {
+	parallel := r.cfg != nil && r.cfg.GetBool("steps.parallel")
+	if !parallel && !r.opts.DeclaresDependencies() {
+		return SequentialStepGraph(len(r.job.Steps)), nil
+	}
+	return NewStepGraph(r.job, r.opts)
+}
+
+// stepResult is sent by each step as it finishes.
+type stepResult struct {
+	index  int
+	status messaging.StatusCode
+	err    error
+}
+
+// stepState tracks where a step is in the schedule.
+type stepState int
+
+const (
+	stepPending stepState = iota
+	stepRunning
+	stepSucceeded
+
+	// stepIgnored is a step that failed but is allowed to fail.
+	stepIgnored
+	stepFailed
+	stepSkipped
+)
+
+// done returns true if the step won't run any more.
+func (s stepState) done() bool {
+	return s >= stepSucceeded
+}
+
+// joinInts formats a list of step indexes for a message.
+func joinInts(list []int) string {
+	var strs []string
+	for _, i := range list {
+		strs = append(strs, fmt.Sprintf("%d", i))
+	}
+	return strings.Join(strs, ", ")
+}
+
+// runAllSteps runs the job's steps, starting each one as soon as the steps it
+// depends on have finished and there's room for it in the step budget.
+//
+// Steps that are allowed to fail don't stop the job. Once any other step
+// fails no more steps are started and the ones still running are cancelled,
+// except for the steps that are set to always run. Those still run once the
+// steps they depend on are done, unless the job itself was stopped.
+func (r *JobRunner) runAllSteps(ctx context.Context) (messaging.StatusCode, error) {
+	graph, err := r.stepGraph()
+	if err != nil {
+		running(r.client, r.job, fmt.Sprintf("Error scheduling the job steps: %s", err.Error()))
+		return messaging.StatusStepFailed, err
+	}
+
+	// Cancelling abortCtx stops the running steps that aren't set to always
+	// run.
+	abortCtx, abort := context.WithCancel(ctx)
+	defer abort()
+
+	var (
+		budget     = r.stepBudget()
+		count      = len(r.job.Steps)
+		states     = make([]stepState, count)
+		results    = make(chan stepResult)
+		active     = 0
+		usedCPUs   float64
+		usedMemory int64
+		status     = messaging.Success
+		statusErr  error
+		failedStep = -1
+		skipped    []int
+	)
+
+	aborted := func() bool {
+		return failedStep >= 0
+	}
+
+	needs := func(idx int) (float64, int64) {
+		c := r.job.Steps[idx].Component.Container
+		return float64(c.MinCPUCores), c.MinMemoryLimit
+	}
+
+	fits := func(idx int) bool {
+		if active == 0 {
+			return true
+		}
+		cpus, memory := needs(idx)
+		if budget.CPUs > 0 && usedCPUs+cpus > budget.CPUs {
+			return false
+		}
+		if budget.Memory > 0 && usedMemory+memory > budget.Memory {
+			return false
+		}
+		return true
+	}
+
+	// skip marks the pending steps that won't be started as skipped. Once a
+	// step has failed, only the steps that always run can still be started.
+	skip := func() {
+		for idx, state := range states {
+			if state == stepPending && (ctx.Err() != nil || !r.opts.Step(idx).AlwaysRun) {
+				states[idx] = stepSkipped
+				skipped = append(skipped, idx)
+			}
+		}
+	}
+
+	ready := func(idx int) bool {
+		if states[idx] != stepPending || ctx.Err() != nil {
+			return false
+		}
+		if aborted() && !r.opts.Step(idx).AlwaysRun {
+			return false
+		}
+		for _, d := range graph.Deps[idx] {
+			if aborted() && !states[d].done() {
+				return false
+			}
+			if !aborted() && states[d] != stepSucceeded && states[d] != stepIgnored {
+				return false
+			}
+		}
+		return true
+	}
+
+	for idx := 0; idx < count; idx++ {
+		if r.stepFinished(idx) {
+			states[idx] = stepSucceeded
+			running(r.client, r.job, fmt.Sprintf("Skipping step %d, it finished before the job was resumed", idx))
+		}
+	}
+
+	for {
+		for idx := 0; idx < count; idx++ {
+			if !ready(idx) || !fits(idx) {
+				continue
+			}
+			states[idx] = stepRunning
+			active++
+			cpus, memory := needs(idx)
+			usedCPUs += cpus
+			usedMemory += memory
+
+			stepCtx := abortCtx
+			if r.opts.Step(idx).AlwaysRun {
+				stepCtx = ctx
+			}
+			go func(stepCtx context.Context, idx int) {
+				s, err := r.runStep(stepCtx, idx)
+				results <- stepResult{index: idx, status: s, err: err}
+			}(stepCtx, idx)
+		}
+
+		if active == 0 {
+			break
+		}
+
+		result := <-results
+		active--
+		cpus, memory := needs(result.index)
+		usedCPUs -= cpus
+		usedMemory -= memory
+
+		switch {
+		case result.err == nil:
+			states[result.index] = stepSucceeded
+			r.recordStep(result.index)
+
+		case aborted() && abortCtx.Err() != nil && !r.opts.Step(result.index).AlwaysRun:
+			states[result.index] = stepFailed
+			running(r.client, r.job, fmt.Sprintf("Step %d was cancelled because step %d failed", result.index, failedStep))
+
+		case r.opts.Step(result.index).OnFailure == OnFailureContinue && ctx.Err() == nil:
+			states[result.index] = stepIgnored
+			note := fmt.Sprintf("Step %d failed but is allowed to fail: %s", result.index, result.err.Error())
+			r.stepNotes = append(r.stepNotes, note)
+			running(r.client, r.job, note)
+
+		default:
+			states[result.index] = stepFailed
+			if !aborted() {
+				status, statusErr, failedStep = result.status, result.err, result.index
+				r.failureMessage = result.err.Error()
+				var stepErr *StepError
+				if errors.As(result.err, &stepErr) {
+					r.failureDetail = stepErr.StderrTail
+				}
+				abort()
+				skip()
+			}
+		}
+	}
+
+	skip()
+	if len(skipped) > 0 {
+		sort.Ints(skipped)
+		note := fmt.Sprintf("Steps %s were skipped", joinInts(skipped))
+		if aborted() {
+			note = fmt.Sprintf("%s because step %d failed", note, failedStep)
+		}
+		r.stepNotes = append(r.stepNotes, note)
+		running(r.client, r.job, note)
+	}
+
+	return status, statusErr
+}
+
+// StepError is returned by runStep when a step's container fails.
+type StepError struct {
+	Err error
+
+	// StderrTail is the redacted end of the step's stderr log, or an empty
+	// string if it couldn't be read.
+	StderrTail string
+}
+
+func (e *StepError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the error from running the step's container.
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// stderrTail returns the last lines of a step's stderr, with secrets redacted.
+// The tool's own stderr log is used if it has anything in it, otherwise the
+// output of the container backend is used. The number of lines and bytes read
+// are set by steps.stderr_tail_lines and steps.stderr_tail_bytes.
+func (r *JobRunner) stderrTail(idx int) string {
+	lines, maxBytes := defaultStderrTailLines, int64(defaultStderrTailBytes)
+	if r.cfg != nil {
+		if r.cfg.IsSet("steps.stderr_tail_lines") {
+			lines = r.cfg.GetInt("steps.stderr_tail_lines")
+		}
+		if r.cfg.IsSet("steps.stderr_tail_bytes") {
+			maxBytes = r.cfg.GetInt64("steps.stderr_tail_bytes")
+		}
+	}
+	if lines <= 0 {
+		return ""
+	}
+
+	step := &r.job.Steps[idx]
+	var tail []string
+	for _, p := range []string{
+		path.Join(r.volumeDir, step.Stderr(strconv.Itoa(idx))),
+		path.Join(r.logsDir, fmt.Sprintf("docker-compose-step-stderr-%d", idx)),
+	} {
+		var err error
+		if tail, err = fs.TailFile(p, lines, maxBytes); err != nil {
+			log.Debug(err)
+		}
+		if len(tail) > 0 {
+			break
+		}
+	}
+	if len(tail) == 0 {
+		return ""
+	}
+
+	redactor, err := r.newRedactor()
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+	return redactor.Redact(strings.Join(tail, "\n"))
+}
+
+// recordStepResult adds how a step's container exited to the runner's list and
+// writes the list out to the logs directory. The result is nil if the
+// container couldn't be run.
+func (r *JobRunner) recordStepResult(idx int, svcname string, result *ServiceResult, err error) {
+	sr := fs.StepResult{Step: idx, Service: svcname}
+	if result != nil {
+		sr.ContainerID = result.ContainerID
+		sr.ExitCode = result.ExitCode
+		sr.OOMKilled = result.OOMKilled
+		if result.Signal != 0 {
+			sr.Signal = int(result.Signal)
+			sr.SignalName = result.Signal.String()
+		}
+		if !result.StartedAt.IsZero() {
+			sr.StartedAt = &result.StartedAt
+		}
+		if !result.FinishedAt.IsZero() {
+			sr.FinishedAt = &result.FinishedAt
+		}
+	}
+	if err != nil {
+		sr.Error = err.Error()
+	}
+
+	r.stepResultsMutex.Lock()
+	defer r.stepResultsMutex.Unlock()
+	r.stepResults = append(r.stepResults, sr)
+	if err := fs.WriteStepResults(fs.FS, r.logsDir, r.stepResults); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/messaging"
+	"github.com/cyverse-de/model"
+	"github.com/spf13/viper"
+)
+
+func TestParseJobOptions(t *testing.T) {
+	opts, err := ParseJobOptions([]byte(`{"steps": [{}, {"depends_on": [0]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.DeclaresDependencies() {
+		t.Error("DeclaresDependencies() returned false")
+	}
+	if !reflect.DeepEqual(opts.Step(1).DependsOn, []int{0}) {
+		t.Errorf("Step(1).DependsOn was %v", opts.Step(1).DependsOn)
+	}
+	if opts.Step(5).DependsOn != nil {
+		t.Errorf("Step(5).DependsOn was %v", opts.Step(5).DependsOn)
+	}
+
+	var empty *JobOptions
+	if empty.DeclaresDependencies() {
+		t.Error("DeclaresDependencies() returned true for nil options")
+	}
+}
+
+func TestJobEgressPolicy(t *testing.T) {
+	cfg := viper.New()
+	cfg.Set("network.egress", "internal")
+	tests := map[string]string{
+		`{}`:                     "internal",
+		`{"egress": "none"}`:     "none",
+		`{"egress": "full"}`:     "internal",
+		`{"egress": "internal"}`: "internal",
+	}
+	for def, expected := range tests {
+		opts, err := ParseJobOptions([]byte(def))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if egress, err := opts.EgressPolicy(cfg); err != nil || egress != expected {
+			t.Errorf("egress for %s was %q, error was %v", def, egress, err)
+		}
+	}
+
+	var empty *JobOptions
+	if egress, err := empty.EgressPolicy(nil); err != nil || egress != "full" {
+		t.Errorf("default egress was %q, error was %v", egress, err)
+	}
+	if _, err := ParseJobOptions([]byte(`{"egress": "everything"}`)); err == nil {
+		t.Error("an unknown egress policy didn't return an error")
+	}
+}
+
+func TestSequentialStepGraph(t *testing.T) {
+	g := SequentialStepGraph(3)
+	expected := [][]int{nil, {0}, {1}}
+	if !reflect.DeepEqual(g.Deps, expected) {
+		t.Errorf("Deps was %v instead of %v", g.Deps, expected)
+	}
+}
+
+func TestNewStepGraphInferred(t *testing.T) {
+	job := stepsJob(3)
+	job.Steps[0].Config.Outputs = []model.StepOutput{{Name: "results/out.txt"}}
+	job.Steps[2].Config.Inputs = []model.StepInput{{Value: "out.txt"}}
+
+	g, err := NewStepGraph(job, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]int{nil, nil, {0}}
+	if !reflect.DeepEqual(g.Deps, expected) {
+		t.Errorf("Deps was %v instead of %v", g.Deps, expected)
+	}
+}
+
+func TestNewStepGraphDeclared(t *testing.T) {
+	opts := &JobOptions{Steps: []StepOptions{{}, {DependsOn: []int{2}}, {}}}
+	g, err := NewStepGraph(stepsJob(3), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := g.Order()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []int{0, 2, 1}) {
+		t.Errorf("order was %v", order)
+	}
+}
+
+func TestNewStepGraphErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *JobOptions
+		msg  string
+	}{
+		{"missing", &JobOptions{Steps: []StepOptions{{DependsOn: []int{3}}}}, "invalid dependency"},
+		{"self", &JobOptions{Steps: []StepOptions{{DependsOn: []int{0}}}}, "invalid dependency"},
+		{"cycle", &JobOptions{Steps: []StepOptions{{DependsOn: []int{1}}, {DependsOn: []int{0}}}}, "cycle"},
+	}
+	for _, tt := range tests {
+		_, err := NewStepGraph(stepsJob(2), tt.opts)
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s: error was %v", tt.name, err)
+		}
+	}
+}
+
+// concurrencyBackend tracks the greatest number of services that ran at the
+// same time.
+type concurrencyBackend struct {
+	testBackend
+	mu      sync.Mutex
+	current int
+	max     int
+}
+
+func (b *concurrencyBackend) track(ctx context.Context, svcname string) (*ServiceResult, error) {
+	b.mu.Lock()
+	b.current++
+	if b.current > b.max {
+		b.max = b.current
+	}
+	b.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	b.mu.Lock()
+	b.current--
+	b.mu.Unlock()
+	return &ServiceResult{}, nil
+}
+
+func TestRunAllStepsConcurrently(t *testing.T) {
+	job := stepsJob(4)
+	for i := range job.Steps {
+		job.Steps[i].Component.Container.MinCPUCores = 1
+	}
+
+	cfg := viper.New()
+	cfg.Set("steps.parallel", true)
+	cfg.Set("steps.max_cpus", 2)
+
+	backend := &concurrencyBackend{}
+	backend.run = backend.track
+	r, _ := newTestRunner(t, job, backend)
+	r.cfg = cfg
+
+	status, err := r.runAllSteps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != messaging.Success {
+		t.Errorf("status was %d", status)
+	}
+	if len(backend.services) != 4 {
+		t.Errorf("%d services were run instead of 4", len(backend.services))
+	}
+	if backend.max != 2 {
+		t.Errorf("%d steps ran at once instead of 2", backend.max)
+	}
+}
+
+func TestRunAllStepsSequentialByDefault(t *testing.T) {
+	backend := &concurrencyBackend{}
+	backend.run = backend.track
+	r, _ := newTestRunner(t, stepsJob(3), backend)
+
+	if _, err := r.runAllSteps(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if backend.max != 1 {
+		t.Errorf("%d steps ran at once instead of 1", backend.max)
+	}
+	expected := []string{"step_0", "step_1", "step_2"}
+	if !reflect.DeepEqual(backend.services, expected) {
+		t.Errorf("services were %v instead of %v", backend.services, expected)
+	}
+}
+
+func TestRunAllStepsCancelsOnFailure(t *testing.T) {
+	// Step 1 fails while step 0 is running, and step 2 depends on step 1.
+	job := stepsJob(3)
+	opts := &JobOptions{Steps: []StepOptions{{}, {}, {DependsOn: []int{1}}}}
+
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			if svcname == "step_1" {
+				return &ServiceResult{ExitCode: 1}, errors.New("step failed")
+			}
+			return blockUntilDone(ctx, svcname)
+		},
+	}
+	r, _ := newTestRunner(t, job, backend)
+	r.opts = opts
+
+	status, err := r.runAllSteps(context.Background())
+	if err == nil {
+		t.Fatal("no error was returned")
+	}
+	if status != messaging.StatusStepFailed {
+		t.Errorf("status was %d", status)
+	}
+	for _, svcname := range backend.services {
+		if svcname == "step_2" {
+			t.Error("step_2 was run after step_1 failed")
+		}
+	}
+}
+
+// failSteps returns a backend where the named step services fail.
+func failSteps(svcnames ...string) *testBackend {
+	return &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			if containsString(svcnames, svcname) {
+				return &ServiceResult{ExitCode: 1}, errors.New("exit status 1")
+			}
+			return &ServiceResult{}, nil
+		},
+	}
+}
+
+func TestParseJobOptionsOnFailure(t *testing.T) {
+	opts, err := ParseJobOptions([]byte(`{"steps": [{"on_failure": "continue", "always_run": true}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Step(0).OnFailure != OnFailureContinue || !opts.Step(0).AlwaysRun {
+		t.Errorf("step options were %+v", opts.Step(0))
+	}
+
+	if _, err = ParseJobOptions([]byte(`{"steps": [{"on_failure": "retry"}]}`)); err == nil {
+		t.Error("no error was returned for an unknown on_failure setting")
+	}
+}
+
+func TestRunAllStepsContinueOnFailure(t *testing.T) {
+	backend := failSteps("step_0")
+	r, _ := newTestRunner(t, stepsJob(2), backend)
+	r.opts = &JobOptions{Steps: []StepOptions{{OnFailure: OnFailureContinue}}}
+
+	status, err := r.runAllSteps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != messaging.Success {
+		t.Errorf("status was %d", status)
+	}
+	if !reflect.DeepEqual(backend.services, []string{"step_0", "step_1"}) {
+		t.Errorf("services were %v", backend.services)
+	}
+	if len(r.stepNotes) != 1 || !strings.Contains(r.stepNotes[0], "Step 0 failed but is allowed to fail") {
+		t.Errorf("notes were %v", r.stepNotes)
+	}
+}
+
+func TestRunAllStepsAlwaysRun(t *testing.T) {
+	backend := failSteps("step_0")
+	r, _ := newTestRunner(t, stepsJob(4), backend)
+	r.opts = &JobOptions{Steps: []StepOptions{{}, {}, {}, {AlwaysRun: true}}}
+
+	status, err := r.runAllSteps(context.Background())
+	if err == nil {
+		t.Fatal("no error was returned")
+	}
+	if status != messaging.StatusStepFailed {
+		t.Errorf("status was %d", status)
+	}
+	if !reflect.DeepEqual(backend.services, []string{"step_0", "step_3"}) {
+		t.Errorf("services were %v", backend.services)
+	}
+	expected := []string{"Steps 1, 2 were skipped because step 0 failed"}
+	if !reflect.DeepEqual(r.stepNotes, expected) {
+		t.Errorf("notes were %v instead of %v", r.stepNotes, expected)
+	}
+}
+
+func TestRunAllStepsAlwaysRunNotCancelled(t *testing.T) {
+	// Step 1 always runs, so it isn't stopped when step 0 fails.
+	var finished bool
+	backend := &testBackend{
+		run: func(ctx context.Context, svcname string) (*ServiceResult, error) {
+			switch svcname {
+			case "step_0":
+				time.Sleep(20 * time.Millisecond)
+				return &ServiceResult{ExitCode: 1}, errors.New("exit status 1")
+			case "step_1":
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(100 * time.Millisecond):
+					finished = true
+				}
+			}
+			return &ServiceResult{}, nil
+		},
+	}
+	r, _ := newTestRunner(t, stepsJob(2), backend)
+	r.opts = &JobOptions{Steps: []StepOptions{{DependsOn: []int{}}, {DependsOn: []int{}, AlwaysRun: true}}}
+
+	if _, err := r.runAllSteps(context.Background()); err == nil {
+		t.Fatal("no error was returned")
+	}
+	if !finished {
+		t.Error("step_1 was cancelled")
+	}
+}
+
+func TestRunAllStepsAlwaysRunJobStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	backend := &testBackend{
+		run: func(c context.Context, svcname string) (*ServiceResult, error) {
+			cancel()
+			return blockUntilDone(c, svcname)
+		},
+	}
+	r, _ := newTestRunner(t, stepsJob(2), backend)
+	r.opts = &JobOptions{Steps: []StepOptions{{}, {AlwaysRun: true}}}
+
+	if _, err := r.runAllSteps(ctx); err == nil {
+		t.Fatal("no error was returned")
+	}
+	if !reflect.DeepEqual(backend.services, []string{"step_0"}) {
+		t.Errorf("services were %v", backend.services)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// defaultRegistry is the registry used for image references that don't name
+// one.
+const defaultRegistry = "docker.io"
+
+// TrustPolicy controls which images a job is allowed to run. It's read from
+// the file named by images.trust_policy.
+type TrustPolicy struct {
+	// Allowed lists the registries, repositories or images that the job's
+	// images have to come from, such as "harbor.cyverse.org" or
+	// "discoenv/*". Everything that isn't denied is allowed if it's empty.
+	Allowed []string `yaml:"allowed"`
+
+	// Denied lists the registries, repositories or images that can't be used,
+	// such as "discoenv/tool:1.0" or "discoenv/tool@sha256:...".
+	Denied []string `yaml:"denied"`
+
+	// Keys are the paths to PEM-encoded ECDSA public keys. When any are
+	// listed, every image has to have a cosign signature made with one of
+	// them. Relative paths are relative to the policy file.
+	Keys []string `yaml:"keys"`
+
+	// OCILayout is an OCI image layout directory to read the signatures from.
+	// They're read from the image's own registry if it's empty.
+	OCILayout string `yaml:"oci_layout"`
+
+	// InsecureRegistries are the registries that signatures are read from
+	// over plain HTTP, such as "localhost:5000".
+	InsecureRegistries []string `yaml:"insecure_registries"`
+
+	keys []*ecdsa.PublicKey
+}
+
+// loadTrustPolicy reads the trust policy named by images.trust_policy.
+// Returns nil if there isn't one.
+func loadTrustPolicy(cfg *viper.Viper) (*TrustPolicy, error) {
+	if cfg == nil || cfg.GetString("images.trust_policy") == "" {
+		return nil, nil
+	}
+	policyPath := cfg.GetString("images.trust_policy")
+	b, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the trust policy %s", policyPath)
+	}
+	p := &TrustPolicy{}
+	if err = yaml.UnmarshalStrict(b, p); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the trust policy %s", policyPath)
+	}
+
+	for _, keyPath := range p.Keys {
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(filepath.Dir(policyPath), keyPath)
+		}
+		key, err := readPublicKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		p.keys = append(p.keys, key)
+	}
+	if p.OCILayout != "" && !filepath.IsAbs(p.OCILayout) {
+		p.OCILayout = filepath.Join(filepath.Dir(policyPath), p.OCILayout)
+	}
+	return p, nil
+}
+
+// readPublicKey reads a PEM-encoded ECDSA public key, like the ones written by
+// "cosign generate-key-pair".
+func readPublicKey(keyPath string) (*ecdsa.PublicKey, error) {
+	b, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the public key %s", keyPath)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s doesn't contain a PEM-encoded public key", keyPath)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the public key %s", keyPath)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an ECDSA public key", keyPath)
+	}
+	return ecKey, nil
+}
+
+// imageRef is an image reference split into its parts.
+type imageRef struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// isRegistry returns true if the first component of an image reference names
+// a registry rather than a repository on the default registry.
+func isRegistry(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+// qualifyName adds the default registry to a name that doesn't include one,
+// along with the "library" namespace for official images.
+func qualifyName(name string) string {
+	parts := strings.SplitN(name, "/", 2)
+	switch {
+	case isRegistry(parts[0]):
+		return name
+	case len(parts) == 1:
+		return defaultRegistry + "/library/" + name
+	default:
+		return defaultRegistry + "/" + name
+	}
+}
+
+// parseImageRef splits an image reference, filling in the default registry.
+func parseImageRef(ref string) imageRef {
+	var r imageRef
+	name := ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, r.Digest = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, r.Tag = name[:i], name[i+1:]
+	}
+	name = qualifyName(name)
+	i := strings.Index(name, "/")
+	r.Registry, r.Repository = name[:i], name[i+1:]
+	return r
+}
+
+// Name returns the registry and repository.
+func (r imageRef) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+// matchesPattern returns true if the pattern from the trust policy covers the
+// image. A pattern can name a registry, a namespace or repository in a
+// registry, or a single tag or digest, and can contain path.Match wildcards.
+func matchesPattern(pattern string, r imageRef) bool {
+	pattern = qualifyName(pattern)
+	name := r.Name()
+	if pattern == r.Registry || strings.HasPrefix(name, pattern+"/") {
+		return true
+	}
+	candidates := []string{name}
+	if r.Tag != "" {
+		candidates = append(candidates, name+":"+r.Tag)
+	}
+	if r.Digest != "" {
+		candidates = append(candidates, name+"@"+r.Digest)
+	}
+	for _, c := range candidates {
+		if c == pattern {
+			return true
+		}
+		if ok, _ := path.Match(pattern, c); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// PolicyError is returned when an image isn't allowed by the trust policy.
+type PolicyError struct {
+	Image  string
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return fmt.Sprintf("Image %s isn't allowed to run by the image trust policy: %s", e.Image, e.Reason)
+}
+
+// check returns a PolicyError if the image isn't allowed. The digest is the
+// digest of the image that was pulled, or an empty string if it's unknown.
+func (p *TrustPolicy) check(ctx context.Context, image, digest string) error {
+	r := parseImageRef(image)
+	if r.Digest == "" {
+		r.Digest = digest
+	}
+	for _, pattern := range p.Denied {
+		if matchesPattern(pattern, r) {
+			return &PolicyError{Image: image, Reason: fmt.Sprintf("it matches %q, which is denied", pattern)}
+		}
+	}
+	if len(p.Allowed) > 0 {
+		allowed := false
+		for _, pattern := range p.Allowed {
+			if matchesPattern(pattern, r) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &PolicyError{Image: image, Reason: "it isn't from one of the allowed registries or repositories"}
+		}
+	}
+	if len(p.keys) == 0 {
+		return nil
+	}
+	if r.Digest == "" {
+		return &PolicyError{Image: image, Reason: "its digest is unknown, so its signature can't be verified"}
+	}
+	if err := p.verifySignature(ctx, r); err != nil {
+		return &PolicyError{Image: image, Reason: err.Error()}
+	}
+	return nil
+}
+
+// enforceTrustPolicy checks every image used by the job's services against
+// the trust policy, if there is one. It has to run after the images are pulled
+// and pinned so that their digests are known.
+func (r *JobRunner) enforceTrustPolicy(ctx context.Context) error {
+	policy, err := loadTrustPolicy(r.cfg)
+	if err != nil || policy == nil {
+		return err
+	}
+	lister, ok := r.backend.(imageLister)
+	if !ok {
+		return errors.New("the trust policy can't be enforced because the container backend can't list the job's images")
+	}
+
+	// Check the references from the job rather than the pinned ones, so that
+	// tags can be denied.
+	original := make(map[string]string)
+	for image, p := range r.pinnedImages {
+		original[p.Reference] = image
+	}
+	var digests map[string]string
+	if inspector, ok := r.backend.(imageInspector); ok {
+		if digests, err = inspector.ImageDigests(ctx); err != nil {
+			return err
+		}
+	}
+
+	for _, image := range lister.Images() {
+		digest := digests[image]
+		if orig, ok := original[image]; ok {
+			digest = r.pinnedImages[orig].Digest
+			image = orig
+		}
+		if err = policy.check(ctx, image, digest); err != nil {
+			var pErr *PolicyError
+			if errors.As(err, &pErr) {
+				r.failureMessage = pErr.Error()
+				running(r.client, r.job, r.failureMessage)
+			}
+			return err
+		}
+	}
+	running(r.client, r.job, "All of the job's images are allowed by the image trust policy")
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseImageRef(t *testing.T) {
+	tests := map[string]imageRef{
+		"alpine":                              {Registry: "docker.io", Repository: "library/alpine"},
+		"discoenv/tool:1.0":                   {Registry: "docker.io", Repository: "discoenv/tool", Tag: "1.0"},
+		"harbor.cyverse.org/de/tool@sha256:a": {Registry: "harbor.cyverse.org", Repository: "de/tool", Digest: "sha256:a"},
+		"localhost:5000/tool:2":               {Registry: "localhost:5000", Repository: "tool", Tag: "2"},
+	}
+	for ref, expected := range tests {
+		if actual := parseImageRef(ref); actual != expected {
+			t.Errorf("parseImageRef(%q) was %+v instead of %+v", ref, actual, expected)
+		}
+	}
+}
+
+func TestMatchesPattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		image    string
+		expected bool
+	}{
+		{"harbor.cyverse.org", "harbor.cyverse.org/de/tool:1.0", true},
+		{"harbor.cyverse.org", "docker.io/de/tool:1.0", false},
+		{"discoenv", "discoenv/tool:1.0", false},
+		{"docker.io/discoenv", "discoenv/tool:1.0", true},
+		{"discoenv/*", "discoenv/tool:1.0", true},
+		{"discoenv/*", "other/tool:1.0", false},
+		{"discoenv/tool", "discoenv/tool:2.0", true},
+		{"discoenv/tool:1.0", "discoenv/tool:1.0", true},
+		{"discoenv/tool:1.0", "discoenv/tool:2.0", false},
+		{"alpine", "alpine:3", true},
+		{"discoenv/tool@sha256:a", "discoenv/tool@sha256:a", true},
+	}
+	for _, tt := range tests {
+		if actual := matchesPattern(tt.pattern, parseImageRef(tt.image)); actual != tt.expected {
+			t.Errorf("matchesPattern(%q, %q) was %v", tt.pattern, tt.image, actual)
+		}
+	}
+}
+
+func TestTrustPolicyAllowDeny(t *testing.T) {
+	p := &TrustPolicy{
+		Allowed: []string{"harbor.cyverse.org", "discoenv/*"},
+		Denied:  []string{"discoenv/bad:1.0", "discoenv/tool@sha256:bad"},
+	}
+	tests := map[string]bool{
+		"harbor.cyverse.org/de/tool:1.0": true,
+		"discoenv/porklock:latest":       true,
+		"discoenv/bad:1.0":               false,
+		"discoenv/bad:2.0":               true,
+		"ubuntu:22.04":                   false,
+	}
+	for image, allowed := range tests {
+		err := p.check(context.Background(), image, "sha256:good")
+		if (err == nil) != allowed {
+			t.Errorf("check(%q) returned %v", image, err)
+		}
+	}
+	if err := p.check(context.Background(), "discoenv/tool:1.0", "sha256:bad"); err == nil {
+		t.Error("a denied digest was allowed")
+	}
+}
+
+// signedImage writes an OCI layout to dir containing a cosign signature for
+// the digest made with key, and returns the layout's blobs keyed by digest
+// along with the signature manifest.
+func signedImage(t *testing.T, dir, digest string, key *ecdsa.PrivateKey) (map[string][]byte, []byte) {
+	blobs := make(map[string][]byte)
+	addBlob := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		d := "sha256:" + hex.EncodeToString(sum[:])
+		blobs[d] = b
+		return d
+	}
+
+	payload := []byte(`{"critical":{"identity":{"docker-reference":"discoenv/tool"},"image":{"docker-manifest-digest":"` + digest + `"},"type":"cosign container image signature"},"optional":null}`)
+	sum := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"layers": []ociDescriptor{{
+			MediaType:   "application/vnd.dev.cosign.simplesigning.v1+json",
+			Digest:      addBlob(payload),
+			Size:        int64(len(payload)),
+			Annotations: map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := json.Marshal(ociIndex{Manifests: []ociDescriptor{{
+		MediaType:   "application/vnd.oci.image.manifest.v1+json",
+		Digest:      addBlob(manifest),
+		Annotations: map[string]string{ociRefNameAnnotation: signatureTag(digest)},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for d, b := range blobs {
+		if err = os.WriteFile(filepath.Join(dir, "blobs", "sha256", strings.TrimPrefix(d, "sha256:")), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.WriteFile(filepath.Join(dir, "index.json"), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return blobs, manifest
+}
+
+// writePublicKey writes out the key's public half in PEM format.
+func writePublicKey(t *testing.T, p string, key *ecdsa.PrivateKey) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// trustPolicyConfig writes out the policy and returns a config pointing to it.
+func trustPolicyConfig(t *testing.T, dir, policy string) *viper.Viper {
+	p := filepath.Join(dir, "policy.yml")
+	if err := os.WriteFile(p, []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := viper.New()
+	cfg.Set("images.trust_policy", p)
+	return cfg
+}
+
+const testImageDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestTrustPolicySignaturesOCILayout(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signedImage(t, filepath.Join(dir, "layout"), testImageDigest, key)
+	writePublicKey(t, filepath.Join(dir, "trusted.pub"), key)
+	writePublicKey(t, filepath.Join(dir, "other.pub"), other)
+
+	p, err := loadTrustPolicy(trustPolicyConfig(t, dir, "keys: [trusted.pub]\noci_layout: layout\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.check(context.Background(), "discoenv/tool:1.0", testImageDigest); err != nil {
+		t.Errorf("a signed image wasn't allowed: %v", err)
+	}
+	if err = p.check(context.Background(), "discoenv/tool:1.0", "sha256:"+strings.Repeat("f", 64)); err == nil {
+		t.Error("an unsigned image was allowed")
+	}
+	if err = p.check(context.Background(), "discoenv/tool:1.0", ""); err == nil {
+		t.Error("an image without a digest was allowed")
+	}
+
+	p, err = loadTrustPolicy(trustPolicyConfig(t, dir, "keys: [other.pub]\noci_layout: layout\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.check(context.Background(), "discoenv/tool:1.0", testImageDigest); err == nil {
+		t.Error("an image signed with an untrusted key was allowed")
+	}
+}
+
+func TestTrustPolicySignaturesRegistry(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, manifest := signedImage(t, filepath.Join(dir, "layout"), testImageDigest, key)
+	writePublicKey(t, filepath.Join(dir, "trusted.pub"), key)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/v2/de/tool/manifests/"+signatureTag(testImageDigest):
+			w.Write(manifest)
+		case strings.HasPrefix(req.URL.Path, "/v2/de/tool/blobs/"):
+			b, ok := blobs[strings.TrimPrefix(req.URL.Path, "/v2/de/tool/blobs/")]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			w.Write(b)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	registry := strings.TrimPrefix(server.URL, "http://")
+
+	p, err := loadTrustPolicy(trustPolicyConfig(t, dir, "keys: [trusted.pub]\ninsecure_registries: ['"+registry+"']\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.check(context.Background(), registry+"/de/tool:1.0", testImageDigest); err != nil {
+		t.Errorf("a signed image wasn't allowed: %v", err)
+	}
+	if err = p.check(context.Background(), registry+"/de/other:1.0", testImageDigest); err == nil {
+		t.Error("an unsigned image was allowed")
+	}
+}
+
+func TestLoadTrustPolicyErrors(t *testing.T) {
+	dir := t.TempDir()
+	if p, err := loadTrustPolicy(viper.New()); p != nil || err != nil {
+		t.Errorf("policy was %v, error was %v", p, err)
+	}
+	for _, policy := range []string{"keys: [missing.pub]\n", "allowed: [a]\nunknown: true\n"} {
+		if _, err := loadTrustPolicy(trustPolicyConfig(t, dir, policy)); err == nil {
+			t.Errorf("no error was returned for %q", policy)
+		}
+	}
+}
+
+// listingBackend is a pinningBackend that can list its images.
+type listingBackend struct {
+	pinningBackend
+	images []string
+}
+
+func (b *listingBackend) Images() []string {
+	return b.images
+}
+
+func TestEnforceTrustPolicy(t *testing.T) {
+	backend := &listingBackend{images: []string{"discoenv/porklock@sha256:a", "discoenv/tool:1.0"}}
+	r, _ := newTestRunner(t, stepsJob(1), backend)
+	r.pinnedImages = map[string]PinnedImage{
+		"discoenv/porklock:latest": {Digest: "sha256:a", Reference: "discoenv/porklock@sha256:a"},
+	}
+
+	r.cfg = trustPolicyConfig(t, t.TempDir(), "allowed: [discoenv/*]\n")
+	if err := r.enforceTrustPolicy(context.Background()); err != nil {
+		t.Errorf("the images weren't allowed: %v", err)
+	}
+
+	// Tags are checked against the references from the job.
+	r.cfg = trustPolicyConfig(t, t.TempDir(), "denied: ['discoenv/porklock:latest']\n")
+	err := r.enforceTrustPolicy(context.Background())
+	if err == nil {
+		t.Fatal("a denied image was allowed")
+	}
+	expected := `Image discoenv/porklock:latest isn't allowed to run by the image trust policy: it matches "discoenv/porklock:latest", which is denied`
+	if r.failureMessage != expected {
+		t.Errorf("failure message was %q", r.failureMessage)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/road-runner/fs"
+	"github.com/pkg/errors"
+)
+
+// defaultCgroupRoot is where the cgroup filesystem is normally mounted.
+const defaultCgroupRoot = "/sys/fs/cgroup"
+
+// defaultUsageInterval is how often a step's cgroup is sampled by default.
+const defaultUsageInterval = 2 * time.Second
+
+// cgroupStats is a single sample of a container's cgroup. Values that
+// couldn't be read are left at zero.
+type cgroupStats struct {
+	Memory     int64
+	PeakMemory int64
+	CPUSeconds float64
+	BlockRead  int64
+	BlockWrite int64
+	Pids       int64
+	PeakPids   int64
+}
+
+// findCgroupDir looks for the cgroup directory for the container under base.
+// Docker and podman name it after the container ID, for example
+// system.slice/docker-<id>.scope or docker/<id>, depending on the cgroup
+// driver.
+func findCgroupDir(base, id string) (string, error) {
+	for _, pattern := range []string{"*%s*", "*/*%s*", "*/*/*%s*"} {
+		matches, err := filepath.Glob(filepath.Join(base, fmt.Sprintf(pattern, id)))
+		if err != nil {
+			return "", err
+		}
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && info.IsDir() {
+				return m, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no cgroup found for container %s under %s", id, base)
+}
+
+// readInt reads a file containing a single integer. A missing file reads as
+// zero.
+func readInt(p string) (int64, error) {
+	b, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v := strings.TrimSpace(string(b))
+	if v == "max" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+// readFields calls fn with the fields of every line in the file. A missing
+// file is skipped.
+func readFields(p string, fn func(fields []string)) error {
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fn(strings.Fields(scanner.Text()))
+	}
+	return scanner.Err()
+}
+
+// readCgroup samples the container's cgroup under root, which can either be a
+// cgroup v2 unified hierarchy or a set of cgroup v1 controllers.
+func readCgroup(root, id string) (*cgroupStats, error) {
+	if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err == nil {
+		dir, err := findCgroupDir(root, id)
+		if err != nil {
+			return nil, err
+		}
+		return readCgroupV2(dir)
+	}
+	return readCgroupV1(root, id)
+}
+
+func readCgroupV2(dir string) (*cgroupStats, error) {
+	var (
+		stats = &cgroupStats{}
+		err   error
+	)
+	if stats.Memory, err = readInt(filepath.Join(dir, "memory.current")); err != nil {
+		return nil, err
+	}
+	if stats.PeakMemory, err = readInt(filepath.Join(dir, "memory.peak")); err != nil {
+		return nil, err
+	}
+	if stats.Pids, err = readInt(filepath.Join(dir, "pids.current")); err != nil {
+		return nil, err
+	}
+	if stats.PeakPids, err = readInt(filepath.Join(dir, "pids.peak")); err != nil {
+		return nil, err
+	}
+	err = readFields(filepath.Join(dir, "cpu.stat"), func(fields []string) {
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usec, _ := strconv.ParseInt(fields[1], 10, 64)
+			stats.CPUSeconds = float64(usec) / 1e6
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = readFields(filepath.Join(dir, "io.stat"), func(fields []string) {
+		for _, f := range fields[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			n, _ := strconv.ParseInt(kv[1], 10, 64)
+			switch kv[0] {
+			case "rbytes":
+				stats.BlockRead += n
+			case "wbytes":
+				stats.BlockWrite += n
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func readCgroupV1(root, id string) (*cgroupStats, error) {
+	stats := &cgroupStats{}
+
+	dir, err := findCgroupDir(filepath.Join(root, "memory"), id)
+	if err != nil {
+		return nil, err
+	}
+	if stats.Memory, err = readInt(filepath.Join(dir, "memory.usage_in_bytes")); err != nil {
+		return nil, err
+	}
+	if stats.PeakMemory, err = readInt(filepath.Join(dir, "memory.max_usage_in_bytes")); err != nil {
+		return nil, err
+	}
+
+	// The other controllers are optional.
+	if dir, err = findCgroupDir(filepath.Join(root, "cpuacct"), id); err == nil {
+		var nsec int64
+		if nsec, err = readInt(filepath.Join(dir, "cpuacct.usage")); err != nil {
+			return nil, err
+		}
+		stats.CPUSeconds = float64(nsec) / 1e9
+	}
+	if dir, err = findCgroupDir(filepath.Join(root, "pids"), id); err == nil {
+		if stats.Pids, err = readInt(filepath.Join(dir, "pids.current")); err != nil {
+			return nil, err
+		}
+	}
+	if dir, err = findCgroupDir(filepath.Join(root, "blkio"), id); err == nil {
+		err = readFields(filepath.Join(dir, "blkio.throttle.io_service_bytes"), func(fields []string) {
+			if len(fields) != 3 {
+				return
+			}
+			n, _ := strconv.ParseInt(fields[2], 10, 64)
+			switch fields[1] {
+			case "Read":
+				stats.BlockRead += n
+			case "Write":
+				stats.BlockWrite += n
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stats, nil
+}
+
+// addSample folds a sample into the usage. The cgroup is removed when the
+// container exits, so the totals from the last sample are the best that's
+// available.
+func addSample(u *fs.ResourceUsage, stats *cgroupStats) {
+	u.SampleCount++
+	u.PeakMemory = maxInt64(u.PeakMemory, stats.Memory, stats.PeakMemory)
+	u.PeakPids = maxInt64(u.PeakPids, stats.Pids, stats.PeakPids)
+	if stats.CPUSeconds > u.CPUSeconds {
+		u.CPUSeconds = stats.CPUSeconds
+	}
+	u.BlockRead = maxInt64(u.BlockRead, stats.BlockRead)
+	u.BlockWrite = maxInt64(u.BlockWrite, stats.BlockWrite)
+}
+
+func maxInt64(values ...int64) int64 {
+	var m int64
+	for _, v := range values {
+		if v > m {
+			m = v
+		}
+	}
+	return m
+}
+
+// formatBytes formats a byte count using binary units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// usageSummary returns a one-line summary of the usage for status updates.
+func usageSummary(u *fs.ResourceUsage) string {
+	return fmt.Sprintf(
+		"peak memory %s, CPU time %.1fs, block I/O %s read / %s written, peak pids %d",
+		formatBytes(u.PeakMemory),
+		u.CPUSeconds,
+		formatBytes(u.BlockRead),
+		formatBytes(u.BlockWrite),
+		u.PeakPids,
+	)
+}
+
+// usageSampler samples the cgroup of a step's container until it's stopped.
+type usageSampler struct {
+	locator  containerLocator
+	root     string
+	interval time.Duration
+	svcname  string
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu    sync.Mutex
+	id    string
+	usage fs.ResourceUsage
+}
+
+// sampleUsage starts sampling the resource usage of the service's container.
+// Returns nil if the backend can't find the containers it runs.
+func (r *JobRunner) sampleUsage(ctx context.Context, idx int, svcname string) *usageSampler {
+	locator, ok := r.backend.(containerLocator)
+	if !ok {
+		return nil
+	}
+	s := &usageSampler{
+		locator:  locator,
+		root:     defaultCgroupRoot,
+		interval: defaultUsageInterval,
+		svcname:  svcname,
+		done:     make(chan struct{}),
+		usage:    fs.ResourceUsage{Step: idx, Service: svcname},
+	}
+	if r.cfg != nil {
+		if r.cfg.IsSet("usage.cgroup_root") {
+			s.root = r.cfg.GetString("usage.cgroup_root")
+		}
+		if d := r.cfg.GetDuration("usage.interval"); d > 0 {
+			s.interval = d
+		}
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	go s.run(ctx)
+	return s
+}
+
+func (s *usageSampler) run(ctx context.Context) {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.sample(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample takes one sample, looking up the container first if needed. Errors
+// are only logged, since the container may not have started yet or may have
+// already exited.
+func (s *usageSampler) sample(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.id == "" {
+		id, err := s.locator.ContainerID(ctx, s.svcname)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Debug(err)
+			}
+			return
+		}
+		if s.id = id; id == "" {
+			return
+		}
+	}
+	stats, err := readCgroup(s.root, s.id)
+	if err != nil {
+		log.Debug(errors.Wrapf(err, "failed to sample the resource usage of %s", s.svcname))
+		return
+	}
+	addSample(&s.usage, stats)
+}
+
+// stop stops sampling and returns the usage collected for the service.
+func (s *usageSampler) stop(elapsed time.Duration) fs.ResourceUsage {
+	s.cancel()
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.usage.Duration = elapsed
+	return s.usage
+}
+
+// recordUsage adds a step's resource usage to the runner's list and writes
+// the list out to the logs directory.
+func (r *JobRunner) recordUsage(u fs.ResourceUsage) {
+	r.usageMutex.Lock()
+	defer r.usageMutex.Unlock()
+	r.usage = append(r.usage, u)
+	if err := fs.WriteResourceUsage(fs.FS, r.logsDir, r.usage); err != nil {
+		log.Error(err)
+	}
+}
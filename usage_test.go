@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const testContainerID = "0123456789abcdef"
+
+// writeFiles creates the files under dir with the given contents.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadCgroupV2(t *testing.T) {
+	root := t.TempDir()
+	scope := "system.slice/docker-" + testContainerID + ".scope/"
+	writeFiles(t, root, map[string]string{
+		"cgroup.controllers":     "cpu io memory pids\n",
+		scope + "memory.current": "1000\n",
+		scope + "memory.peak":    "4096\n",
+		scope + "pids.current":   "2\n",
+		scope + "pids.peak":      "5\n",
+		scope + "cpu.stat":       "usage_usec 2500000\nuser_usec 2000000\n",
+		scope + "io.stat":        "8:0 rbytes=100 wbytes=20 rios=1 wios=1\n8:16 rbytes=1 wbytes=2\n",
+	})
+
+	stats, err := readCgroup(root, testContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := cgroupStats{Memory: 1000, PeakMemory: 4096, CPUSeconds: 2.5, BlockRead: 101, BlockWrite: 22, Pids: 2, PeakPids: 5}
+	if *stats != expected {
+		t.Errorf("stats were %+v instead of %+v", *stats, expected)
+	}
+}
+
+func TestReadCgroupV1(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"memory/docker/" + testContainerID + "/memory.usage_in_bytes":          "1000\n",
+		"memory/docker/" + testContainerID + "/memory.max_usage_in_bytes":      "4096\n",
+		"cpuacct/docker/" + testContainerID + "/cpuacct.usage":                 "1500000000\n",
+		"pids/docker/" + testContainerID + "/pids.current":                     "3\n",
+		"blkio/docker/" + testContainerID + "/blkio.throttle.io_service_bytes": "8:0 Read 100\n8:0 Write 20\n8:0 Total 120\nTotal 120\n",
+	})
+
+	stats, err := readCgroup(root, testContainerID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := cgroupStats{Memory: 1000, PeakMemory: 4096, CPUSeconds: 1.5, BlockRead: 100, BlockWrite: 20, Pids: 3}
+	if *stats != expected {
+		t.Errorf("stats were %+v instead of %+v", *stats, expected)
+	}
+}
+
+func TestReadCgroupMissing(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{"cgroup.controllers": "memory\n"})
+	if _, err := readCgroup(root, testContainerID); err == nil {
+		t.Error("no error was returned")
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1536:                   "1.5 KiB",
+		3 * 1024 * 1024 * 1024: "3.0 GiB",
+	}
+	for n, expected := range tests {
+		if actual := formatBytes(n); actual != expected {
+			t.Errorf("formatBytes(%d) was %q instead of %q", n, actual, expected)
+		}
+	}
+}
+
+// locatingBackend is a testBackend that reports a container ID for every
+// service.
+type locatingBackend struct {
+	testBackend
+}
+
+func (b *locatingBackend) ContainerID(ctx context.Context, svcname string) (string, error) {
+	return testContainerID, nil
+}
+
+func TestRunStepRecordsUsage(t *testing.T) {
+	root := t.TempDir()
+	scope := "system.slice/docker-" + testContainerID + ".scope/"
+	writeFiles(t, root, map[string]string{
+		"cgroup.controllers":  "cpu io memory pids\n",
+		scope + "memory.peak": "2097152\n",
+		scope + "pids.peak":   "4\n",
+		scope + "cpu.stat":    "usage_usec 1000000\n",
+	})
+
+	backend := &locatingBackend{}
+	backend.run = func(ctx context.Context, svcname string) (*ServiceResult, error) {
+		time.Sleep(30 * time.Millisecond)
+		return &ServiceResult{}, nil
+	}
+	r, client := newTestRunner(t, stepsJob(1), backend)
+	r.cfg = viper.New()
+	r.cfg.Set("usage.cgroup_root", root)
+	r.cfg.Set("usage.interval", "10ms")
+
+	if _, err := r.runStep(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.usage) != 1 || r.usage[0].PeakMemory != 2097152 || r.usage[0].PeakPids != 4 {
+		t.Errorf("usage was %+v", r.usage)
+	}
+	b, err := os.ReadFile(filepath.Join(r.logsDir, "ResourceUsage.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "0,step_0,") {
+		t.Errorf("ResourceUsage.csv was:\n%s", b)
+	}
+
+	var found bool
+	for _, u := range client.updates {
+		if strings.Contains(u.Message, "finished successfully (peak memory 2.0 MiB, CPU time 1.0s") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("the usage summary wasn't published")
+	}
+}